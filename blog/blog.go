@@ -0,0 +1,115 @@
+// Package blog renders users' hosted blogs. The same data is given to the
+// bundled template and to custom templates uploaded by users, so anything a
+// theme can show, a custom template can show too.
+package blog
+
+import (
+	"html/template"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPostsPerPage = 10
+	MaxPostsPerPage     = 50
+	MaxCustomCSSLength  = 32 * 1024
+)
+
+// Theme is a bundled look for blogs using the default template.
+type Theme struct {
+	Name        string
+	DisplayName string
+	Stylesheet  string
+}
+
+const DefaultTheme = "classic"
+
+var Themes = []Theme{
+	{Name: "classic", DisplayName: "Classic", Stylesheet: "/assets/css/main.css"},
+	{Name: "minimal", DisplayName: "Minimal", Stylesheet: "/assets/css/blog/minimal.css"},
+	{Name: "serif", DisplayName: "Serif", Stylesheet: "/assets/css/blog/serif.css"},
+}
+
+// FindTheme returns the theme with the given name, or the default one.
+func FindTheme(name string) Theme {
+	for _, theme := range Themes {
+		if theme.Name == name {
+			return theme
+		}
+	}
+	return FindTheme(DefaultTheme)
+}
+
+func IsValidTheme(name string) bool {
+	for _, theme := range Themes {
+		if theme.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type NavLink struct {
+	Title string
+	URL   string
+}
+
+// Site describes the blog itself and is available to every template.
+type Site struct {
+	Title       string
+	Description string
+	Author      string
+	// URL of the blog's homepage, every other URL is relative to it
+	URL        string
+	Lang       string
+	Nav        []NavLink
+	Stylesheet string
+	CustomCSS  template.CSS
+}
+
+type PostSummary struct {
+	Title              string
+	URL                string
+	Excerpt            string
+	PublishedDate      time.Time
+	Tags               []string
+	ReadingTimeMinutes int
+}
+
+type Post struct {
+	PostSummary
+	Lang string
+	Body template.HTML
+	// the author asked search engines not to index the post
+	NoIndex bool
+}
+
+type Pagination struct {
+	Page       int
+	TotalPages int
+	// empty when there's no previous/next page
+	PrevURL string
+	NextURL string
+}
+
+// IndexData is given to the "index" template.
+type IndexData struct {
+	Site Site
+	// absolute URL of this page where search engines should index it
+	CanonicalURL string
+	Posts        []PostSummary
+	Pagination   Pagination
+}
+
+// PostData is given to the "post" template, for both posts and pages.
+type PostData struct {
+	Site         Site
+	CanonicalURL string
+	Post         Post
+}
+
+// SanitizeCSS makes user provided CSS safe to put inside a <style> element.
+// "<" has no use in CSS outside of strings, where the escape works the same.
+func SanitizeCSS(css string) template.CSS {
+	return template.CSS(strings.ReplaceAll(css, "<", `\3c `))
+}
@@ -0,0 +1,265 @@
+package blog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	MaxTemplateLength = 64 * 1024
+	// templates can call each other and loop over data, limiting how deep
+	// loops can nest keeps a template from running for ages
+	maxRangeDepth   = 3
+	maxOutputLength = 2 * 1024 * 1024
+	executeTimeout  = 2 * time.Second
+)
+
+// templateFuncs is everything templates can call besides the html/template
+// builtins. It's the same for the bundled and custom templates, and none of
+// the functions give access to anything but their arguments.
+var templateFuncs = template.FuncMap{
+	"dateFmt": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"join": func(sep string, items []string) string {
+		return strings.Join(items, sep)
+	},
+	"truncate": func(length int, s string) string {
+		if utf8.RuneCountInString(s) <= length {
+			return s
+		}
+		return string([]rune(s)[:length]) + "…"
+	},
+}
+
+// ParseTemplate parses a blog template and checks that it defines "index"
+// and "post" and can't run away.
+func ParseTemplate(text string) (*template.Template, error) {
+	if len(text) > MaxTemplateLength {
+		return nil, fmt.Errorf("the template can't be longer than %d KiB", MaxTemplateLength/1024)
+	}
+
+	tmpl, err := template.New("blog").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{"index", "post"} {
+		if tmpl.Lookup(name) == nil {
+			return nil, fmt.Errorf(`the template must define "%s" with {{define "%s"}}...{{end}}`, name, name)
+		}
+	}
+
+	err = checkTemplates(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// checkTemplates rejects loops over numbers, templates that end up calling
+// themselves, and loops nested too deep, counting the loops of called
+// templates.
+func checkTemplates(tmpl *template.Template) error {
+	trees := map[string]*parse.Tree{}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			trees[t.Name()] = t.Tree
+		}
+	}
+
+	depths := map[string]int{}
+	visiting := map[string]bool{}
+
+	var templateDepth func(name string) (int, error)
+	var nodeDepth func(node parse.Node) (int, error)
+
+	templateDepth = func(name string) (int, error) {
+		if depth, ok := depths[name]; ok {
+			return depth, nil
+		}
+		if visiting[name] {
+			return 0, fmt.Errorf(`template "%s" ends up calling itself`, name)
+		}
+		tree, ok := trees[name]
+		if !ok {
+			return 0, nil
+		}
+
+		visiting[name] = true
+		depth, err := nodeDepth(tree.Root)
+		visiting[name] = false
+		if err != nil {
+			return 0, err
+		}
+
+		depths[name] = depth
+		return depth, nil
+	}
+
+	nodeDepth = func(node parse.Node) (int, error) {
+		maxDepth := 0
+		children := func(nodes ...parse.Node) error {
+			for _, child := range nodes {
+				if child == nil || child == (*parse.ListNode)(nil) {
+					continue
+				}
+				depth, err := nodeDepth(child)
+				if err != nil {
+					return err
+				}
+				maxDepth = max(maxDepth, depth)
+			}
+			return nil
+		}
+
+		var err error
+		switch node := node.(type) {
+		case *parse.ListNode:
+			err = children(listNodes(node)...)
+
+		case *parse.IfNode:
+			err = children(node.List, node.ElseList)
+
+		case *parse.WithNode:
+			err = children(node.List, node.ElseList)
+
+		case *parse.RangeNode:
+			if !isDataPipe(node.Pipe) {
+				return 0, errors.New("range can only loop over data, like {{range .Posts}}")
+			}
+			err = children(node.List, node.ElseList)
+			maxDepth++
+
+		case *parse.TemplateNode:
+			maxDepth, err = templateDepth(node.Name)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if maxDepth > maxRangeDepth {
+			return 0, fmt.Errorf("loops can't be nested more than %d levels deep", maxRangeDepth)
+		}
+		return maxDepth, nil
+	}
+
+	for name := range trees {
+		if _, err := templateDepth(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listNodes(list *parse.ListNode) []parse.Node {
+	if list == nil {
+		return nil
+	}
+	return list.Nodes
+}
+
+// isDataPipe reports whether the pipeline is just a field or variable, as
+// opposed to a literal number or the result of a function.
+func isDataPipe(pipe *parse.PipeNode) bool {
+	if pipe == nil || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+	switch pipe.Cmds[0].Args[0].(type) {
+	case *parse.FieldNode, *parse.VariableNode, *parse.DotNode, *parse.ChainNode:
+		return true
+	}
+	return false
+}
+
+var errOutputTooLong = errors.New("the template produced too much output")
+
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > maxOutputLength {
+		return 0, errOutputTooLong
+	}
+	return b.Buffer.Write(p)
+}
+
+// Execute runs the named template into w. Nothing is written if the template
+// fails, takes too long or produces too much output.
+func Execute(ctx context.Context, w io.Writer, tmpl *template.Template, name string, data any) error {
+	ctx, cancel := context.WithTimeout(ctx, executeTimeout)
+	defer cancel()
+
+	var buf limitedBuffer
+	done := make(chan error, 1)
+	go func() {
+		done <- tmpl.ExecuteTemplate(&buf, name, data)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		_, err = buf.WriteTo(w)
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("template took too long to run: %w", ctx.Err())
+	}
+}
+
+// CheckTemplate parses a template and runs it with example data, to catch
+// mistakes like misspelled fields before the template goes live.
+func CheckTemplate(text string) error {
+	tmpl, err := ParseTemplate(text)
+	if err != nil {
+		return err
+	}
+
+	site := Site{
+		Title:      "Example blog",
+		Author:     "example",
+		URL:        "/",
+		Lang:       "en",
+		Nav:        []NavLink{{Title: "About", URL: "/about"}},
+		Stylesheet: FindTheme(DefaultTheme).Stylesheet,
+	}
+	summary := PostSummary{
+		Title:              "Example post",
+		URL:                "/example-post",
+		Excerpt:            "The first words of the example post.",
+		PublishedDate:      time.Now(),
+		Tags:               []string{"example"},
+		ReadingTimeMinutes: 1,
+	}
+
+	examples := map[string]any{
+		"index": IndexData{
+			Site:       site,
+			Posts:      []PostSummary{summary},
+			Pagination: Pagination{Page: 1, TotalPages: 2, NextURL: "/?page=2"},
+		},
+		"post": PostData{
+			Site: site,
+			Post: Post{PostSummary: summary, Lang: "en", Body: "<p>The first words of the example post.</p>"},
+		},
+	}
+	for name, data := range examples {
+		err = Execute(context.Background(), io.Discard, tmpl, name, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
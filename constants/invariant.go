@@ -6,4 +6,6 @@ const (
 	PUBLIC_URL        = "https://kitty.meadow.cafe"
 	MAX_POSTS_TO_SHOW = 2_000
 	MAX_POST_LENGTH   = 20_500
+	MAX_TAGS_PER_POST = 20
+	MAX_TAG_LENGTH    = 50
 )
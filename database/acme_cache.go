@@ -0,0 +1,36 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/crypto/acme/autocert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ACMECache keeps certificates in the database so that every instance
+// sharing it can serve them. It implements autocert.Cache.
+type ACMECache struct{}
+
+func (ACMECache) Get(ctx context.Context, key string) ([]byte, error) {
+	var entry ACMECacheEntry
+	result := GetDB().WithContext(ctx).Where(&ACMECacheEntry{Key: key}).First(&entry)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, autocert.ErrCacheMiss
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	return entry.Data, nil
+}
+
+func (ACMECache) Put(ctx context.Context, key string, data []byte) error {
+	return GetDB().WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "data"}),
+	}).Create(&ACMECacheEntry{Key: key, Data: data}).Error
+}
+
+func (ACMECache) Delete(ctx context.Context, key string) error {
+	return GetDB().WithContext(ctx).Delete(&ACMECacheEntry{Key: key}).Error
+}
@@ -0,0 +1,201 @@
+package database
+
+import (
+	"crypto/rand"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const analyticsSaltLength = 32
+
+// GetAnalyticsSalt returns the salt of the visitor hashes of the given day,
+// creating it on the first view of the day. Salts and visitors of earlier
+// days are deleted then, so that visitors can't be followed across days.
+func GetAnalyticsSalt(day string) ([]byte, error) {
+	var salt AnalyticsSalt
+	result := GetDB().Where("day = ?", day).Limit(1).Find(&salt)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return salt.Salt, nil
+	}
+
+	salt = AnalyticsSalt{Day: day, Salt: make([]byte, analyticsSaltLength)}
+	if _, err := rand.Read(salt.Salt); err != nil {
+		return nil, err
+	}
+
+	err := GetDB().Transaction(func(tx *gorm.DB) error {
+		// another request may have created it in the meantime
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&salt)
+		if result.Error != nil {
+			return result.Error
+		}
+		if err := tx.Where("day < ?", day).Delete(&AnalyticsSalt{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("day < ?", day).Delete(&AnalyticsVisitor{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result = GetDB().Where("day = ?", day).First(&salt)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return salt.Salt, nil
+}
+
+// PageView is a single view of a public page.
+type PageView struct {
+	AdminUserID uint
+	// 0 for the user's homepage
+	PostID      uint
+	Day         string
+	VisitorHash string
+	// empty for direct visits and links from the same site
+	ReferrerDomain string
+}
+
+// RecordPageView adds a view to the counts of its page and of the user.
+func RecordPageView(view PageView) error {
+	return GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&AnalyticsVisitor{
+			Day:         view.Day,
+			AdminUserID: view.AdminUserID,
+			AllPages:    true,
+			Hash:        view.VisitorHash,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			result = tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "admin_user_id"}, {Name: "day"}},
+				DoUpdates: clause.Assignments(map[string]any{"visitors": gorm.Expr("visitor_counts.visitors + 1")}),
+			}).Create(&VisitorCount{AdminUserID: view.AdminUserID, Day: view.Day, Visitors: 1})
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		result = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&AnalyticsVisitor{
+			Day:         view.Day,
+			AdminUserID: view.AdminUserID,
+			PostID:      view.PostID,
+			Hash:        view.VisitorHash,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		newVisitor := result.RowsAffected
+
+		result = tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "admin_user_id"}, {Name: "post_id"}, {Name: "day"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"views":    gorm.Expr("page_view_counts.views + 1"),
+				"visitors": gorm.Expr("page_view_counts.visitors + ?", newVisitor),
+			}),
+		}).Create(&PageViewCount{
+			AdminUserID: view.AdminUserID,
+			PostID:      view.PostID,
+			Day:         view.Day,
+			Views:       1,
+			Visitors:    newVisitor,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if view.ReferrerDomain == "" {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "admin_user_id"}, {Name: "post_id"}, {Name: "day"}, {Name: "domain"}},
+			DoUpdates: clause.Assignments(map[string]any{"views": gorm.Expr("referrer_counts.views + 1")}),
+		}).Create(&ReferrerCount{
+			AdminUserID: view.AdminUserID,
+			PostID:      view.PostID,
+			Day:         view.Day,
+			Domain:      view.ReferrerDomain,
+			Views:       1,
+		}).Error
+	})
+}
+
+// DailyViews is the number of views of all the pages of a user on a day.
+type DailyViews struct {
+	Day      string
+	Views    int64
+	Visitors int64
+}
+
+// GetDailyViews returns the views of the user's pages from the since day on,
+// days without views are left out.
+func GetDailyViews(userID uint, since string) ([]DailyViews, error) {
+	var days []DailyViews
+	result := GetDB().Model(&PageViewCount{}).
+		Select("page_view_counts.day, SUM(page_view_counts.views) AS views, MAX(visitor_counts.visitors) AS visitors").
+		Joins("LEFT JOIN visitor_counts ON visitor_counts.admin_user_id = page_view_counts.admin_user_id AND visitor_counts.day = page_view_counts.day").
+		Where("page_view_counts.admin_user_id = ? AND page_view_counts.day >= ?", userID, since).
+		Group("page_view_counts.day").
+		Order("page_view_counts.day ASC").
+		Scan(&days)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return days, nil
+}
+
+// PageViews is the number of views of a page of a user over a period.
+type PageViews struct {
+	// 0 for the homepage
+	PostID uint
+	// empty for the homepage and deleted posts
+	Title    string
+	Views    int64
+	Visitors int64
+}
+
+// GetTopPages returns the user's most viewed pages from the since day on.
+func GetTopPages(userID uint, since string, limit int) ([]PageViews, error) {
+	var pages []PageViews
+	result := GetDB().Model(&PageViewCount{}).
+		Select("page_view_counts.post_id, posts.title, SUM(page_view_counts.views) AS views, SUM(page_view_counts.visitors) AS visitors").
+		Joins("LEFT JOIN posts ON posts.id = page_view_counts.post_id AND posts.deleted_at IS NULL").
+		Where("page_view_counts.admin_user_id = ? AND page_view_counts.day >= ?", userID, since).
+		Group("page_view_counts.post_id, posts.title").
+		Order("views DESC").
+		Limit(limit).
+		Scan(&pages)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return pages, nil
+}
+
+// ReferrerViews is the number of views coming from a site over a period.
+type ReferrerViews struct {
+	Domain string
+	Views  int64
+}
+
+// GetTopReferrers returns the sites linking to the user's pages the most from
+// the since day on.
+func GetTopReferrers(userID uint, since string, limit int) ([]ReferrerViews, error) {
+	var referrers []ReferrerViews
+	result := GetDB().Model(&ReferrerCount{}).
+		Select("domain, SUM(views) AS views").
+		Where("admin_user_id = ? AND day >= ?", userID, since).
+		Group("domain").
+		Order("views DESC").
+		Limit(limit).
+		Scan(&referrers)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return referrers, nil
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CreateAPIToken stores the hash of secret, the value clients send, along
+// with the token.
+func CreateAPIToken(token *APIToken, secret string) error {
+	token.TokenHash = hashToken(secret)
+	return db.Create(token).Error
+}
+
+// GetAPIToken returns the unrevoked token whose value is secret, with its
+// user, or nil if there's none. The token's last use is updated.
+func GetAPIToken(secret string) (*APIToken, *AdminUser, error) {
+	var token APIToken
+	result := db.Where("token_hash = ? AND revoked_at IS NULL", hashToken(secret)).First(&token)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil, nil
+		}
+		return nil, nil, result.Error
+	}
+
+	var user AdminUser
+	result = db.First(&user, token.AdminUserID)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil, nil
+		}
+		return nil, nil, result.Error
+	}
+
+	now := time.Now()
+	result = db.Model(&token).UpdateColumn("last_used_at", &now)
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	return &token, &user, nil
+}
+
+// GetUserAPITokens returns the user's unrevoked tokens, newest first.
+func GetUserAPITokens(userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	result := db.Where("admin_user_id = ? AND revoked_at IS NULL", userID).
+		Order("created_at DESC").
+		Find(&tokens)
+	return tokens, result.Error
+}
+
+// RevokeAPIToken revokes one of the user's tokens, doing nothing if the user
+// has no such token.
+func RevokeAPIToken(userID uint, tokenID uint) error {
+	return db.Model(&APIToken{}).
+		Where("id = ? AND admin_user_id = ? AND revoked_at IS NULL", tokenID, userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeAPITokenBySecret revokes the token whose value is secret, for clients
+// giving up their token. Unknown tokens are ignored.
+func RevokeAPITokenBySecret(secret string) error {
+	return db.Model(&APIToken{}).
+		Where("token_hash = ? AND revoked_at IS NULL", hashToken(secret)).
+		Update("revoked_at", time.Now()).Error
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func IsValidCommentStatus(status CommentStatus) bool {
+	switch status {
+	case CommentStatusPending, CommentStatusApproved, CommentStatusRejected, CommentStatusSpam:
+		return true
+	}
+	return false
+}
+
+// GetComment returns the comment with the given ID if it's on one of the
+// user's posts, nil otherwise.
+func GetComment(userID uint, commentID uint) (*Comment, error) {
+	var comment Comment
+	result := db.Where("admin_user_id = ?", userID).First(&comment, commentID)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &comment, nil
+}
+
+// GetUserComments returns the comments on the user's posts with the given
+// status, with their post. Pending comments come oldest first, in the order
+// they should be moderated, the others newest first.
+func GetUserComments(userID uint, status CommentStatus, limit int) ([]Comment, error) {
+	order := "comments.created_at DESC"
+	if status == CommentStatusPending {
+		order = "comments.created_at ASC"
+	}
+
+	var comments []Comment
+	result := db.Preload("Post").
+		Where("admin_user_id = ? AND status = ?", userID, status).
+		Order(order).
+		Limit(limit).
+		Find(&comments)
+	return comments, result.Error
+}
+
+// CountCommentsByStatus returns the number of comments on the user's posts
+// for each status.
+func CountCommentsByStatus(userID uint) (map[CommentStatus]int64, error) {
+	var rows []struct {
+		Status CommentStatus
+		Count  int64
+	}
+	result := db.Model(&Comment{}).
+		Select("status, COUNT(*) AS count").
+		Where("admin_user_id = ?", userID).
+		Group("status").
+		Scan(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	counts := make(map[CommentStatus]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+// GetApprovedComments returns the comments shown under a post, oldest first.
+func GetApprovedComments(postID uint) ([]Comment, error) {
+	comments := []Comment{}
+	result := db.Where("post_id = ? AND status = ?", postID, CommentStatusApproved).
+		Order("created_at ASC").
+		Find(&comments)
+	return comments, result.Error
+}
+
+// CommentsLastModified returns when a comment on the post was last submitted
+// or moderated, pages showing comments use it to notice changes.
+func CommentsLastModified(postID uint) (time.Time, error) {
+	var comment Comment
+	result := db.Select("updated_at").Where("post_id = ?", postID).
+		Order("updated_at DESC").Limit(1).Find(&comment)
+	return comment.UpdatedAt, result.Error
+}
+
+func SetCommentStatus(comment *Comment, status CommentStatus) error {
+	return db.Model(comment).Update("status", status).Error
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"log"
+	"os"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -9,18 +10,68 @@ import (
 
 var db *gorm.DB
 
+// initDatabase opens the database in the file named by KITTY_DATABASE,
+// kitty.db by default.
 func initDatabase() {
+	path := os.Getenv("KITTY_DATABASE")
+	if path == "" {
+		path = "kitty.db"
+	}
+
 	var err error
-	db, err = gorm.Open(sqlite.Open("file:kitty.db?cache=shared&mode=rwc&_journal_mode=WAL"), &gorm.Config{})
+	db, err = gorm.Open(sqlite.Open("file:"+path+"?cache=shared&mode=rwc&_journal_mode=WAL"), &gorm.Config{})
 	if err != nil {
 		log.Fatalf("failed to connect database: %v", err)
 	}
 
 	// Migrate the schema
-	err = db.AutoMigrate(&Post{}, &AdminUser{})
+	err = db.AutoMigrate(&Post{}, &AdminUser{}, &InstanceSettings{}, &InviteCode{}, &AuditLogEntry{}, &UserToken{}, &OIDCIdentity{}, &RenderCacheEntry{}, &Blog{}, &CustomDomain{}, &ACMECacheEntry{}, &Tag{}, &Series{}, &PostShareLink{}, &Upvote{}, &Comment{}, &Webmention{}, &APIToken{}, &IndieAuthCode{}, &MediaFile{}, &PageViewCount{}, &ReferrerCount{}, &VisitorCount{}, &AnalyticsVisitor{}, &AnalyticsSalt{})
 	if err != nil {
 		log.Fatalf("failed to migrate database: %v", err)
 	}
+
+	// posts without a password used to have a NULL hash
+	err = db.Unscoped().Model(&Post{}).Where("password_hash IS NULL").Update("password_hash", "").Error
+	if err != nil {
+		log.Fatalf("failed to migrate post passwords: %v", err)
+	}
+
+	err = migrateLegacyTags()
+	if err != nil {
+		log.Fatalf("failed to migrate post tags: %v", err)
+	}
+
+	err = ensureInstanceHasAdmin()
+	if err != nil {
+		log.Fatalf("failed to set up instance administrator: %v", err)
+	}
+}
+
+// ensureInstanceHasAdmin promotes the oldest user to instance administrator
+// when there are users but none of them is an administrator, which is the
+// case for instances created before the admin role existed.
+func ensureInstanceHasAdmin() error {
+	var adminCount int64
+	result := db.Model(&AdminUser{}).Where("is_admin = ?", true).Count(&adminCount)
+	if result.Error != nil {
+		return result.Error
+	}
+	if adminCount > 0 {
+		return nil
+	}
+
+	var oldest AdminUser
+	result = db.Order("id ASC").Limit(1).Find(&oldest)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		// no users yet, the first one to sign up will become the administrator
+		return nil
+	}
+
+	log.Printf("No instance administrator found, promoting user '%s' (ID %d)", oldest.Username, oldest.ID)
+	return db.Model(&oldest).Update("is_admin", true).Error
 }
 
 func GetDB() *gorm.DB {
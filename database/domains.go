@@ -0,0 +1,99 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// verified domains are looked up on every request, so they're kept in memory
+// and reloaded after any change
+var (
+	verifiedDomains     map[string]uint
+	verifiedDomainsLock sync.RWMutex
+)
+
+// LookupVerifiedDomain returns the ID of the user that verified domain.
+func LookupVerifiedDomain(domain string) (uint, bool, error) {
+	verifiedDomainsLock.RLock()
+	if verifiedDomains != nil {
+		userID, ok := verifiedDomains[domain]
+		verifiedDomainsLock.RUnlock()
+		return userID, ok, nil
+	}
+	verifiedDomainsLock.RUnlock()
+
+	verifiedDomainsLock.Lock()
+	defer verifiedDomainsLock.Unlock()
+
+	if verifiedDomains == nil {
+		var rows []CustomDomain
+		result := GetDB().Where("verified_at IS NOT NULL").Find(&rows)
+		if result.Error != nil {
+			return 0, false, result.Error
+		}
+
+		verifiedDomains = make(map[string]uint, len(rows))
+		for _, row := range rows {
+			verifiedDomains[row.Domain] = row.AdminUserID
+		}
+	}
+
+	userID, ok := verifiedDomains[domain]
+	return userID, ok, nil
+}
+
+func invalidateVerifiedDomains() {
+	verifiedDomainsLock.Lock()
+	verifiedDomains = nil
+	verifiedDomainsLock.Unlock()
+}
+
+// GetCustomDomain returns the domain claimed by the user, or nil.
+func GetCustomDomain(userID uint) (*CustomDomain, error) {
+	var domain CustomDomain
+	result := GetDB().Where(&CustomDomain{AdminUserID: userID}).First(&domain)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	return &domain, nil
+}
+
+// ClaimCustomDomain sets the (unverified) domain of the user, replacing any
+// previous one.
+func ClaimCustomDomain(userID uint, domain string, token string) error {
+	defer invalidateVerifiedDomains()
+
+	return GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("admin_user_id = ?", userID).Delete(&CustomDomain{})
+		if result.Error != nil {
+			return result.Error
+		}
+		return tx.Create(&CustomDomain{AdminUserID: userID, Domain: domain, VerificationToken: token}).Error
+	})
+}
+
+// MarkCustomDomainVerified verifies the domain, taking it away from any other
+// user that verified it before, since they no longer control its DNS.
+func MarkCustomDomainVerified(customDomain *CustomDomain) error {
+	defer invalidateVerifiedDomains()
+
+	return GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&CustomDomain{}).
+			Where("domain = ? AND id <> ? AND verified_at IS NOT NULL", customDomain.Domain, customDomain.ID).
+			Update("verified_at", nil)
+		if result.Error != nil {
+			return result.Error
+		}
+		return tx.Model(customDomain).Update("verified_at", time.Now()).Error
+	})
+}
+
+func DeleteCustomDomain(userID uint) error {
+	defer invalidateVerifiedDomains()
+	return GetDB().Where("admin_user_id = ?", userID).Delete(&CustomDomain{}).Error
+}
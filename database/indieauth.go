@@ -0,0 +1,45 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CreateIndieAuthCode stores the hash of secret, the code given to the client,
+// along with what it was issued for. Expired codes are cleaned up on the way.
+func CreateIndieAuthCode(code *IndieAuthCode, secret string) error {
+	result := db.Where("expires_at < ?", time.Now()).Delete(&IndieAuthCode{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	code.CodeHash = hashToken(secret)
+	return db.Create(code).Error
+}
+
+// ConsumeIndieAuthCode marks a valid code as used and returns it. Returns nil
+// if the code is unknown, expired or was already used.
+func ConsumeIndieAuthCode(secret string) (*IndieAuthCode, error) {
+	var code IndieAuthCode
+	result := db.Where("code_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(secret), time.Now()).First(&code)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+
+	// guard against the same code being redeemed twice concurrently
+	now := time.Now()
+	result = db.Model(&IndieAuthCode{}).Where("id = ? AND used_at IS NULL", code.ID).Update("used_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, nil
+	}
+
+	code.UsedAt = &now
+	return &code, nil
+}
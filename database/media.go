@@ -0,0 +1,20 @@
+package database
+
+import "gorm.io/gorm"
+
+func CreateMediaFile(file *MediaFile) error {
+	return db.Create(file).Error
+}
+
+// GetMediaFile returns the file with the given name, or nil if there's none.
+func GetMediaFile(name string) (*MediaFile, error) {
+	var file MediaFile
+	result := db.Where("name = ?", name).First(&file)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &file, nil
+}
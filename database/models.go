@@ -1,6 +1,7 @@
 package database
 
 import (
+	"strings"
 	"time"
 
 	"gorm.io/datatypes"
@@ -18,8 +19,167 @@ type Post struct {
 	MetaDescription string
 	MetaImage       string
 	Lang            string
-	Tags            datatypes.JSON
+	Tags            []Tag `gorm:"many2many:post_tags"`
 	Published       bool
+	HiddenByAdmin   bool `gorm:"index"`
+	// nil means the author's default render options are used
+	RenderOptions *RenderOptions `gorm:"serializer:json"`
+	// the series the post is part of, if any, and its place in it starting at 1
+	SeriesID       *uint   `gorm:"index"`
+	Series         *Series `json:",omitempty"`
+	SeriesPosition int
+	// kept out of sitemaps and marked noindex for search engines
+	NoIndex bool
+	// who can read the post once it's published, drafts are always private
+	Visibility PostVisibility `gorm:"default:public"`
+	// bcrypt hash of the password readers must enter, empty when the post
+	// isn't password protected
+	PasswordHash string `gorm:"default:''" json:"-"`
+	// number of Upvote rows of the post, kept here to sort by it
+	Upvotes int64 `gorm:"not null;default:0"`
+	// readers can submit comments, which the author moderates
+	CommentsEnabled bool
+}
+
+type PostVisibility string
+
+const (
+	// listed everywhere: the author's profile and blog, tags, series,
+	// feeds, sitemaps and the API
+	PostVisibilityPublic = PostVisibility("public")
+	// readable by anyone with its URL but not listed anywhere
+	PostVisibilityUnlisted = PostVisibility("unlisted")
+	// only readable by its author and through share links
+	PostVisibilityPrivate = PostVisibility("private")
+)
+
+func IsValidPostVisibility(visibility PostVisibility) bool {
+	switch visibility {
+	case PostVisibilityPublic, PostVisibilityUnlisted, PostVisibilityPrivate:
+		return true
+	}
+	return false
+}
+
+// IsReadableByURL reports whether anyone with the post's URL can read it,
+// leaving moderation aside.
+func (p *Post) IsReadableByURL() bool {
+	return p.Published && p.Visibility != PostVisibilityPrivate
+}
+
+func (p *Post) IsPasswordProtected() bool {
+	return p.PasswordHash != ""
+}
+
+// Upvote is an anonymous upvote of a post. VoterHash is derived from the
+// reader's IP address and the post, so each reader can upvote a post once.
+type Upvote struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	PostID    uint   `gorm:"uniqueIndex:idx_upvotes_post_voter"`
+	VoterHash string `gorm:"uniqueIndex:idx_upvotes_post_voter"`
+}
+
+type CommentStatus string
+
+const (
+	// waiting for the post's author to moderate it
+	CommentStatusPending  = CommentStatus("pending")
+	CommentStatusApproved = CommentStatus("approved")
+	CommentStatusRejected = CommentStatus("rejected")
+	CommentStatusSpam     = CommentStatus("spam")
+)
+
+// Comment is a reader's comment on a post, only shown once its author
+// approves it.
+type Comment struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	PostID    uint `gorm:"index"`
+	Post      Post
+	// the post's author, who moderates the comment
+	AdminUserID uint `gorm:"index"`
+	AuthorName  string
+	// optional, the author's name links to it
+	AuthorURL string
+	// Markdown, with only text formatting, lists, quotes, code and links
+	Body   string        `gorm:"type:text"`
+	Status CommentStatus `gorm:"index;default:pending"`
+}
+
+type WebmentionStatus string
+
+const (
+	// received, the source hasn't been checked yet
+	WebmentionStatusPending = WebmentionStatus("pending")
+	// the source links to the post, the mention is shown
+	WebmentionStatusVerified = WebmentionStatus("verified")
+	// the source doesn't link to the post or is gone
+	WebmentionStatusInvalid = WebmentionStatus("invalid")
+)
+
+// Webmention is a page elsewhere linking to a post, which told us about it
+// with a Webmention. A source can mention a target once, mentioning it again
+// means the source was updated.
+type Webmention struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	PostID    uint   `gorm:"index"`
+	Source    string `gorm:"uniqueIndex:idx_webmentions_source_target"`
+	// the URL of the post the source links to
+	Target string           `gorm:"uniqueIndex:idx_webmentions_source_target"`
+	Status WebmentionStatus `gorm:"index;default:pending"`
+	// title of the source, empty until it's verified
+	Title      string
+	VerifiedAt *time.Time
+}
+
+// PostShareLink lets whoever has its token read a post, even a draft or a
+// private one, until it's revoked or expires.
+type PostShareLink struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	PostID    uint `gorm:"index"`
+	Post      Post
+	Token     string `gorm:"uniqueIndex"`
+	// reminds the author who the link was given to
+	Label     string
+	ExpiresAt *time.Time
+	RevokedAt *time.Time
+}
+
+// IsUsable reports whether the share link still gives access to its post.
+func (l *PostShareLink) IsUsable(now time.Time) bool {
+	if l.RevokedAt != nil {
+		return false
+	}
+	return l.ExpiresAt == nil || now.Before(*l.ExpiresAt)
+}
+
+// Tag belongs to a single user, posts by different users never share tags.
+// Slug is derived from Name and is what tag URLs use, two tags of a user can't
+// have the same slug.
+type Tag struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	AdminUserID uint   `gorm:"uniqueIndex:idx_tags_user_slug"`
+	Slug        string `gorm:"uniqueIndex:idx_tags_user_slug"`
+	Name        string
+}
+
+// Series is an ordered collection of posts by the same user, like the parts
+// of a tutorial. A post is part of at most one series.
+type Series struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	AdminUserID uint   `gorm:"uniqueIndex:idx_series_user_slug"`
+	Slug        string `gorm:"uniqueIndex:idx_series_user_slug"`
+	Title       string
+	Description string `gorm:"type:text"`
 }
 
 type AdminUser struct {
@@ -27,5 +187,278 @@ type AdminUser struct {
 	Username     string         `gorm:"uniqueIndex"`
 	PasswordHash datatypes.JSON `gorm:"type:json"`
 	SessionToken string         `gorm:"index;unique"`
-	Posts        []Post         `gorm:"foreignKey:AdminUserID"`
+	// when the session behind SessionToken was started
+	SignedInAt      *time.Time
+	IsAdmin         bool
+	SuspendedAt     *time.Time
+	Email           string `gorm:"index"`
+	EmailVerifiedAt *time.Time
+	// nil means render.DefaultOptions
+	RenderOptions *RenderOptions `gorm:"serializer:json"`
+	Posts         []Post         `gorm:"foreignKey:AdminUserID"`
+}
+
+func (u *AdminUser) IsSuspended() bool {
+	return u.SuspendedAt != nil
+}
+
+type RegistrationMode string
+
+const (
+	RegistrationModeOpen       = RegistrationMode("open")
+	RegistrationModeInviteOnly = RegistrationMode("invite_only")
+	RegistrationModeClosed     = RegistrationMode("closed")
+)
+
+// InstanceSettings holds the settings that apply to the whole instance. There
+// is only ever a single row, see GetInstanceSettings.
+type InstanceSettings struct {
+	ID               uint `gorm:"primarykey"`
+	UpdatedAt        time.Time
+	RegistrationMode RegistrationMode `gorm:"default:open"`
+	// name of the sanitizer.PolicyName used to clean up rendered Markdown
+	HTMLPolicy string `gorm:"default:standard"`
+	// rules served in /robots.txt, empty means the default ones
+	RobotsTxt string `gorm:"type:text"`
+	// key of the HMAC signing cookies, generated when the settings are first
+	// loaded
+	SigningKey []byte `json:"-"`
+	// stops page views from being counted on the whole instance
+	AnalyticsDisabled bool
+}
+
+type InviteCode struct {
+	gorm.Model
+	Code        string `gorm:"uniqueIndex"`
+	CreatedByID *uint
+	UsedByID    *uint
+	UsedAt      *time.Time
+	ExpiresAt   *time.Time
+}
+
+// IsUsable reports whether the invite code can still be used to sign up.
+func (c *InviteCode) IsUsable(now time.Time) bool {
+	if c.UsedByID != nil {
+		return false
+	}
+	return c.ExpiresAt == nil || now.Before(*c.ExpiresAt)
+}
+
+// AuditLogEntry records an action taken by an instance administrator.
+type AuditLogEntry struct {
+	ID         uint `gorm:"primarykey"`
+	CreatedAt  time.Time
+	ActorID    uint `gorm:"index"`
+	Actor      AdminUser
+	Action     string
+	TargetType string
+	TargetID   uint
+	Details    string
+}
+
+type UserTokenPurpose string
+
+const (
+	UserTokenPurposeEmailVerification = UserTokenPurpose("email_verification")
+	UserTokenPurposePasswordReset     = UserTokenPurpose("password_reset")
+)
+
+// UserToken is a single use, time limited token sent to a user out of band
+// (e.g. by email). Only a hash of the token is stored.
+type UserToken struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	AdminUserID uint `gorm:"index"`
+	Purpose     UserTokenPurpose
+	TokenHash   string `gorm:"uniqueIndex"`
+	Email       string // address the token was sent to
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+}
+
+// APIToken lets a client act on behalf of a user, within its scope, e.g. a
+// Micropub client publishing posts. Only a hash of the token is stored.
+type APIToken struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	AdminUserID uint `gorm:"index"`
+	// reminds the user what the token is for
+	Name string
+	// space separated list of what the token allows, e.g. "create media"
+	Scope     string
+	TokenHash string `gorm:"uniqueIndex"`
+	// the IndieAuth client the token was issued to, empty for the tokens
+	// created in the dashboard
+	ClientID   string
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+// HasScope reports whether the token was granted the given scope.
+func (t *APIToken) HasScope(scope string) bool {
+	return scopeIncludes(t.Scope, scope)
+}
+
+func scopeIncludes(list string, scope string) bool {
+	for _, s := range strings.Fields(list) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IndieAuthCode is an authorization code given to an IndieAuth client once the
+// user allowed it to sign them in. The client exchanges it for the user's
+// profile URL, and an APIToken when it asked for more. Only a hash of the code
+// is stored.
+type IndieAuthCode struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	AdminUserID uint   `gorm:"index"`
+	CodeHash    string `gorm:"uniqueIndex"`
+	ClientID    string
+	RedirectURI string
+	Scope       string
+	// the PKCE challenge, the SHA-256 of the verifier the client must send
+	CodeChallenge string
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+}
+
+// HasScope reports whether the user granted the given scope to the client.
+func (c *IndieAuthCode) HasScope(scope string) bool {
+	return scopeIncludes(c.Scope, scope)
+}
+
+// MediaFile is a file uploaded by a user, e.g. through the Micropub media
+// endpoint, and served under /media/{Name}.
+type MediaFile struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	AdminUserID uint   `gorm:"index"`
+	Name        string `gorm:"uniqueIndex"`
+	ContentType string
+	Data        []byte
+}
+
+// OIDCIdentity links an account at an external OpenID Connect provider to a
+// local user.
+type OIDCIdentity struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	AdminUserID uint   `gorm:"index"`
+	Issuer      string `gorm:"uniqueIndex:idx_oidc_issuer_subject"`
+	Subject     string `gorm:"uniqueIndex:idx_oidc_issuer_subject"`
+	Email       string
+}
+
+// RenderOptions are the Markdown options chosen by a user or for a post. They
+// have the fields of render.Options, which they're converted to when posts are
+// rendered, so that storing them doesn't depend on the renderer.
+type RenderOptions struct {
+	Footnotes          bool `json:"footnotes"`
+	DefinitionLists    bool `json:"definition_lists"`
+	TaskLists          bool `json:"task_lists"`
+	Math               bool `json:"math"`
+	SyntaxHighlighting bool `json:"syntax_highlighting"`
+	HeadingAnchors     bool `json:"heading_anchors"`
+	TableOfContents    bool `json:"table_of_contents"`
+	LinksInNewTab      bool `json:"links_in_new_tab"`
+}
+
+// RenderCacheEntry is rendered Markdown persisted by RenderCacheStore.
+type RenderCacheEntry struct {
+	Key        string `gorm:"primarykey"`
+	CreatedAt  time.Time
+	LastUsedAt time.Time `gorm:"index"`
+	HTML       string    `gorm:"type:text"`
+}
+
+// Blog holds the settings of a user's hosted blog. Users without a row, or
+// with Enabled set to false, only have the plain list of posts at /u/{id}.
+type Blog struct {
+	ID           uint `gorm:"primarykey"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	AdminUserID  uint `gorm:"uniqueIndex"`
+	Enabled      bool
+	Title        string
+	Description  string
+	Theme        string
+	PostsPerPage int
+	CustomCSS    string `gorm:"type:text"`
+	// a Go html/template defining "index" and "post", empty to use the theme's
+	CustomTemplate string `gorm:"type:text"`
+}
+
+// CustomDomain is a domain a user serves their blog from. Several users can
+// claim the same domain, but only the one that last proved control over its
+// DNS has it verified.
+type CustomDomain struct {
+	ID                uint `gorm:"primarykey"`
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	AdminUserID       uint   `gorm:"uniqueIndex"`
+	Domain            string `gorm:"index"`
+	VerificationToken string
+	VerifiedAt        *time.Time
+}
+
+// ACMECacheEntry stores the ACME account key and issued certificates when
+// they're kept in the database, see ACMECache.
+type ACMECacheEntry struct {
+	Key       string `gorm:"primarykey"`
+	UpdatedAt time.Time
+	Data      []byte
+}
+
+// PageViewCount is how many times a page of a user was viewed on a day, in
+// UTC. PostID is 0 for the user's homepage.
+type PageViewCount struct {
+	ID          uint   `gorm:"primarykey"`
+	AdminUserID uint   `gorm:"uniqueIndex:idx_page_view_counts_page_day"`
+	PostID      uint   `gorm:"uniqueIndex:idx_page_view_counts_page_day"`
+	Day         string `gorm:"uniqueIndex:idx_page_view_counts_page_day"` // 2006-01-02
+	Views       int64
+	Visitors    int64
+}
+
+// ReferrerCount is how many views of a page came from links on another site
+// on a day. Only the domain of the linking page is kept.
+type ReferrerCount struct {
+	ID          uint   `gorm:"primarykey"`
+	AdminUserID uint   `gorm:"uniqueIndex:idx_referrer_counts_page_day_domain"`
+	PostID      uint   `gorm:"uniqueIndex:idx_referrer_counts_page_day_domain"`
+	Day         string `gorm:"uniqueIndex:idx_referrer_counts_page_day_domain"`
+	Domain      string `gorm:"uniqueIndex:idx_referrer_counts_page_day_domain"`
+	Views       int64
+}
+
+// VisitorCount is how many different readers viewed any page of a user on a
+// day, which is less than the sum of the visitors of each page.
+type VisitorCount struct {
+	ID          uint   `gorm:"primarykey"`
+	AdminUserID uint   `gorm:"uniqueIndex:idx_visitor_counts_user_day"`
+	Day         string `gorm:"uniqueIndex:idx_visitor_counts_user_day"`
+	Visitors    int64
+}
+
+// AnalyticsVisitor records that a visitor saw a page today, or any page of
+// the user when AllPages is set, so they're only counted once. Hash is
+// derived from the day's salt, which is thrown away along with these rows
+// once the day is over.
+type AnalyticsVisitor struct {
+	ID          uint   `gorm:"primarykey"`
+	Day         string `gorm:"uniqueIndex:idx_analytics_visitors_page_day_hash"`
+	AdminUserID uint   `gorm:"uniqueIndex:idx_analytics_visitors_page_day_hash"`
+	PostID      uint   `gorm:"uniqueIndex:idx_analytics_visitors_page_day_hash"`
+	AllPages    bool   `gorm:"uniqueIndex:idx_analytics_visitors_page_day_hash"`
+	Hash        string `gorm:"uniqueIndex:idx_analytics_visitors_page_day_hash"`
+}
+
+// AnalyticsSalt is the random salt of the visitor hashes of a day.
+type AnalyticsSalt struct {
+	Day  string `gorm:"primarykey"`
+	Salt []byte
 }
@@ -1,6 +1,10 @@
 package database
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 func GetPostWithSlug(slug string) (*Post, error) {
 	var post Post
@@ -13,3 +17,226 @@ func GetPostWithSlug(slug string) (*Post, error) {
 	}
 	return &post, nil
 }
+
+// ListedPosts is a scope selecting the posts that show up in lists: published,
+// public and not hidden by an admin.
+func ListedPosts(db *gorm.DB) *gorm.DB {
+	return db.Where("posts.published = ? AND posts.hidden_by_admin = ? AND posts.visibility = ?", true, false, PostVisibilityPublic)
+}
+
+// ReadablePosts is a scope selecting the posts anyone can read given their
+// URL, the listed ones plus the unlisted ones.
+func ReadablePosts(db *gorm.DB) *gorm.DB {
+	return db.Where("posts.published = ? AND posts.hidden_by_admin = ? AND posts.visibility <> ?", true, false, PostVisibilityPrivate)
+}
+
+// DeletePost deletes a post, taking it out of its series and removing its
+// tags first so that it doesn't count towards either anymore.
+func DeletePost(post *Post) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := SetPostTags(tx, post, nil); err != nil {
+			return err
+		}
+		if err := SetPostSeries(tx, post, nil); err != nil {
+			return err
+		}
+		for _, model := range []any{&PostShareLink{}, &Upvote{}, &Comment{}, &Webmention{}} {
+			if err := tx.Where("post_id = ?", post.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(post).Error
+	})
+}
+
+func GetInviteCode(code string) (*InviteCode, error) {
+	var invite InviteCode
+	result := db.Where("code = ?", code).First(&invite)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &invite, nil
+}
+
+// IsUsernameTaken checks (case insensitively) whether any user, including
+// deleted ones, already has the given username.
+func IsUsernameTaken(username string) (bool, error) {
+	var count int64
+	result := db.Unscoped().Model(&AdminUser{}).Where("LOWER(username) = LOWER(?)", username).Count(&count)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return count > 0, nil
+}
+
+type UserStats struct {
+	ID           uint
+	Username     string
+	CreatedAt    time.Time
+	IsAdmin      bool
+	SuspendedAt  *time.Time
+	PostCount    int64
+	StorageBytes int64
+}
+
+// ListUsersWithStats returns every user along with how many posts they have
+// and how much space their post bodies take up.
+func ListUsersWithStats() ([]UserStats, error) {
+	var stats []UserStats
+	result := db.Model(&AdminUser{}).
+		Select(`admin_users.id, admin_users.username, admin_users.created_at, admin_users.is_admin,
+			admin_users.suspended_at, COUNT(posts.id) AS post_count,
+			COALESCE(SUM(LENGTH(posts.body)), 0) AS storage_bytes`).
+		Joins("LEFT JOIN posts ON posts.admin_user_id = admin_users.id AND posts.deleted_at IS NULL").
+		Group("admin_users.id").
+		Order("admin_users.id ASC").
+		Scan(&stats)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return stats, nil
+}
+
+// CreateUser inserts a new user. The very first user of an instance becomes
+// its administrator.
+func CreateUser(tx *gorm.DB, user *AdminUser) error {
+	var userCount int64
+	if result := tx.Model(&AdminUser{}).Count(&userCount); result.Error != nil {
+		return result.Error
+	}
+	user.IsAdmin = userCount == 0
+
+	return tx.Create(user).Error
+}
+
+// DeleteUserAndPosts permanently deletes a user along with all of their posts.
+func DeleteUserAndPosts(userID uint) error {
+	defer invalidateVerifiedDomains()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec("DELETE FROM post_tags WHERE tag_id IN (SELECT id FROM tags WHERE admin_user_id = ?)", userID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		for _, model := range []any{&PostShareLink{}, &Upvote{}, &Comment{}, &Webmention{}} {
+			result = tx.Where("post_id IN (SELECT id FROM posts WHERE admin_user_id = ?)", userID).Delete(model)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		result = tx.Unscoped().Where("admin_user_id = ?", userID).Delete(&Post{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		for _, model := range []any{&UserToken{}, &OIDCIdentity{}, &Blog{}, &CustomDomain{}, &Tag{}, &Series{}, &PageViewCount{}, &ReferrerCount{}, &VisitorCount{}, &AnalyticsVisitor{}, &APIToken{}, &IndieAuthCode{}, &MediaFile{}} {
+			result = tx.Where("admin_user_id = ?", userID).Delete(model)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		return tx.Unscoped().Delete(&AdminUser{}, userID).Error
+	})
+}
+
+func RecordAuditEvent(actorID uint, action string, targetType string, targetID uint, details string) error {
+	entry := AuditLogEntry{
+		ActorID:    actorID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Details:    details,
+	}
+	return db.Create(&entry).Error
+}
+
+func GetOIDCIdentity(issuer string, subject string) (*OIDCIdentity, error) {
+	var identity OIDCIdentity
+	result := db.Where("issuer = ? AND subject = ?", issuer, subject).First(&identity)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &identity, nil
+}
+
+// PostsLastModified returns when any post of the user, including drafts,
+// hidden and deleted posts, last changed. It's the zero time if the user
+// never had any post.
+func PostsLastModified(userID uint) (time.Time, error) {
+	var lastUpdated Post
+	result := GetDB().Unscoped().Select("updated_at").
+		Where("admin_user_id = ?", userID).
+		Order("updated_at DESC").Limit(1).
+		Find(&lastUpdated)
+	if result.Error != nil {
+		return time.Time{}, result.Error
+	}
+
+	var lastDeleted Post
+	result = GetDB().Unscoped().Select("deleted_at").
+		Where("admin_user_id = ? AND deleted_at IS NOT NULL", userID).
+		Order("deleted_at DESC").Limit(1).
+		Find(&lastDeleted)
+	if result.Error != nil {
+		return time.Time{}, result.Error
+	}
+
+	if lastDeleted.DeletedAt.Valid && lastDeleted.DeletedAt.Time.After(lastUpdated.UpdatedAt) {
+		return lastDeleted.DeletedAt.Time, nil
+	}
+	return lastUpdated.UpdatedAt, nil
+}
+
+// SitemapUser is a user with posts search engines can index.
+type SitemapUser struct {
+	UserID    uint
+	PostCount int64
+}
+
+// ListSitemapUsers returns the users who aren't suspended and have listed
+// posts that aren't marked noindex nor protected by a password, along with
+// how many.
+func ListSitemapUsers() ([]SitemapUser, error) {
+	var users []SitemapUser
+	result := GetDB().Model(&Post{}).
+		Select("posts.admin_user_id AS user_id, COUNT(posts.id) AS post_count").
+		Joins("JOIN admin_users ON admin_users.id = posts.admin_user_id AND admin_users.suspended_at IS NULL AND admin_users.deleted_at IS NULL").
+		Scopes(ListedPosts).
+		Where("posts.no_index = ?", false).
+		Where("posts.password_hash = ''").
+		Group("posts.admin_user_id").
+		Order("posts.admin_user_id ASC").
+		Scan(&users)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return users, nil
+}
+
+// ListCustomDomainBlogOwners returns the IDs of users whose blog is enabled
+// and served on a verified custom domain.
+func ListCustomDomainBlogOwners() (map[uint]bool, error) {
+	var userIDs []uint
+	result := GetDB().Model(&Blog{}).
+		Joins("JOIN custom_domains ON custom_domains.admin_user_id = blogs.admin_user_id AND custom_domains.verified_at IS NOT NULL").
+		Where("blogs.enabled = ?", true).
+		Pluck("blogs.admin_user_id", &userIDs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	owners := make(map[uint]bool, len(userIDs))
+	for _, id := range userIDs {
+		owners[id] = true
+	}
+	return owners, nil
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RenderCacheStore keeps rendered Markdown in the database. It implements
+// render.CacheStore.
+type RenderCacheStore struct{}
+
+func (RenderCacheStore) Load(key string) ([]byte, bool, error) {
+	var entry RenderCacheEntry
+	result := GetDB().Where(&RenderCacheEntry{Key: key}).First(&entry)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, false, nil
+	} else if result.Error != nil {
+		return nil, false, result.Error
+	}
+
+	result = GetDB().Model(&entry).Update("last_used_at", time.Now())
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+
+	return []byte(entry.HTML), true, nil
+}
+
+func (RenderCacheStore) Save(key string, html []byte) error {
+	entry := RenderCacheEntry{Key: key, LastUsedAt: time.Now(), HTML: string(html)}
+	return GetDB().Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_used_at", "html"}),
+	}).Create(&entry).Error
+}
+
+func (RenderCacheStore) Delete(key string) error {
+	return GetDB().Delete(&RenderCacheEntry{Key: key}).Error
+}
+
+// PruneRenderCache deletes persisted rendered Markdown that hasn't been used
+// since before the given time, such as old versions of edited posts.
+func PruneRenderCache(unusedSince time.Time) (int64, error) {
+	result := GetDB().Where("last_used_at < ?", unusedSince).Delete(&RenderCacheEntry{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,200 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSeriesExists   = errors.New("a series with that title already exists")
+	ErrSeriesNotFound = errors.New("invalid series")
+)
+
+// SeriesCount is a series along with how many posts are part of it.
+type SeriesCount struct {
+	Series
+	PostCount int64
+}
+
+// GetUserSeries returns the user's series sorted by title. With publicOnly,
+// only listed posts are counted and series without any such post are left
+// out.
+func GetUserSeries(userID uint, publicOnly bool) ([]SeriesCount, error) {
+	query := GetDB().Model(&Series{}).Select("series.*, COUNT(posts.id) AS post_count")
+	if publicOnly {
+		query = query.Joins("LEFT JOIN posts ON posts.series_id = series.id AND posts.deleted_at IS NULL AND posts.published = ? AND posts.hidden_by_admin = ? AND posts.visibility = ?", true, false, PostVisibilityPublic).
+			Having("COUNT(posts.id) > 0")
+	} else {
+		query = query.Joins("LEFT JOIN posts ON posts.series_id = series.id AND posts.deleted_at IS NULL")
+	}
+
+	var series []SeriesCount
+	result := query.
+		Where("series.admin_user_id = ?", userID).
+		Group("series.id").
+		Order("series.title ASC").
+		Scan(&series)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return series, nil
+}
+
+// GetSeriesBySlug returns the user's series with the given slug, or nil.
+func GetSeriesBySlug(userID uint, seriesSlug string) (*Series, error) {
+	var series Series
+	result := GetDB().Where(&Series{AdminUserID: userID, Slug: seriesSlug}).First(&series)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	return &series, nil
+}
+
+// SaveSeries creates or updates a series, deriving its slug from the title.
+// It fails with ErrSeriesExists if the user has another series with the
+// same slug.
+func SaveSeries(series *Series) error {
+	series.Slug = TagSlug(series.Title)
+	if series.Slug == "" {
+		return errors.New("the title must contain letters or numbers")
+	}
+
+	existing, err := GetSeriesBySlug(series.AdminUserID, series.Slug)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.ID != series.ID {
+		return ErrSeriesExists
+	}
+
+	return GetDB().Save(series).Error
+}
+
+// DeleteSeries deletes a series. Its posts stay, they're just not part of a
+// series anymore.
+func DeleteSeries(series *Series) error {
+	return GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Post{}).Unscoped().
+			Where("series_id = ?", series.ID).
+			Updates(map[string]any{"series_id": nil, "series_position": 0, "updated_at": time.Now()})
+		if result.Error != nil {
+			return result.Error
+		}
+		return tx.Delete(series).Error
+	})
+}
+
+// SeriesPosts returns the posts of a series in order. With publicOnly, only
+// listed posts are included.
+func SeriesPosts(seriesID uint, publicOnly bool) ([]Post, error) {
+	query := GetDB().Where("series_id = ?", seriesID)
+	if publicOnly {
+		query = query.Scopes(ListedPosts)
+	}
+
+	var posts []Post
+	result := query.Order("series_position ASC, id ASC").Find(&posts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return posts, nil
+}
+
+// SetPostSeries moves a saved post into the series with the given ID, at its
+// end, or out of any series when seriesID is nil. The series must belong to
+// the post's author, ErrSeriesNotFound is returned otherwise.
+func SetPostSeries(tx *gorm.DB, post *Post, seriesID *uint) error {
+	if post.SeriesID == nil && seriesID == nil ||
+		post.SeriesID != nil && seriesID != nil && *post.SeriesID == *seriesID {
+		return nil
+	}
+
+	previousSeriesID := post.SeriesID
+	post.SeriesID = nil
+	post.SeriesPosition = 0
+
+	if seriesID != nil {
+		var series Series
+		result := tx.Where("admin_user_id = ?", post.AdminUserID).First(&series, *seriesID)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrSeriesNotFound
+		} else if result.Error != nil {
+			return result.Error
+		}
+
+		var lastPosition int
+		result = tx.Model(&Post{}).Where("series_id = ?", series.ID).
+			Select("COALESCE(MAX(series_position), 0)").Scan(&lastPosition)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		post.SeriesID = &series.ID
+		post.SeriesPosition = lastPosition + 1
+	}
+
+	result := tx.Model(post).Updates(map[string]any{"series_id": post.SeriesID, "series_position": post.SeriesPosition})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if previousSeriesID != nil {
+		return renumberSeries(tx, *previousSeriesID, nil)
+	}
+	return nil
+}
+
+// ReorderSeries puts the posts with the given IDs first, in that order,
+// followed by the rest of the series' posts in their current order.
+func ReorderSeries(series *Series, postIDs []uint) error {
+	return GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := renumberSeries(tx, series.ID, postIDs); err != nil {
+			return err
+		}
+		// pages showing the series depend on its order
+		return tx.Model(series).Update("updated_at", time.Now()).Error
+	})
+}
+
+// renumberSeries numbers the posts of a series from 1 without gaps, putting
+// the posts in first, in that order.
+func renumberSeries(tx *gorm.DB, seriesID uint, first []uint) error {
+	var posts []Post
+	result := tx.Unscoped().Select("id").
+		Where("series_id = ?", seriesID).
+		Order("series_position ASC, id ASC").
+		Find(&posts)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	ordered := make([]uint, 0, len(posts))
+	inSeries := map[uint]bool{}
+	for _, post := range posts {
+		inSeries[post.ID] = true
+	}
+	placed := map[uint]bool{}
+	for _, id := range first {
+		if inSeries[id] && !placed[id] {
+			ordered = append(ordered, id)
+			placed[id] = true
+		}
+	}
+	for _, post := range posts {
+		if !placed[post.ID] {
+			ordered = append(ordered, post.ID)
+		}
+	}
+
+	for i, id := range ordered {
+		result = tx.Model(&Post{}).Unscoped().Where("id = ?", id).Update("series_position", i+1)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// instanceSettingsID is the primary key of the single InstanceSettings row.
+const instanceSettingsID = 1
+
+// settings are read on pretty much every request, so we keep them in memory
+// and only go to the database after they've been saved.
+var (
+	cachedSettings     *InstanceSettings
+	cachedSettingsLock sync.RWMutex
+)
+
+// GetInstanceSettings returns the instance wide settings, creating them with
+// their default values the first time they are requested. The returned value
+// is a copy, so it's safe to modify before calling SaveInstanceSettings.
+func GetInstanceSettings() (*InstanceSettings, error) {
+	cachedSettingsLock.RLock()
+	if cachedSettings != nil {
+		settings := *cachedSettings
+		cachedSettingsLock.RUnlock()
+		return &settings, nil
+	}
+	cachedSettingsLock.RUnlock()
+
+	settings, err := loadInstanceSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	cachedSettingsLock.Lock()
+	cachedSettings = settings
+	cachedSettingsLock.Unlock()
+
+	settingsCopy := *settings
+	return &settingsCopy, nil
+}
+
+func loadInstanceSettings() (*InstanceSettings, error) {
+	var settings InstanceSettings
+	result := GetDB().First(&settings, instanceSettingsID)
+	if result.Error == nil {
+		if len(settings.SigningKey) == 0 {
+			if err := generateSigningKey(&settings); err != nil {
+				return nil, err
+			}
+		}
+		return &settings, nil
+	}
+	if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, result.Error
+	}
+
+	settings = InstanceSettings{
+		ID:               instanceSettingsID,
+		RegistrationMode: RegistrationModeOpen,
+		HTMLPolicy:       "standard",
+	}
+	signingKey, err := newSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	settings.SigningKey = signingKey
+	result = GetDB().Create(&settings)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &settings, nil
+}
+
+func SaveInstanceSettings(settings *InstanceSettings) error {
+	settings.ID = instanceSettingsID
+	err := GetDB().Save(settings).Error
+
+	cachedSettingsLock.Lock()
+	cachedSettings = nil
+	cachedSettingsLock.Unlock()
+
+	return err
+}
+
+const signingKeyLength = 32
+
+func newSigningKey() ([]byte, error) {
+	key := make([]byte, signingKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// generateSigningKey gives a signing key to the settings of instances created
+// before there was one.
+func generateSigningKey(settings *InstanceSettings) error {
+	key, err := newSigningKey()
+	if err != nil {
+		return err
+	}
+	settings.SigningKey = key
+	return GetDB().Model(settings).Update("signing_key", key).Error
+}
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// GetPostShareLinks returns the share links of a post, newest first.
+func GetPostShareLinks(postID uint) ([]PostShareLink, error) {
+	var links []PostShareLink
+	result := GetDB().Where("post_id = ?", postID).Order("created_at DESC").Find(&links)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return links, nil
+}
+
+// GetUsableShareLink returns the share link with the given token along with
+// its post, or nil if there's no such link, it was revoked or it expired.
+func GetUsableShareLink(token string) (*PostShareLink, error) {
+	var link PostShareLink
+	result := GetDB().Preload("Post").Where("token = ?", token).First(&link)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	// the post was deleted
+	if link.Post.ID == 0 {
+		return nil, nil
+	}
+	if !link.IsUsable(time.Now()) {
+		return nil, nil
+	}
+	return &link, nil
+}
+
+// RevokeShareLink stops a share link from giving access to its post. Revoked
+// links are kept so the author can see who had access.
+func RevokeShareLink(link *PostShareLink) error {
+	now := time.Now()
+	link.RevokedAt = &now
+	return GetDB().Model(link).Update("revoked_at", now).Error
+}
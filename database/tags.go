@@ -0,0 +1,213 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gosimple/slug"
+	"gorm.io/gorm"
+)
+
+var ErrTagExists = errors.New("a tag with that name already exists")
+
+// TagCount is a tag along with how many posts use it.
+type TagCount struct {
+	Tag
+	PostCount int64
+}
+
+func TagSlug(name string) string {
+	return slug.Make(name)
+}
+
+// NormalizeTagNames trims tag names and collapses their inner whitespace,
+// dropping empty names and names with the same slug as an earlier one.
+func NormalizeTagNames(names []string) []string {
+	seen := map[string]bool{}
+	normalized := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.Join(strings.Fields(name), " ")
+		tagSlug := TagSlug(name)
+		if tagSlug == "" || seen[tagSlug] {
+			continue
+		}
+		seen[tagSlug] = true
+		normalized = append(normalized, name)
+	}
+	return normalized
+}
+
+// SetPostTags replaces the tags of a post with the given, already normalized,
+// names. Tags the author doesn't have yet are created, and the author's tags
+// no post uses anymore are deleted.
+func SetPostTags(tx *gorm.DB, post *Post, names []string) error {
+	tags := make([]Tag, 0, len(names))
+	for _, name := range names {
+		tag := Tag{AdminUserID: post.AdminUserID, Slug: TagSlug(name)}
+		result := tx.Where(&tag).Attrs(Tag{Name: name}).FirstOrCreate(&tag)
+		if result.Error != nil {
+			return result.Error
+		}
+		tags = append(tags, tag)
+	}
+
+	err := tx.Model(post).Association("Tags").Replace(tags)
+	if err != nil {
+		return err
+	}
+	post.Tags = tags
+
+	return deleteUnusedTags(tx, post.AdminUserID)
+}
+
+func deleteUnusedTags(tx *gorm.DB, userID uint) error {
+	return tx.Where("admin_user_id = ? AND id NOT IN (SELECT tag_id FROM post_tags)", userID).Delete(&Tag{}).Error
+}
+
+// GetTagCounts returns the user's tags with how many posts use them, most
+// used first. With publicOnly, only listed posts are counted and tags without
+// any such post are left out.
+func GetTagCounts(userID uint, publicOnly bool) ([]TagCount, error) {
+	query := GetDB().Model(&Tag{}).
+		Select("tags.*, COUNT(posts.id) AS post_count").
+		Joins("LEFT JOIN post_tags ON post_tags.tag_id = tags.id")
+	if publicOnly {
+		query = query.Joins("LEFT JOIN posts ON posts.id = post_tags.post_id AND posts.deleted_at IS NULL AND posts.published = ? AND posts.hidden_by_admin = ? AND posts.visibility = ?", true, false, PostVisibilityPublic).
+			Having("COUNT(posts.id) > 0")
+	} else {
+		query = query.Joins("LEFT JOIN posts ON posts.id = post_tags.post_id AND posts.deleted_at IS NULL")
+	}
+
+	var counts []TagCount
+	result := query.
+		Where("tags.admin_user_id = ?", userID).
+		Group("tags.id").
+		Order("post_count DESC, tags.name ASC").
+		Scan(&counts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return counts, nil
+}
+
+// GetTagBySlug returns the user's tag with the given slug, or nil.
+func GetTagBySlug(userID uint, tagSlug string) (*Tag, error) {
+	var tag Tag
+	result := GetDB().Where(&Tag{AdminUserID: userID, Slug: tagSlug}).First(&tag)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	return &tag, nil
+}
+
+// PostsWithTag restricts a posts query to the posts with the given tag.
+func PostsWithTag(tagID uint) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("posts.id IN (SELECT post_id FROM post_tags WHERE tag_id = ?)", tagID)
+	}
+}
+
+// touchTaggedPosts bumps the update time of the posts with the tag, so that
+// caches of pages showing the tag are refreshed when it changes.
+func touchTaggedPosts(tx *gorm.DB, tagID uint) error {
+	return tx.Model(&Post{}).Scopes(PostsWithTag(tagID)).Update("updated_at", time.Now()).Error
+}
+
+// RenameTag changes the name, and so the slug, of a tag. It fails with
+// ErrTagExists if the user has another tag with the new slug, those have to
+// be merged instead.
+func RenameTag(tag *Tag, name string) error {
+	name = strings.Join(strings.Fields(name), " ")
+	newSlug := TagSlug(name)
+	if newSlug == "" {
+		return errors.New("the tag name must contain letters or numbers")
+	}
+
+	existing, err := GetTagBySlug(tag.AdminUserID, newSlug)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.ID != tag.ID {
+		return ErrTagExists
+	}
+
+	return GetDB().Transaction(func(tx *gorm.DB) error {
+		tag.Name = name
+		tag.Slug = newSlug
+		if err := tx.Save(tag).Error; err != nil {
+			return err
+		}
+		return touchTaggedPosts(tx, tag.ID)
+	})
+}
+
+// MergeTags moves every post tagged with from to into and deletes from.
+func MergeTags(from *Tag, into *Tag) error {
+	if from.AdminUserID != into.AdminUserID || from.ID == into.ID {
+		return errors.New("tags can only be merged into another tag of the same user")
+	}
+
+	return GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec(`INSERT INTO post_tags (post_id, tag_id)
+			SELECT post_id, ? FROM post_tags WHERE tag_id = ?
+			AND post_id NOT IN (SELECT post_id FROM post_tags WHERE tag_id = ?)`, into.ID, from.ID, into.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		result = tx.Exec("DELETE FROM post_tags WHERE tag_id = ?", from.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if err := tx.Delete(from).Error; err != nil {
+			return err
+		}
+		return touchTaggedPosts(tx, into.ID)
+	})
+}
+
+// migrateLegacyTags moves the tags of posts from the JSON "tags" column they
+// used to have into the tags table, then drops the column. Deleted posts lose
+// their tags.
+func migrateLegacyTags() error {
+	if !db.Migrator().HasColumn(&Post{}, "tags") {
+		return nil
+	}
+
+	type legacyPost struct {
+		ID          uint
+		AdminUserID uint
+		Tags        string
+	}
+	var posts []legacyPost
+	result := db.Model(&Post{}).
+		Select("id, admin_user_id, tags").
+		Where("tags IS NOT NULL AND tags != ''").
+		Scan(&posts)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	log.Printf("Moving the tags of %d posts to the tags table", len(posts))
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, legacy := range posts {
+			var names []string
+			if err := json.Unmarshal([]byte(legacy.Tags), &names); err != nil {
+				log.Printf("Skipping invalid tags of post %d: %v", legacy.ID, err)
+				continue
+			}
+
+			post := Post{Model: gorm.Model{ID: legacy.ID}, AdminUserID: legacy.AdminUserID}
+			if err := SetPostTags(tx, &post, NormalizeTagNames(names)); err != nil {
+				return err
+			}
+		}
+		return tx.Migrator().DropColumn(&Post{}, "tags")
+	})
+}
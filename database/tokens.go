@@ -0,0 +1,91 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateUserToken stores the hash of token so that it can later be redeemed
+// with ConsumeUserToken.
+func CreateUserToken(userID uint, purpose UserTokenPurpose, token string, email string, ttl time.Duration) error {
+	userToken := UserToken{
+		AdminUserID: userID,
+		Purpose:     purpose,
+		TokenHash:   hashToken(token),
+		Email:       email,
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+	return db.Create(&userToken).Error
+}
+
+// GetValidUserToken returns the token if it exists, hasn't been used and
+// hasn't expired, or nil otherwise. The token is not consumed.
+func GetValidUserToken(purpose UserTokenPurpose, token string) (*UserToken, error) {
+	var userToken UserToken
+	result := db.Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+		hashToken(token), purpose, time.Now()).First(&userToken)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &userToken, nil
+}
+
+// ConsumeUserToken marks a valid token as used and returns it. Returns nil if
+// the token is invalid, expired or was already used.
+func ConsumeUserToken(tx *gorm.DB, purpose UserTokenPurpose, token string) (*UserToken, error) {
+	var userToken UserToken
+	result := tx.Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+		hashToken(token), purpose, time.Now()).First(&userToken)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+
+	// guard against the same token being redeemed twice concurrently
+	now := time.Now()
+	result = tx.Model(&UserToken{}).Where("id = ? AND used_at IS NULL", userToken.ID).Update("used_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, nil
+	}
+
+	userToken.UsedAt = &now
+	return &userToken, nil
+}
+
+// RevokeUserTokens invalidates every outstanding token of the given purpose
+// for a user.
+func RevokeUserTokens(tx *gorm.DB, userID uint, purpose UserTokenPurpose) error {
+	return tx.Model(&UserToken{}).
+		Where("admin_user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+		Update("used_at", time.Now()).Error
+}
+
+// GetUserWithVerifiedEmail returns the user owning the given verified email
+// address, or nil if there isn't one.
+func GetUserWithVerifiedEmail(email string) (*AdminUser, error) {
+	var user AdminUser
+	result := db.Where("LOWER(email) = LOWER(?) AND email_verified_at IS NOT NULL", email).First(&user)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &user, nil
+}
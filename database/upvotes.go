@@ -0,0 +1,35 @@
+package database
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AddUpvote upvotes the post for the voter, doing nothing if they already
+// did. It returns the post's new number of upvotes.
+func AddUpvote(post *Post, voterHash string) (int64, error) {
+	err := GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Upvote{PostID: post.ID, VoterHash: voterHash})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			// upvotes aren't edits, the post's update time stays
+			result = tx.Model(post).UpdateColumn("upvotes", gorm.Expr("upvotes + 1"))
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		return tx.Model(&Post{}).Where("id = ?", post.ID).Select("upvotes").Scan(&post.Upvotes).Error
+	})
+	return post.Upvotes, err
+}
+
+// TotalUpvotes returns the number of upvotes of all the user's posts, pages
+// showing upvotes use it to notice new ones.
+func TotalUpvotes(userID uint) (int64, error) {
+	var total int64
+	result := GetDB().Model(&Post{}).Where("admin_user_id = ?", userID).
+		Select("COALESCE(SUM(upvotes), 0)").Scan(&total)
+	return total, result.Error
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// SaveWebmention records that source mentions target, a post, and returns
+// the mention to verify. A source mentioning the target again is verified
+// again.
+func SaveWebmention(postID uint, source string, target string) (*Webmention, error) {
+	mention := Webmention{PostID: postID, Source: source, Target: target, Status: WebmentionStatusPending}
+	result := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "source"}, {Name: "target"}},
+		DoUpdates: clause.AssignmentColumns([]string{"post_id", "status", "updated_at"}),
+	}).Create(&mention)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	result = db.Where("source = ? AND target = ?", source, target).First(&mention)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &mention, nil
+}
+
+// SetWebmentionVerified shows the mention on its post, with the title of
+// its source.
+func SetWebmentionVerified(mention *Webmention, title string) error {
+	now := time.Now()
+	return db.Model(mention).Updates(map[string]any{
+		"status":      WebmentionStatusVerified,
+		"title":       title,
+		"verified_at": &now,
+	}).Error
+}
+
+func SetWebmentionInvalid(mention *Webmention) error {
+	return db.Model(mention).Update("status", WebmentionStatusInvalid).Error
+}
+
+// GetPostWebmentions returns the verified mentions of a post, oldest first.
+func GetPostWebmentions(postID uint) ([]Webmention, error) {
+	var mentions []Webmention
+	result := db.Where("post_id = ? AND status = ?", postID, WebmentionStatusVerified).
+		Order("created_at ASC").
+		Find(&mentions)
+	return mentions, result.Error
+}
+
+// WebmentionsLastModified returns when a mention of the post was last
+// received or verified, pages showing mentions use it to notice changes.
+func WebmentionsLastModified(postID uint) (time.Time, error) {
+	var mention Webmention
+	result := db.Select("updated_at").Where("post_id = ?", postID).
+		Order("updated_at DESC").Limit(1).Find(&mention)
+	return mention.UpdatedAt, result.Error
+}
@@ -0,0 +1,83 @@
+// Package domains checks that users control the custom domains they point at
+// their blogs.
+package domains
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ChallengePrefix is prepended to a domain to get the name of the TXT record
+// proving ownership.
+const ChallengePrefix = "_kitty-challenge."
+
+// TXTResolver looks up DNS TXT records. *net.Resolver implements it.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var (
+	resolver     TXTResolver = net.DefaultResolver
+	resolverLock sync.RWMutex
+)
+
+// SetResolver replaces the resolver used by Verify, for example with a fake
+// one in tests.
+func SetResolver(r TXTResolver) {
+	resolverLock.Lock()
+	defer resolverLock.Unlock()
+	resolver = r
+}
+
+func getResolver() TXTResolver {
+	resolverLock.RLock()
+	defer resolverLock.RUnlock()
+	return resolver
+}
+
+var hostnameRegex = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Normalize lowercases a domain and checks that it's a plain hostname, without
+// scheme, port or path.
+func Normalize(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if domain == "" {
+		return "", errors.New("the domain is empty")
+	}
+	if len(domain) > 253 || !hostnameRegex.MatchString(domain) {
+		return "", errors.New("that isn't a valid domain name, it should look like blog.example.com")
+	}
+	return domain, nil
+}
+
+// ChallengeRecord returns the name and the value of the TXT record that proves
+// ownership of domain.
+func ChallengeRecord(domain string, token string) (name string, value string) {
+	return ChallengePrefix + domain, "kitty-verification=" + token
+}
+
+// Verify checks whether the challenge TXT record of domain contains token. A
+// missing record isn't an error, it just means the domain isn't verified.
+func Verify(ctx context.Context, domain string, token string) (bool, error) {
+	name, expected := ChallengeRecord(domain, token)
+
+	records, err := getResolver().LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, record := range records {
+		if strings.TrimSpace(record) == expected {
+			return true, nil
+		}
+	}
+	return false, nil
+}
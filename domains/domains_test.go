@@ -0,0 +1,110 @@
+package domains
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeResolver answers TXT lookups from a fixed set of records.
+type fakeResolver struct {
+	records map[string][]string
+	err     error
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	records, ok := r.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestVerify(t *testing.T) {
+	errResolver := errors.New("server misbehaving")
+
+	tests := []struct {
+		name     string
+		resolver *fakeResolver
+		want     bool
+		wantErr  error
+	}{
+		{
+			name: "matching token",
+			resolver: &fakeResolver{records: map[string][]string{
+				"_kitty-challenge.blog.example.com": {"unrelated", " kitty-verification=token "},
+			}},
+			want: true,
+		},
+		{
+			name:     "missing record",
+			resolver: &fakeResolver{records: map[string][]string{}},
+			want:     false,
+		},
+		{
+			name: "wrong token",
+			resolver: &fakeResolver{records: map[string][]string{
+				"_kitty-challenge.blog.example.com": {"kitty-verification=other-token"},
+			}},
+			want: false,
+		},
+		{
+			name: "token on the domain instead of the challenge record",
+			resolver: &fakeResolver{records: map[string][]string{
+				"blog.example.com": {"kitty-verification=token"},
+			}},
+			want: false,
+		},
+		{
+			name:     "resolver error",
+			resolver: &fakeResolver{err: errResolver},
+			wantErr:  errResolver,
+		},
+	}
+
+	t.Cleanup(func() { SetResolver(net.DefaultResolver) })
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetResolver(tc.resolver)
+
+			got, err := Verify(context.Background(), "blog.example.com", "token")
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("Verify() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "Blog.Example.com.", want: "blog.example.com"},
+		{input: "  example.org ", want: "example.org"},
+		{input: "", wantErr: true},
+		{input: "https://example.com", wantErr: true},
+		{input: "example.com:8080", wantErr: true},
+		{input: "example.com/blog", wantErr: true},
+		{input: "localhost", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := Normalize(tc.input)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Normalize(%q) error = %v, want error: %v", tc.input, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
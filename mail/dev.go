@@ -0,0 +1,37 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LogSender prints messages to the application log instead of delivering
+// them. Meant for development.
+type LogSender struct {
+	From string
+}
+
+func (s *LogSender) Send(ctx context.Context, msg Message) error {
+	log.Printf("Email (not delivered):\n%s", formatMessage(s.From, msg))
+	return nil
+}
+
+// FileSender writes every message to its own .eml file inside Dir. Meant for
+// development and for inspecting outgoing messages.
+type FileSender struct {
+	Dir  string
+	From string
+}
+
+func (s *FileSender) Send(ctx context.Context, msg Message) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s.eml", time.Now().Format("20060102T150405.000000000"))
+	return os.WriteFile(filepath.Join(s.Dir, name), formatMessage(s.From, msg), 0o644)
+}
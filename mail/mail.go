@@ -0,0 +1,88 @@
+package mail
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string // plain text
+}
+
+// Sender delivers email messages.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var (
+	sender     Sender
+	senderLock sync.Mutex
+)
+
+// GetSender returns the configured mail sender. The transport is picked from
+// the KITTY_MAIL_TRANSPORT environment variable:
+//
+//   - "smtp": deliver through the server in KITTY_SMTP_HOST / KITTY_SMTP_PORT,
+//     optionally authenticating with KITTY_SMTP_USERNAME / KITTY_SMTP_PASSWORD
+//   - "file": write every message to a file in KITTY_MAIL_DIR
+//   - "log" (default): print every message to the application log
+//
+// The sender address is taken from KITTY_MAIL_FROM.
+func GetSender() Sender {
+	senderLock.Lock()
+	defer senderLock.Unlock()
+
+	if sender == nil {
+		sender = newSenderFromEnv()
+	}
+	return sender
+}
+
+// SetSender replaces the mail sender, mostly useful to plug in a fake one.
+func SetSender(s Sender) {
+	senderLock.Lock()
+	defer senderLock.Unlock()
+
+	sender = s
+}
+
+func newSenderFromEnv() Sender {
+	from := os.Getenv("KITTY_MAIL_FROM")
+	if from == "" {
+		from = "kitty@localhost"
+	}
+
+	switch transport := os.Getenv("KITTY_MAIL_TRANSPORT"); transport {
+	case "smtp":
+		port, err := strconv.Atoi(os.Getenv("KITTY_SMTP_PORT"))
+		if err != nil {
+			port = 587
+		}
+		return &SMTPSender{
+			Host:     os.Getenv("KITTY_SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("KITTY_SMTP_USERNAME"),
+			Password: os.Getenv("KITTY_SMTP_PASSWORD"),
+			From:     from,
+		}
+
+	case "file":
+		dir := os.Getenv("KITTY_MAIL_DIR")
+		if dir == "" {
+			dir = "mail_outbox"
+		}
+		return &FileSender{Dir: dir, From: from}
+
+	case "", "log":
+		return &LogSender{From: from}
+
+	default:
+		log.Printf("Unknown mail transport '%s', falling back to logging emails", transport)
+		return &LogSender{From: from}
+	}
+}
@@ -1,15 +1,12 @@
 package main
 
 import (
-	"encoding/json"
-	"kitty/constants"
 	"kitty/database"
 	"kitty/site"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 	"time"
 
@@ -22,18 +19,39 @@ import (
 
 func main() {
 	_ = database.GetDB() // force database initialization
-	r := initRouter()
+	r := site.HostRouter(initRouter(), initCustomDomainRouter())
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	const portNum = ":6835"
-	go func() {
-		log.Printf("Running on http://localhost%s", portNum)
-		if err := http.ListenAndServe(portNum, r); err != nil {
-			log.Printf("HTTP server stopped: %v", err)
-		}
-	}()
+	tlsServer, err := site.GetTLSServer()
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+
+	if tlsServer == nil {
+		const portNum = ":6835"
+		go func() {
+			log.Printf("Running on http://localhost%s", portNum)
+			if err := http.ListenAndServe(portNum, r); err != nil {
+				log.Printf("HTTP server stopped: %v", err)
+			}
+		}()
+	} else {
+		go func() {
+			log.Printf("Redirecting HTTP to HTTPS on %s", tlsServer.HTTPAddr)
+			if err := http.ListenAndServe(tlsServer.HTTPAddr, tlsServer.HTTPHandler()); err != nil {
+				log.Printf("HTTP server stopped: %v", err)
+			}
+		}()
+		go func() {
+			server := &http.Server{Addr: tlsServer.HTTPSAddr, Handler: r, TLSConfig: tlsServer.TLSConfig()}
+			log.Printf("Running on %s (HTTPS on %s)", site.PublicURL(), tlsServer.HTTPSAddr)
+			if err := server.ListenAndServeTLS("", ""); err != nil {
+				log.Printf("HTTPS server stopped: %v", err)
+			}
+		}()
+	}
 
 	// Block until a signal is received
 	<-signals
@@ -71,50 +89,135 @@ func initRouter() *chi.Mux {
 		site.RenderTemplate(w, r, "terms_and_conditions", nil)
 	})
 	r.HandleFunc("/signin", site.UserSignIn)
+	r.Get("/signin/oidc", site.OIDCSignIn)
+	r.Get("/signin/oidc/callback", site.OIDCCallback)
 	r.HandleFunc("/signup", site.UserSignUp)
 	r.Post("/logout", site.UserLogout)
+	r.With(httprate.LimitByIP(5, time.Hour)).HandleFunc("/forgot-password", site.ForgotPassword)
+	r.HandleFunc("/reset-password", site.ResetPassword)
+	r.Get("/verify-email", site.VerifyEmail)
 
 	r.With(site.AuthProtectedMiddleware).Route("/dashboard", func(r chi.Router) {
 		r.Get("/", site.UserPostList)
 
 		r.HandleFunc("/import", site.ImportPosts)
 
+		r.Get("/account", site.AccountSettings)
+		r.HandleFunc("/account/password", site.AccountChangePassword)
+		r.HandleFunc("/account/username", site.AccountChangeUsername)
+		r.HandleFunc("/account/email", site.AccountChangeEmail)
+		r.HandleFunc("/account/email/resend", site.AccountResendVerificationEmail)
+		r.HandleFunc("/account/oidc/link", site.AccountLinkOIDC)
+		r.HandleFunc("/account/oidc/unlink", site.AccountUnlinkOIDC)
+		r.HandleFunc("/account/rendering", site.AccountRenderOptions)
+		r.Get("/account/export", site.AccountExport)
+		r.HandleFunc("/account/delete", site.AccountDelete)
+
+		r.HandleFunc("/blog", site.DashboardBlogSettings)
+		r.HandleFunc("/blog/domain", site.DashboardSetCustomDomain)
+		r.HandleFunc("/blog/domain/verify", site.DashboardVerifyCustomDomain)
+
+		r.Get("/tags", site.DashboardTags)
+		r.HandleFunc("/tags/{tagID}/rename", site.DashboardRenameTag)
+		r.HandleFunc("/tags/{tagID}/merge", site.DashboardMergeTag)
+
+		r.Get("/analytics", site.DashboardAnalytics)
+
+		r.HandleFunc("/series", site.DashboardSeriesList)
+		r.HandleFunc("/series/{seriesID}", site.DashboardSeries)
+		r.HandleFunc("/series/{seriesID}/order", site.DashboardReorderSeries)
+		r.HandleFunc("/series/{seriesID}/delete", site.DashboardDeleteSeries)
+
 		r.HandleFunc("/post/new", site.CreatePost)
 		r.HandleFunc("/post/{postID}", site.UpdatePost)
 		r.HandleFunc("/post/{postID}/delete", site.DeletePost)
+		r.HandleFunc("/post/{postID}/share", site.DashboardPostShareLinks)
+		r.HandleFunc("/post/{postID}/share/{linkID}/revoke", site.DashboardRevokeShareLink)
+		r.HandleFunc("/post/{postID}/comments", site.DashboardPostComments)
+
+		r.Get("/comments", site.DashboardComments)
+		r.HandleFunc("/comments/{commentID}/moderate", site.DashboardModerateComment)
+
+		r.HandleFunc("/tokens", site.DashboardAPITokens)
+		r.HandleFunc("/tokens/{tokenID}/revoke", site.DashboardRevokeAPIToken)
+
+		r.HandleFunc("/indieauth", site.DashboardIndieAuth)
+	})
+
+	r.With(site.AuthProtectedMiddleware, site.AdminProtectedMiddleware).Route("/admin", func(r chi.Router) {
+		r.Get("/", site.AdminDashboard)
+		r.Post("/settings", site.AdminUpdateSettings)
+
+		r.Get("/users/{userID}", site.AdminViewUser)
+		r.Post("/users/{userID}/suspend", site.AdminSuspendUser)
+		r.Post("/users/{userID}/role", site.AdminSetUserRole)
+		r.Post("/users/{userID}/delete", site.AdminDeleteUser)
+
+		r.Post("/posts/{postID}/hide", site.AdminHidePost)
+
+		r.HandleFunc("/invites", site.AdminInvites)
+		r.Post("/invites/{inviteID}/delete", site.AdminDeleteInvite)
+
+		r.Get("/audit", site.AdminAuditLog)
 	})
 
+	r.Get("/robots.txt", site.RobotsTxt)
+	r.Get("/sitemap.xml", site.SitemapIndex)
+	r.Get("/sitemap-{userID}-{page}.xml", site.UserSitemap)
+
 	r.Get("/post/{postID}", site.PublicViewPost)
+	r.With(httprate.LimitByIP(10, time.Minute)).Post("/post/{postID}", site.PublicViewPost)
+	r.With(httprate.LimitByIP(10, time.Minute)).Post("/post/{postID}/upvote", site.UpvotePost)
+	r.With(httprate.LimitByIP(5, time.Minute), httprate.LimitByIP(30, time.Hour)).Post("/post/{postID}/comments", site.SubmitComment)
+	r.Get("/share/{token}", site.PublicViewSharedPost)
+	r.With(httprate.LimitByIP(20, time.Minute)).Post("/webmention", site.ReceiveWebmention)
+	r.With(httprate.LimitByIP(30, time.Minute)).HandleFunc("/micropub", site.Micropub)
+	r.With(httprate.LimitByIP(10, time.Minute)).Post("/micropub/media", site.MicropubMedia)
+	r.Get("/media/{name}", site.ServeMediaFile)
+	r.Get("/.well-known/oauth-authorization-server", site.IndieAuthMetadata)
+	r.With(httprate.LimitByIP(30, time.Minute)).HandleFunc("/indieauth/auth", site.IndieAuthAuthorize)
+	r.With(httprate.LimitByIP(30, time.Minute)).HandleFunc("/indieauth/token", site.IndieAuthToken)
+	r.With(httprate.LimitByIP(30, time.Minute)).Post("/indieauth/revoke", site.IndieAuthRevoke)
 	r.Get("/u/{userID}", site.PublicViewUser)
+	r.Get("/u/{userID}/tag/{tag}", site.PublicViewUserTag)
+	r.Get("/u/{userID}/series/{slug}", site.PublicViewSeries)
+	r.Get("/b/{username}", site.BlogIndex)
+	r.Get("/b/{username}/", site.BlogIndex)
+	r.Get("/b/{username}/{slug}", site.BlogPost)
+	r.With(httprate.LimitByIP(10, time.Minute)).Post("/b/{username}/{slug}", site.BlogPost)
 
 	fileServer := http.FileServer(http.Dir("./assets"))
 	r.Handle("/assets/*", http.StripPrefix("/assets", fileServer))
 
 	r.Route("/api", func(r chi.Router) {
 		r.Route("/v1", func(r chi.Router) {
-			r.Get("/get-user-posts-messages/{userID}", func(w http.ResponseWriter, r *http.Request) {
-				userID := chi.URLParam(r, "userID")
-
-				var posts []database.Post
-				userIDUint, err := strconv.ParseUint(userID, 10, 64)
-				if err != nil {
-					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-					return
-				}
-
-				result := database.GetDB().Where(&database.Post{AdminUserID: uint(userIDUint)}).
-					Limit(constants.MAX_POSTS_TO_SHOW).
-					Find(&posts)
-				if result.Error != nil {
-					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-					return
-				}
-
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(posts)
-			})
+			r.Get("/get-user-posts-messages/{userID}", site.APIGetUserPosts)
+			r.Get("/get-post-comments/{postID}", site.APIGetPostComments)
 		})
 	})
 
 	return r
 }
+
+// initCustomDomainRouter serves the blogs of users on their own domains, see
+// site.HostRouter.
+func initCustomDomainRouter() *chi.Mux {
+	r := chi.NewRouter()
+
+	r.Use(site.RealIPMiddleware)
+	r.Use(middleware.Logger)
+	r.Use(httprate.LimitByIP(50, time.Minute))
+	r.Use(middleware.Recoverer)
+
+	r.Get("/", site.CustomDomainBlogIndex)
+	r.Get("/robots.txt", site.CustomDomainRobotsTxt)
+	r.Get("/sitemap.xml", site.CustomDomainSitemapIndex)
+	r.Get("/sitemap-{page}.xml", site.CustomDomainSitemap)
+	r.Get("/{slug}", site.CustomDomainBlogPost)
+	r.With(httprate.LimitByIP(10, time.Minute)).Post("/{slug}", site.CustomDomainBlogPost)
+
+	fileServer := http.FileServer(http.Dir("./assets"))
+	r.Handle("/assets/*", http.StripPrefix("/assets", fileServer))
+
+	return r
+}
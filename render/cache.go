@@ -0,0 +1,210 @@
+package render
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"kitty/sanitizer"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// CacheStore persists rendered HTML beyond the in-memory cache, so that it
+// survives restarts and isn't lost when an entry gets evicted.
+type CacheStore interface {
+	// Load returns the stored HTML, or false if there's nothing stored for key.
+	Load(key string) ([]byte, bool, error)
+	Save(key string, html []byte) error
+	Delete(key string) error
+}
+
+// CacheStats are counters since the cache was created.
+type CacheStats struct {
+	Entries     int
+	Capacity    int
+	Persistent  bool
+	MemoryHits  uint64
+	StoreHits   uint64
+	Misses      uint64
+	Evictions   uint64
+	StoreErrors uint64
+}
+
+// Lookups is the number of times rendered HTML was asked for.
+func (s CacheStats) Lookups() uint64 {
+	return s.MemoryHits + s.StoreHits + s.Misses
+}
+
+// HitRate is the share of lookups that didn't need rendering, between 0 and 1.
+func (s CacheStats) HitRate() float64 {
+	if s.Lookups() == 0 {
+		return 0
+	}
+	return float64(s.MemoryHits+s.StoreHits) / float64(s.Lookups())
+}
+
+type cacheEntry struct {
+	key  string
+	html []byte
+}
+
+// Cache is an LRU cache of rendered HTML in front of ToHTML, optionally
+// backed by a CacheStore. Entries are keyed by a hash of everything that
+// affects the output, so editing a post or changing its options never serves
+// stale HTML. Invalidate only frees the space early.
+type Cache struct {
+	capacity int
+	store    CacheStore
+
+	mu      sync.Mutex
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+
+	memoryHits  atomic.Uint64
+	storeHits   atomic.Uint64
+	misses      atomic.Uint64
+	evictions   atomic.Uint64
+	storeErrors atomic.Uint64
+}
+
+// NewCache creates a cache holding up to capacity documents in memory. store
+// can be nil.
+func NewCache(capacity int, store CacheStore) *Cache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Cache{
+		capacity: capacity,
+		store:    store,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// renderVersion is part of every cache key. Bump it whenever ToHTML or the
+// sanitizer policies produce different HTML for the same arguments, so that
+// HTML rendered by an older version is no longer served. Persisted entries
+// of older versions are then never used again, and get pruned.
+const renderVersion = 2
+
+// CacheKey identifies the output of ToHTML for the given arguments.
+func CacheKey(source string, opts Options, policy sanitizer.PolicyName) string {
+	optsJSON, _ := json.Marshal(opts)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "v%d", renderVersion)
+	hash.Write([]byte{0})
+	hash.Write([]byte(policy))
+	hash.Write([]byte{0})
+	hash.Write(optsJSON)
+	hash.Write([]byte{0})
+	hash.Write([]byte(source))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ToHTML is like the package level ToHTML, but only renders documents it
+// hasn't seen before. The returned slice must not be modified.
+func (c *Cache) ToHTML(source string, opts Options, policy sanitizer.PolicyName) []byte {
+	key := CacheKey(source, opts, policy)
+
+	if html, ok := c.get(key); ok {
+		c.memoryHits.Add(1)
+		return html
+	}
+
+	if c.store != nil {
+		html, ok, err := c.store.Load(key)
+		if err != nil {
+			c.storeErrors.Add(1)
+			log.Printf("Failed to load rendered HTML from the cache store: %v", err)
+		} else if ok {
+			c.storeHits.Add(1)
+			c.add(key, html)
+			return html
+		}
+	}
+
+	c.misses.Add(1)
+	html := ToHTML(source, opts, policy)
+	c.add(key, html)
+
+	if c.store != nil {
+		if err := c.store.Save(key, html); err != nil {
+			c.storeErrors.Add(1)
+			log.Printf("Failed to save rendered HTML to the cache store: %v", err)
+		}
+	}
+
+	return html
+}
+
+// Invalidate drops the rendered HTML for the given arguments, usually the
+// previous version of a post that was just edited or deleted.
+func (c *Cache) Invalidate(source string, opts Options, policy sanitizer.PolicyName) {
+	key := CacheKey(source, opts, policy)
+
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+
+	if c.store != nil {
+		if err := c.store.Delete(key); err != nil {
+			c.storeErrors.Add(1)
+			log.Printf("Failed to delete rendered HTML from the cache store: %v", err)
+		}
+	}
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	entries := c.order.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Entries:     entries,
+		Capacity:    c.capacity,
+		Persistent:  c.store != nil,
+		MemoryHits:  c.memoryHits.Load(),
+		StoreHits:   c.storeHits.Load(),
+		Misses:      c.misses.Load(),
+		Evictions:   c.evictions.Load(),
+		StoreErrors: c.storeErrors.Load(),
+	}
+}
+
+func (c *Cache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).html, true
+}
+
+func (c *Cache) add(key string, html []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, html: html})
+
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
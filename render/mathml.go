@@ -0,0 +1,557 @@
+package render
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// This file converts the commonly used subset of LaTeX math into MathML, so
+// that formulas are rendered by the browser without any client side
+// JavaScript. Anything it doesn't understand is rendered as an <merror>
+// instead of failing the whole document.
+
+const mathMLNamespace = "http://www.w3.org/1998/Math/MathML"
+
+func latexToMathML(source string, display bool) string {
+	p := mathParser{tokens: tokenizeLatex(source)}
+	var body []string
+	for {
+		body = append(body, p.parseRow(nil)...)
+		if p.next() == nil {
+			break
+		}
+		// skip unbalanced closing braces
+	}
+
+	var b strings.Builder
+	b.WriteString(`<math xmlns="` + mathMLNamespace + `"`)
+	if display {
+		b.WriteString(` display="block"`)
+	}
+	b.WriteString(">")
+	b.WriteString(wrapRow(body))
+	b.WriteString("</math>")
+	return b.String()
+}
+
+type latexTokenKind int
+
+const (
+	tokenChar latexTokenKind = iota
+	tokenCommand
+	tokenOpenGroup
+	tokenCloseGroup
+	tokenSuperscript
+	tokenSubscript
+	tokenAlign   // &
+	tokenNewline // \\
+)
+
+type latexToken struct {
+	kind  latexTokenKind
+	value string
+}
+
+func tokenizeLatex(source string) []latexToken {
+	var tokens []latexToken
+	runes := []rune(source)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			continue
+		case c == '{':
+			tokens = append(tokens, latexToken{kind: tokenOpenGroup})
+		case c == '}':
+			tokens = append(tokens, latexToken{kind: tokenCloseGroup})
+		case c == '^':
+			tokens = append(tokens, latexToken{kind: tokenSuperscript})
+		case c == '_':
+			tokens = append(tokens, latexToken{kind: tokenSubscript})
+		case c == '&':
+			tokens = append(tokens, latexToken{kind: tokenAlign})
+		case c == '\\':
+			if i+1 >= len(runes) {
+				continue
+			}
+			if runes[i+1] == '\\' {
+				tokens = append(tokens, latexToken{kind: tokenNewline})
+				i++
+				continue
+			}
+			j := i + 1
+			if unicode.IsLetter(runes[j]) {
+				for j < len(runes) && unicode.IsLetter(runes[j]) {
+					j++
+				}
+			} else {
+				// single character commands like \{ or \,
+				j++
+			}
+			tokens = append(tokens, latexToken{kind: tokenCommand, value: string(runes[i+1 : j])})
+			i = j - 1
+		default:
+			tokens = append(tokens, latexToken{kind: tokenChar, value: string(c)})
+		}
+	}
+	return tokens
+}
+
+type mathParser struct {
+	tokens []latexToken
+	pos    int
+}
+
+func (p *mathParser) peek() *latexToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *mathParser) next() *latexToken {
+	tok := p.peek()
+	if tok != nil {
+		p.pos++
+	}
+	return tok
+}
+
+// parseRow parses elements until the end of input, a closing brace, or any
+// token for which stop returns true. The stopping token is not consumed.
+func (p *mathParser) parseRow(stop func(latexToken) bool) []string {
+	var elements []string
+	for {
+		tok := p.peek()
+		if tok == nil || tok.kind == tokenCloseGroup || (stop != nil && stop(*tok)) {
+			return elements
+		}
+
+		element, ok := p.parseScripted()
+		if ok {
+			elements = append(elements, element)
+		}
+	}
+}
+
+// parseScripted parses an atom followed by any super/subscripts.
+func (p *mathParser) parseScripted() (string, bool) {
+	tok := p.peek()
+	var base string
+	var isLargeOperator bool
+	if tok.kind == tokenSuperscript || tok.kind == tokenSubscript {
+		// a script with nothing before it, e.g. "^2" at the start
+		base = "<mrow></mrow>"
+	} else {
+		var ok bool
+		base, isLargeOperator, ok = p.parseAtom()
+		if !ok {
+			return "", false
+		}
+	}
+
+	var sub, sup string
+	for {
+		tok := p.peek()
+		if tok == nil || (tok.kind != tokenSuperscript && tok.kind != tokenSubscript) {
+			break
+		}
+		p.next()
+		arg := p.parseArgument()
+		if tok.kind == tokenSuperscript {
+			sup = arg
+		} else {
+			sub = arg
+		}
+	}
+
+	under, over := "msub", "msup"
+	both := "msubsup"
+	if isLargeOperator {
+		under, over, both = "munder", "mover", "munderover"
+	}
+
+	switch {
+	case sub != "" && sup != "":
+		return "<" + both + ">" + base + sub + sup + "</" + both + ">", true
+	case sub != "":
+		return "<" + under + ">" + base + sub + "</" + under + ">", true
+	case sup != "":
+		return "<" + over + ">" + base + sup + "</" + over + ">", true
+	default:
+		return base, true
+	}
+}
+
+// parseArgument parses a command argument or script, which is either a
+// {group} or a single atom.
+func (p *mathParser) parseArgument() string {
+	tok := p.peek()
+	if tok == nil || tok.kind == tokenCloseGroup {
+		return "<mrow></mrow>"
+	}
+	if tok.kind == tokenOpenGroup {
+		return p.parseGroup()
+	}
+	// only the first digit is the argument, as in x^23 or \frac12
+	if tok.kind == tokenChar && unicode.IsDigit([]rune(tok.value)[0]) {
+		p.next()
+		return "<mn>" + tok.value + "</mn>"
+	}
+	atom, _, ok := p.parseAtom()
+	if !ok {
+		return "<mrow></mrow>"
+	}
+	return atom
+}
+
+func (p *mathParser) parseGroup() string {
+	p.next() // {
+	elements := p.parseRow(nil)
+	if tok := p.peek(); tok != nil && tok.kind == tokenCloseGroup {
+		p.next()
+	}
+	return wrapRow(elements)
+}
+
+// parseRawGroup returns the literal text inside a {group}, used for things
+// like \text{...} where the content isn't math.
+func (p *mathParser) parseRawGroup() string {
+	tok := p.peek()
+	if tok == nil || tok.kind != tokenOpenGroup {
+		if tok != nil {
+			p.next()
+			return tok.value
+		}
+		return ""
+	}
+	p.next()
+
+	var b strings.Builder
+	depth := 1
+	for {
+		tok := p.next()
+		if tok == nil {
+			return b.String()
+		}
+		switch tok.kind {
+		case tokenOpenGroup:
+			depth++
+			b.WriteString("{")
+		case tokenCloseGroup:
+			depth--
+			if depth == 0 {
+				return b.String()
+			}
+			b.WriteString("}")
+		case tokenCommand:
+			if tok.value == " " || tok.value == "," {
+				b.WriteString(" ")
+			} else {
+				b.WriteString(tok.value)
+			}
+		case tokenSuperscript:
+			b.WriteString("^")
+		case tokenSubscript:
+			b.WriteString("_")
+		case tokenAlign:
+			b.WriteString("&")
+		default:
+			b.WriteString(tok.value)
+		}
+	}
+}
+
+// parseAtom parses a single element. The second return value reports whether
+// the element is a large operator (like \sum) whose scripts go above/below.
+func (p *mathParser) parseAtom() (string, bool, bool) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenOpenGroup:
+		p.pos--
+		return p.parseGroup(), false, true
+
+	case tokenAlign, tokenNewline, tokenCloseGroup:
+		// only meaningful inside environments, ignore them elsewhere
+		return "", false, false
+
+	case tokenChar:
+		c := tok.value
+		switch {
+		case unicode.IsDigit([]rune(c)[0]) || c == ".":
+			number := c
+			for {
+				next := p.peek()
+				if next == nil || next.kind != tokenChar ||
+					!(unicode.IsDigit([]rune(next.value)[0]) || next.value == ".") {
+					break
+				}
+				number += next.value
+				p.next()
+			}
+			return "<mn>" + html.EscapeString(number) + "</mn>", false, true
+		case unicode.IsLetter([]rune(c)[0]):
+			return "<mi>" + html.EscapeString(c) + "</mi>", false, true
+		case c == "'":
+			return "<mo>&#x2032;</mo>", false, true
+		default:
+			return "<mo>" + html.EscapeString(c) + "</mo>", false, true
+		}
+
+	case tokenCommand:
+		return p.parseCommand(tok.value)
+	}
+
+	return "", false, false
+}
+
+func (p *mathParser) parseCommand(name string) (string, bool, bool) {
+	if symbol, ok := mathIdentifiers[name]; ok {
+		return "<mi>" + symbol + "</mi>", false, true
+	}
+	if symbol, ok := mathOperators[name]; ok {
+		return "<mo>" + symbol + "</mo>", false, true
+	}
+	if symbol, ok := mathLargeOperators[name]; ok {
+		return "<mo largeop=\"true\">" + symbol + "</mo>", true, true
+	}
+	if mathFunctions[name] {
+		// \lim and friends take their scripts below, like large operators
+		return "<mi>" + name + "</mi>", name == "lim" || name == "max" || name == "min", true
+	}
+	if variant, ok := mathVariants[name]; ok {
+		content := p.parseRawGroup()
+		return `<mi mathvariant="` + variant + `">` + html.EscapeString(content) + "</mi>", false, true
+	}
+	if accent, ok := mathAccents[name]; ok {
+		arg := p.parseArgument()
+		return `<mover accent="true">` + arg + "<mo>" + accent + "</mo></mover>", false, true
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac":
+		num := p.parseArgument()
+		den := p.parseArgument()
+		return "<mfrac>" + num + den + "</mfrac>", false, true
+
+	case "binom":
+		top := p.parseArgument()
+		bottom := p.parseArgument()
+		return `<mrow><mo>(</mo><mfrac linethickness="0">` + top + bottom + `</mfrac><mo>)</mo></mrow>`, false, true
+
+	case "sqrt":
+		var index string
+		if tok := p.peek(); tok != nil && tok.kind == tokenChar && tok.value == "[" {
+			p.next()
+			index = wrapRow(p.parseRow(func(t latexToken) bool { return t.kind == tokenChar && t.value == "]" }))
+			p.next()
+		}
+		radicand := p.parseArgument()
+		if index != "" {
+			return "<mroot>" + radicand + index + "</mroot>", false, true
+		}
+		return "<msqrt>" + radicand + "</msqrt>", false, true
+
+	case "text", "textrm", "textit", "textbf", "mbox", "operatorname":
+		content := p.parseRawGroup()
+		if name == "operatorname" {
+			return "<mi>" + html.EscapeString(content) + "</mi>", false, true
+		}
+		return "<mtext>" + html.EscapeString(content) + "</mtext>", false, true
+
+	case "left", "right", "big", "Big", "bigg", "Bigg", "bigl", "bigr", "Bigl", "Bigr":
+		delim := p.next()
+		if delim == nil {
+			return "", false, false
+		}
+		symbol := delimiterSymbol(*delim)
+		if symbol == "" {
+			// \left. and \right. are invisible
+			return "", false, false
+		}
+		return `<mo stretchy="true">` + symbol + "</mo>", false, true
+
+	case "begin":
+		return p.parseEnvironment(p.parseRawGroup()), false, true
+
+	case "end":
+		p.parseRawGroup()
+		return "", false, false
+
+	case ",", ":", ";", " ", "quad", "qquad", "!":
+		width := map[string]string{",": "0.17em", ":": "0.22em", ";": "0.28em", " ": "0.33em",
+			"quad": "1em", "qquad": "2em", "!": "0em"}[name]
+		return `<mspace width="` + width + `"></mspace>`, false, true
+
+	case "{", "}", "|", "#", "%", "$", "&", "_":
+		return "<mo>" + html.EscapeString(name) + "</mo>", false, true
+	}
+
+	return "<merror><mtext>\\" + html.EscapeString(name) + "</mtext></merror>", false, true
+}
+
+func (p *mathParser) parseEnvironment(name string) string {
+	var open, close string
+	switch name {
+	case "pmatrix":
+		open, close = "(", ")"
+	case "bmatrix":
+		open, close = "[", "]"
+	case "Bmatrix", "cases":
+		open, close = "{", ""
+		if name == "Bmatrix" {
+			close = "}"
+		}
+	case "vmatrix":
+		open, close = "|", "|"
+	case "matrix", "aligned", "align", "align*", "array", "gathered", "split":
+	default:
+		return "<merror><mtext>" + html.EscapeString(name) + "</mtext></merror>"
+	}
+
+	// array takes a column spec we don't care about
+	if name == "array" {
+		p.parseRawGroup()
+	}
+
+	var table strings.Builder
+	table.WriteString("<mtable>")
+	for {
+		table.WriteString("<mtr>")
+		for {
+			cell := p.parseRow(func(t latexToken) bool {
+				return t.kind == tokenAlign || t.kind == tokenNewline ||
+					(t.kind == tokenCommand && t.value == "end")
+			})
+			table.WriteString("<mtd>" + wrapRow(cell) + "</mtd>")
+
+			tok := p.peek()
+			if tok == nil || tok.kind != tokenAlign {
+				break
+			}
+			p.next()
+		}
+		table.WriteString("</mtr>")
+
+		tok := p.peek()
+		if tok == nil || tok.kind != tokenNewline {
+			break
+		}
+		p.next()
+	}
+	table.WriteString("</mtable>")
+
+	if tok := p.peek(); tok != nil && tok.kind == tokenCommand && tok.value == "end" {
+		p.next()
+		p.parseRawGroup()
+	}
+
+	if open == "" {
+		return table.String()
+	}
+	result := "<mrow><mo>" + html.EscapeString(open) + "</mo>" + table.String()
+	if close != "" {
+		result += "<mo>" + html.EscapeString(close) + "</mo>"
+	}
+	return result + "</mrow>"
+}
+
+func delimiterSymbol(tok latexToken) string {
+	switch tok.kind {
+	case tokenChar:
+		if tok.value == "." {
+			return ""
+		}
+		return html.EscapeString(tok.value)
+	case tokenCommand:
+		switch tok.value {
+		case "{":
+			return "{"
+		case "}":
+			return "}"
+		case "|":
+			return "&#x2016;"
+		case "langle":
+			return "&#x27E8;"
+		case "rangle":
+			return "&#x27E9;"
+		case "lfloor":
+			return "&#x230A;"
+		case "rfloor":
+			return "&#x230B;"
+		case "lceil":
+			return "&#x2308;"
+		case "rceil":
+			return "&#x2309;"
+		}
+	}
+	return ""
+}
+
+func wrapRow(elements []string) string {
+	if len(elements) == 1 {
+		return elements[0]
+	}
+	return "<mrow>" + strings.Join(elements, "") + "</mrow>"
+}
+
+var mathIdentifiers = map[string]string{
+	"alpha": "&#x3B1;", "beta": "&#x3B2;", "gamma": "&#x3B3;", "delta": "&#x3B4;", "epsilon": "&#x3F5;",
+	"varepsilon": "&#x3B5;", "zeta": "&#x3B6;", "eta": "&#x3B7;", "theta": "&#x3B8;", "vartheta": "&#x3D1;",
+	"iota": "&#x3B9;", "kappa": "&#x3BA;", "lambda": "&#x3BB;", "mu": "&#x3BC;", "nu": "&#x3BD;",
+	"xi": "&#x3BE;", "pi": "&#x3C0;", "varpi": "&#x3D6;", "rho": "&#x3C1;", "varrho": "&#x3F1;",
+	"sigma": "&#x3C3;", "varsigma": "&#x3C2;", "tau": "&#x3C4;", "upsilon": "&#x3C5;", "phi": "&#x3D5;",
+	"varphi": "&#x3C6;", "chi": "&#x3C7;", "psi": "&#x3C8;", "omega": "&#x3C9;",
+	"Gamma": "&#x393;", "Delta": "&#x394;", "Theta": "&#x398;", "Lambda": "&#x39B;", "Xi": "&#x39E;",
+	"Pi": "&#x3A0;", "Sigma": "&#x3A3;", "Upsilon": "&#x3A5;", "Phi": "&#x3A6;", "Psi": "&#x3A8;",
+	"Omega": "&#x3A9;",
+	"infty": "&#x221E;", "partial": "&#x2202;", "nabla": "&#x2207;", "hbar": "&#x210F;", "ell": "&#x2113;",
+	"emptyset": "&#x2205;", "varnothing": "&#x2205;", "aleph": "&#x2135;", "Re": "&#x211C;", "Im": "&#x2111;",
+}
+
+var mathOperators = map[string]string{
+	"pm": "&#xB1;", "mp": "&#x2213;", "times": "&#xD7;", "div": "&#xF7;", "cdot": "&#x22C5;", "ast": "&#x2217;",
+	"star": "&#x22C6;", "circ": "&#x2218;", "bullet": "&#x2219;",
+	"leq": "&#x2264;", "le": "&#x2264;", "geq": "&#x2265;", "ge": "&#x2265;", "neq": "&#x2260;", "ne": "&#x2260;",
+	"approx": "&#x2248;", "equiv": "&#x2261;", "sim": "&#x223C;", "simeq": "&#x2243;", "cong": "&#x2245;",
+	"propto": "&#x221D;", "ll": "&#x226A;", "gg": "&#x226B;",
+	"in": "&#x2208;", "notin": "&#x2209;", "ni": "&#x220B;", "subset": "&#x2282;", "supset": "&#x2283;",
+	"subseteq": "&#x2286;", "supseteq": "&#x2287;", "cup": "&#x222A;", "cap": "&#x2229;", "setminus": "&#x2216;",
+	"land": "&#x2227;", "wedge": "&#x2227;", "lor": "&#x2228;", "vee": "&#x2228;", "neg": "&#xAC;", "lnot": "&#xAC;",
+	"forall": "&#x2200;", "exists": "&#x2203;", "nexists": "&#x2204;",
+	"to": "&#x2192;", "rightarrow": "&#x2192;", "leftarrow": "&#x2190;", "gets": "&#x2190;",
+	"leftrightarrow": "&#x2194;", "Rightarrow": "&#x21D2;", "Leftarrow": "&#x21D0;",
+	"Leftrightarrow": "&#x21D4;", "implies": "&#x21D2;", "iff": "&#x21D4;", "mapsto": "&#x21A6;",
+	"uparrow": "&#x2191;", "downarrow": "&#x2193;",
+	"ldots": "&#x2026;", "dots": "&#x2026;", "cdots": "&#x22EF;", "vdots": "&#x22EE;", "ddots": "&#x22F1;",
+	"mid": "&#x2223;", "parallel": "&#x2225;", "perp": "&#x22A5;", "angle": "&#x2220;", "triangle": "&#x25B3;",
+	"langle": "&#x27E8;", "rangle": "&#x27E9;", "lfloor": "&#x230A;", "rfloor": "&#x230B;",
+	"lceil": "&#x2308;", "rceil": "&#x2309;", "vert": "|", "Vert": "&#x2016;",
+	"oplus": "&#x2295;", "otimes": "&#x2297;", "top": "&#x22A4;", "bot": "&#x22A5;", "vdash": "&#x22A2;",
+	"models": "&#x22A8;", "prime": "&#x2032;", "deg": "&#xB0;",
+}
+
+var mathLargeOperators = map[string]string{
+	"sum": "&#x2211;", "prod": "&#x220F;", "coprod": "&#x2210;", "int": "&#x222B;", "iint": "&#x222C;",
+	"iiint": "&#x222D;", "oint": "&#x222E;", "bigcup": "&#x22C3;", "bigcap": "&#x22C2;",
+	"bigoplus": "&#x2A01;", "bigotimes": "&#x2A02;",
+}
+
+var mathFunctions = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "cot": true, "sec": true, "csc": true,
+	"arcsin": true, "arccos": true, "arctan": true, "sinh": true, "cosh": true, "tanh": true,
+	"log": true, "ln": true, "lg": true, "exp": true, "lim": true, "max": true, "min": true,
+	"sup": true, "inf": true, "det": true, "gcd": true, "dim": true, "ker": true, "arg": true, "Pr": true,
+}
+
+var mathVariants = map[string]string{
+	"mathbb": "double-struck", "mathbf": "bold", "mathit": "italic", "mathrm": "normal",
+	"mathcal": "script", "mathscr": "script", "mathfrak": "fraktur", "mathsf": "sans-serif",
+	"mathtt": "monospace", "boldsymbol": "bold-italic",
+}
+
+var mathAccents = map[string]string{
+	"hat": "^", "widehat": "^", "bar": "&#xAF;", "overline": "&#xAF;", "vec": "&#x2192;",
+	"dot": "&#x2D9;", "ddot": "&#xA8;", "tilde": "~", "widetilde": "~",
+}
@@ -0,0 +1,112 @@
+package render
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLatexToMathML(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		// the content of the <math> element
+		want string
+	}{
+		{"fraction", `\frac{a}{b}`, `<mfrac><mi>a</mi><mi>b</mi></mfrac>`},
+		{"fraction of digits", `\frac12`, `<mfrac><mn>1</mn><mn>2</mn></mfrac>`},
+		{"square root", `\sqrt{x}`, `<msqrt><mi>x</mi></msqrt>`},
+		{"root with an index", `\sqrt[3]{x+1}`, `<mroot><mrow><mi>x</mi><mo>+</mo><mn>1</mn></mrow><mn>3</mn></mroot>`},
+		{"superscript", `x^2`, `<msup><mi>x</mi><mn>2</mn></msup>`},
+		{"superscript takes one digit", `x^23`, `<mrow><msup><mi>x</mi><mn>2</mn></msup><mn>3</mn></mrow>`},
+		{"subscript", `x_i`, `<msub><mi>x</mi><mi>i</mi></msub>`},
+		{"both scripts", `x_i^2`, `<msubsup><mi>x</mi><mi>i</mi><mn>2</mn></msubsup>`},
+		{"script without a base", `^2`, `<msup><mrow></mrow><mn>2</mn></msup>`},
+		{
+			"large operator",
+			`\sum_{i=1}^n i`,
+			`<mrow><munderover><mo largeop="true">&#x2211;</mo><mrow><mi>i</mi><mo>=</mo><mn>1</mn></mrow><mi>n</mi></munderover><mi>i</mi></mrow>`,
+		},
+		{"limit", `\lim_{x\to0}`, `<munder><mi>lim</mi><mrow><mi>x</mi><mo>&#x2192;</mo><mn>0</mn></mrow></munder>`},
+		{
+			"left and right",
+			`\left( x \right)`,
+			`<mrow><mo stretchy="true">(</mo><mi>x</mi><mo stretchy="true">)</mo></mrow>`,
+		},
+		{"invisible delimiter", `\left\{ x \right.`, `<mrow><mo stretchy="true">{</mo><mi>x</mi></mrow>`},
+		{
+			"pmatrix",
+			`\begin{pmatrix} a & b \\ c & d \end{pmatrix}`,
+			`<mrow><mo>(</mo><mtable><mtr><mtd><mi>a</mi></mtd><mtd><mi>b</mi></mtd></mtr><mtr><mtd><mi>c</mi></mtd><mtd><mi>d</mi></mtd></mtr></mtable><mo>)</mo></mrow>`,
+		},
+		{"bmatrix", `\begin{bmatrix} 1 \end{bmatrix}`, `<mrow><mo>[</mo><mtable><mtr><mtd><mn>1</mn></mtd></mtr></mtable><mo>]</mo></mrow>`},
+		{
+			"cases",
+			`\begin{cases} 1 & x>0 \\ 0 \end{cases}`,
+			`<mrow><mo>{</mo><mtable><mtr><mtd><mn>1</mn></mtd><mtd><mrow><mi>x</mi><mo>&gt;</mo><mn>0</mn></mrow></mtd></mtr><mtr><mtd><mn>0</mn></mtd></mtr></mtable></mrow>`,
+		},
+
+		{"less than", `a<b`, `<mrow><mi>a</mi><mo>&lt;</mo><mi>b</mi></mrow>`},
+		{"escaped ampersand", `a \& b`, `<mrow><mi>a</mi><mo>&amp;</mo><mi>b</mi></mrow>`},
+		{"markup in text", `\text{a<b&c}`, `<mtext>a&lt;b&amp;c</mtext>`},
+		{"markup in a variant", `\mathrm{<b>}`, `<mi mathvariant="normal">&lt;b&gt;</mi>`},
+		{"markup in an operator name", `\operatorname{<script>}`, `<mi>&lt;script&gt;</mi>`},
+		{"markup delimiters", `\left< x \right>`, `<mrow><mo stretchy="true">&lt;</mo><mi>x</mi><mo stretchy="true">&gt;</mo></mrow>`},
+
+		{"unclosed argument", `\frac{a`, `<mfrac><mi>a</mi><mrow></mrow></mfrac>`},
+		{"unbalanced braces", `}x{`, `<mrow><mi>x</mi><mrow></mrow></mrow>`},
+		{"unclosed groups", `{{x`, `<mi>x</mi>`},
+		{"missing script", `x^`, `<msup><mi>x</mi><mrow></mrow></msup>`},
+		{"script closed early", `x_}`, `<msub><mi>x</mi><mrow></mrow></msub>`},
+		{"unclosed root index", `\sqrt[3`, `<mroot><mrow></mrow><mn>3</mn></mroot>`},
+		{"unclosed text", `\text{`, `<mtext></mtext>`},
+		{"missing delimiter", `\left`, `<mrow></mrow>`},
+		{"unclosed environment", `\begin{pmatrix} a`, `<mrow><mo>(</mo><mtable><mtr><mtd><mi>a</mi></mtd></mtr></mtable><mo>)</mo></mrow>`},
+		{"stray end", `\end{x}`, `<mrow></mrow>`},
+		{"stray alignment", `&\\`, `<mrow></mrow>`},
+		{"trailing backslash", `\`, `<mrow></mrow>`},
+		{"unknown command", `\foo`, `<merror><mtext>\foo</mtext></merror>`},
+		{
+			"unknown command with markup",
+			`\foo{<b>}`,
+			`<mrow><merror><mtext>\foo</mtext></merror><mrow><mo>&lt;</mo><mi>b</mi><mo>&gt;</mo></mrow></mrow>`,
+		},
+		{"unknown symbol command", `\<`, `<merror><mtext>\&lt;</mtext></merror>`},
+		{"unknown environment", `\begin{unknown} x \end{unknown}`, `<mrow><merror><mtext>unknown</mtext></merror><mi>x</mi></mrow>`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			want := `<math xmlns="` + mathMLNamespace + `">` + tc.want + "</math>"
+			if got := latexToMathML(tc.source, false); got != want {
+				t.Errorf("latexToMathML(%q) =\n%s\nwant\n%s", tc.source, got, want)
+			}
+		})
+	}
+}
+
+func TestLatexToMathMLDisplay(t *testing.T) {
+	got := latexToMathML(`x`, true)
+	if want := `<math xmlns="` + mathMLNamespace + `" display="block"><mi>x</mi></math>`; got != want {
+		t.Errorf("latexToMathML() = %s, want %s", got, want)
+	}
+}
+
+func TestLatexToMathMLNeverOutputsSourceMarkup(t *testing.T) {
+	sources := []string{
+		`<script>alert(1)</script>`,
+		`\text{<img src=x onerror=alert(1)>}`,
+		`\begin{<b>}x\end{<b>}`,
+		`\mathbb{</math><b>}`,
+		`\<b\>`,
+		`x^{<b>`,
+	}
+
+	for _, source := range sources {
+		got := latexToMathML(source, false)
+		for _, tag := range []string{"<script", "<img", "<b>", "</math><"} {
+			if strings.Contains(got, tag) {
+				t.Errorf("latexToMathML(%q) = %s, contains %s", source, got, tag)
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Package render turns post Markdown into sanitized HTML. It's the single
+// place where rendering happens so that the public pages, feeds and API all
+// produce the same output.
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"kitty/sanitizer"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	mdhtml "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// Options toggle optional Markdown features. The zero value is not the
+// default, use DefaultOptions.
+type Options struct {
+	Footnotes       bool `json:"footnotes"`
+	DefinitionLists bool `json:"definition_lists"`
+	TaskLists       bool `json:"task_lists"`
+	// renders $...$ and $$...$$ to MathML, otherwise they're left as
+	// \(...\) and \[...\] spans for client side libraries like MathJax
+	Math               bool `json:"math"`
+	SyntaxHighlighting bool `json:"syntax_highlighting"`
+	HeadingAnchors     bool `json:"heading_anchors"`
+	TableOfContents    bool `json:"table_of_contents"`
+	LinksInNewTab      bool `json:"links_in_new_tab"`
+}
+
+// DefaultOptions matches how posts were rendered before rendering became
+// configurable.
+func DefaultOptions() Options {
+	return Options{
+		DefinitionLists: true,
+		LinksInNewTab:   true,
+	}
+}
+
+// ToHTML renders markdown into HTML that is safe to serve, cleaned up with the
+// given sanitizer policy.
+func ToHTML(source string, opts Options, policy sanitizer.PolicyName) []byte {
+	doc := parse(source, opts)
+
+	htmlFlags := mdhtml.CommonFlags
+	if opts.LinksInNewTab {
+		htmlFlags |= mdhtml.HrefTargetBlank
+	}
+	if opts.Footnotes {
+		htmlFlags |= mdhtml.FootnoteReturnLinks
+	}
+	if opts.TableOfContents {
+		htmlFlags |= mdhtml.TOC
+	}
+
+	renderer := mdhtml.NewRenderer(mdhtml.RendererOptions{Flags: htmlFlags})
+	renderer.Opts.RenderNodeHook = nodeHook(renderer, opts)
+
+	rendered := markdown.Render(doc, renderer)
+
+	if opts.TaskLists {
+		rendered = renderTaskLists(rendered)
+	}
+
+	return sanitizer.Sanitize(policy, rendered)
+}
+
+// CommentToHTML renders the Markdown of a reader's comment. Only a small
+// subset of Markdown is supported: headings, images and raw HTML are dropped.
+func CommentToHTML(source string) []byte {
+	extensions := parser.NoIntraEmphasis | parser.FencedCode | parser.Autolink |
+		parser.Strikethrough | parser.HardLineBreak
+	doc := parser.NewWithExtensions(extensions).Parse([]byte(source))
+
+	renderer := mdhtml.NewRenderer(mdhtml.RendererOptions{
+		Flags: mdhtml.CommonFlags | mdhtml.SkipHTML | mdhtml.SkipImages,
+		// headings would stand out from the post, they're kept as paragraphs
+		RenderNodeHook: func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+			if _, ok := node.(*ast.Heading); !ok {
+				return ast.GoToNext, false
+			}
+			if entering {
+				io.WriteString(w, "<p>")
+			} else {
+				io.WriteString(w, "</p>\n")
+			}
+			return ast.GoToNext, true
+		},
+	})
+	return sanitizer.Sanitize(sanitizer.PolicyComments, markdown.Render(doc, renderer))
+}
+
+// parse builds the Markdown syntax tree. The parser is stateful, so a new one
+// is needed for every document.
+func parse(source string, opts Options) ast.Node {
+	extensions := parser.NoIntraEmphasis | parser.Tables | parser.FencedCode | parser.Autolink |
+		parser.Strikethrough | parser.SpaceHeadings | parser.HeadingIDs | parser.BackslashLineBreak |
+		parser.AutoHeadingIDs | parser.MathJax
+	if opts.DefinitionLists {
+		extensions |= parser.DefinitionLists
+	}
+	if opts.Footnotes {
+		extensions |= parser.Footnotes
+	}
+
+	return parser.NewWithExtensions(extensions).Parse([]byte(source))
+}
+
+func nodeHook(renderer *mdhtml.Renderer, opts Options) mdhtml.RenderNodeFunc {
+	return func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+		switch node := node.(type) {
+		case *ast.Math:
+			if opts.Math {
+				io.WriteString(w, latexToMathML(string(node.Literal), false))
+				return ast.GoToNext, true
+			}
+
+		case *ast.MathBlock:
+			if opts.Math {
+				if entering {
+					io.WriteString(w, latexToMathML(string(node.Literal), true))
+				}
+				return ast.SkipChildren, true
+			}
+
+		case *ast.CodeBlock:
+			if opts.SyntaxHighlighting && highlightCode(w, node) {
+				return ast.GoToNext, true
+			}
+
+		case *ast.Heading:
+			if opts.HeadingAnchors && !entering && node.HeadingID != "" {
+				fmt.Fprintf(w, ` <a class="heading-anchor" href="#%s" aria-label="Link to this section">#</a>`,
+					html.EscapeString(node.HeadingID))
+				renderer.HeadingExit(w, node)
+				return ast.GoToNext, true
+			}
+		}
+
+		return ast.GoToNext, false
+	}
+}
+
+var highlightFormatter = chromahtml.New(chromahtml.WithClasses(true))
+
+// highlightCode writes a syntax highlighted version of the code block.
+// Returns false if the block's language is unknown, in which case the default
+// rendering should be used instead.
+func highlightCode(w io.Writer, block *ast.CodeBlock) bool {
+	language, _, _ := strings.Cut(strings.TrimSpace(string(block.Info)), " ")
+	if language == "" {
+		return false
+	}
+
+	lexer := lexers.Get(language)
+	if lexer == nil {
+		return false
+	}
+
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, string(block.Literal))
+	if err != nil {
+		return false
+	}
+
+	var buf bytes.Buffer
+	err = highlightFormatter.Format(&buf, styles.Fallback, iterator)
+	if err != nil {
+		return false
+	}
+
+	w.Write(buf.Bytes())
+	return true
+}
+
+var taskListItemRegex = regexp.MustCompile(`<li>(\s*<p>)?\[([ xX])\]\s`)
+
+// renderTaskLists turns list items starting with "[ ]" or "[x]" into
+// checkboxes.
+func renderTaskLists(rendered []byte) []byte {
+	return taskListItemRegex.ReplaceAllFunc(rendered, func(match []byte) []byte {
+		groups := taskListItemRegex.FindSubmatch(match)
+		checked := ""
+		if !bytes.Equal(groups[2], []byte(" ")) {
+			checked = " checked"
+		}
+		return []byte(fmt.Sprintf(`<li class="task-list-item">%s<input type="checkbox" disabled%s> `, groups[1], checked))
+	})
+}
@@ -0,0 +1,52 @@
+package render
+
+import (
+	"kitty/sanitizer"
+	"strings"
+	"testing"
+
+	"github.com/gomarkdown/markdown"
+	mdhtml "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// baselineToHTML renders Markdown the way posts were rendered before the
+// render package existed.
+func baselineToHTML(source string) []byte {
+	p := parser.NewWithExtensions(parser.CommonExtensions | parser.AutoHeadingIDs)
+	doc := p.Parse([]byte(source))
+	renderer := mdhtml.NewRenderer(mdhtml.RendererOptions{Flags: mdhtml.CommonFlags | mdhtml.HrefTargetBlank})
+	return sanitizer.Sanitize(sanitizer.PolicyStandard, markdown.Render(doc, renderer))
+}
+
+func TestDefaultOptionsMatchBaseline(t *testing.T) {
+	documents := map[string]string{
+		"headings and links": "# Title\n\nSome [link](https://example.com) and `code`.\n",
+		"table":              "| a | b |\n|---|---|\n| 1 | 2 |\n",
+		"definition list":    "Term\n: Definition\n",
+		"inline math":        "Euler said $e^{i\\pi} + 1 = 0$ once.\n",
+		"display math":       "$$\nx^2\n$$\n",
+		"fenced code":        "```go\nfunc main() {}\n```\n",
+		"strikethrough":      "~~gone~~ and https://example.com\n",
+	}
+
+	for name, source := range documents {
+		t.Run(name, func(t *testing.T) {
+			got := string(ToHTML(source, DefaultOptions(), sanitizer.PolicyStandard))
+			want := string(baselineToHTML(source))
+			if got != want {
+				t.Errorf("ToHTML(%q) =\n%s\nwant\n%s", source, got, want)
+			}
+		})
+	}
+}
+
+func TestMathOptionRendersMathML(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Math = true
+
+	got := string(ToHTML("$x^2$\n", opts, sanitizer.PolicyStandard))
+	if want := "<math"; !strings.Contains(got, want) {
+		t.Errorf("ToHTML with Math = %q, want it to contain %q", got, want)
+	}
+}
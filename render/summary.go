@@ -0,0 +1,116 @@
+package render
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+const (
+	wordsPerMinute = 200
+	excerptLength  = 200
+)
+
+// Heading is an entry of a document's outline. ID matches the id attribute
+// of the heading in the rendered HTML.
+type Heading struct {
+	Level int    `json:"level"`
+	ID    string `json:"id"`
+	Text  string `json:"text"`
+}
+
+// Summary describes a document without rendering it to HTML.
+type Summary struct {
+	// Excerpt is the start of the document's prose as plain text, cut at a
+	// word boundary.
+	Excerpt            string
+	WordCount          int
+	ReadingTimeMinutes int
+	Headings           []Heading
+}
+
+// Summarize extracts plain text information from markdown. Code blocks and
+// raw HTML don't count as words, everything else that would be shown to a
+// reader does.
+func Summarize(source string, opts Options) Summary {
+	doc := parse(source, opts)
+
+	var summary Summary
+	var text, paragraph, heading strings.Builder
+	var excerptParts []string
+	excerptRunes := 0
+
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch node := node.(type) {
+		case *ast.CodeBlock, *ast.HTMLBlock, *ast.HTMLSpan:
+			return ast.SkipChildren
+
+		case *ast.Text, *ast.Code, *ast.Math:
+			literal := string(node.AsLeaf().Literal)
+			text.WriteString(literal)
+			paragraph.WriteString(literal)
+			heading.WriteString(literal)
+
+		case *ast.Softbreak, *ast.Hardbreak, *ast.MathBlock:
+			if leaf := node.AsLeaf(); leaf != nil {
+				text.Write(leaf.Literal)
+			}
+			text.WriteString(" ")
+			paragraph.WriteString(" ")
+
+		case *ast.Heading:
+			if entering {
+				heading.Reset()
+				return ast.GoToNext
+			}
+			summary.Headings = append(summary.Headings, Heading{
+				Level: node.Level,
+				ID:    node.HeadingID,
+				Text:  strings.Join(strings.Fields(heading.String()), " "),
+			})
+			text.WriteString(" ")
+
+		case *ast.Paragraph:
+			if entering {
+				paragraph.Reset()
+				return ast.GoToNext
+			}
+			if excerptRunes < excerptLength {
+				part := strings.Join(strings.Fields(paragraph.String()), " ")
+				if part != "" {
+					excerptParts = append(excerptParts, part)
+					excerptRunes += utf8.RuneCountInString(part) + 1
+				}
+			}
+			text.WriteString(" ")
+
+		default:
+			if !entering {
+				text.WriteString(" ")
+			}
+		}
+		return ast.GoToNext
+	})
+
+	summary.WordCount = len(strings.Fields(text.String()))
+	summary.ReadingTimeMinutes = (summary.WordCount + wordsPerMinute - 1) / wordsPerMinute
+	summary.Excerpt = truncateWords(strings.Join(excerptParts, " "), excerptLength)
+
+	return summary
+}
+
+// truncateWords shortens s to at most limit runes without cutting words in
+// half, adding an ellipsis when something was removed.
+func truncateWords(s string, limit int) string {
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+
+	runes := []rune(s)
+	cut := string(runes[:limit])
+	if i := strings.LastIndexByte(cut, ' '); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,.;:") + "…"
+}
@@ -0,0 +1,143 @@
+// Package sanitizer cleans up user generated HTML (e.g. rendered Markdown)
+// using allowlist based policies, so that it can be safely served to visitors.
+//
+// Rendered HTML is cached, changes to the policies must come with a bump of
+// the render version in render/cache.go.
+package sanitizer
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+type PolicyName string
+
+const (
+	// PolicyStrict only allows text formatting, headings, lists, quotes, code
+	// and links.
+	PolicyStrict = PolicyName("strict")
+	// PolicyStandard allows everything Markdown can produce, including images
+	// and tables.
+	PolicyStandard = PolicyName("standard")
+	// PolicyEmbeds is PolicyStandard plus iframes from well known video hosts.
+	PolicyEmbeds = PolicyName("embeds")
+	// PolicyComments is for readers' comments, it only allows text
+	// formatting, lists, quotes, code and links. Authors can't pick it for
+	// their posts.
+	PolicyComments = PolicyName("comments")
+)
+
+const DefaultPolicy = PolicyStandard
+
+var AllPolicies = []PolicyName{PolicyStrict, PolicyStandard, PolicyEmbeds}
+
+func IsValidPolicy(name PolicyName) bool {
+	for _, policy := range AllPolicies {
+		if policy == name {
+			return true
+		}
+	}
+	return false
+}
+
+var allowedEmbedSources = regexp.MustCompile(
+	`^https://(www\.youtube\.com/embed/|www\.youtube-nocookie\.com/embed/|player\.vimeo\.com/video/|open\.spotify\.com/embed/|bandcamp\.com/EmbeddedPlayer/)`)
+
+var (
+	policies     map[PolicyName]*bluemonday.Policy
+	policiesOnce sync.Once
+)
+
+func buildPolicies() {
+	strict := bluemonday.NewPolicy()
+	strict.AllowElements("p", "br", "hr", "b", "strong", "i", "em", "del", "s", "sub", "sup",
+		"blockquote", "ul", "ol", "li", "pre", "code", "span")
+	strict.AllowStandardURLs()
+	strict.AllowAttrs("href").OnElements("a")
+	strict.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	addCommonRules(strict)
+
+	standard := bluemonday.UGCPolicy()
+	addCommonRules(standard)
+
+	embeds := bluemonday.UGCPolicy()
+	addCommonRules(embeds)
+	embeds.AllowElements("iframe")
+	embeds.AllowAttrs("src").Matching(allowedEmbedSources).OnElements("iframe")
+	embeds.AllowAttrs("width", "height").Matching(bluemonday.NumberOrPercent).OnElements("iframe")
+	embeds.AllowAttrs("allowfullscreen").OnElements("iframe")
+	embeds.AllowAttrs("title").OnElements("iframe")
+
+	comments := bluemonday.NewPolicy()
+	comments.AllowElements("p", "br", "b", "strong", "i", "em", "del", "s",
+		"blockquote", "ul", "ol", "li", "pre", "code")
+	comments.AllowStandardURLs()
+	comments.AllowAttrs("href").OnElements("a")
+	comments.AllowURLSchemes("http", "https", "mailto")
+	// links written by strangers shouldn't be endorsed
+	comments.RequireNoFollowOnLinks(true)
+	comments.RequireNoReferrerOnLinks(true)
+	comments.AddTargetBlankToFullyQualifiedLinks(true)
+
+	policies = map[PolicyName]*bluemonday.Policy{
+		PolicyStrict:   strict,
+		PolicyStandard: standard,
+		PolicyEmbeds:   embeds,
+		PolicyComments: comments,
+	}
+}
+
+var (
+	idRegex        = regexp.MustCompile(`^[\w:.-]+$`)
+	classListRegex = regexp.MustCompile(`^[\w -]+$`)
+)
+
+var mathMLElements = []string{
+	"math", "mrow", "mi", "mn", "mo", "mtext", "mspace", "msup", "msub", "msubsup", "mfrac", "msqrt", "mroot",
+	"munder", "mover", "munderover", "mtable", "mtr", "mtd", "merror",
+}
+
+// addCommonRules allows the markup produced by the Markdown renderer (heading
+// anchors, footnotes, task lists, highlighted code, MathML) and hardens links.
+func addCommonRules(p *bluemonday.Policy) {
+	// ids so that "#anchor" links to headings and footnotes keep working
+	p.AllowAttrs("id").Matching(idRegex).OnElements("h1", "h2", "h3", "h4", "h5", "h6", "sup", "li")
+	// classes are harmless on their own and are used for code languages,
+	// syntax highlighting tokens, footnotes and task lists
+	p.AllowAttrs("class").Matching(classListRegex).OnElements("code", "pre", "span", "div", "sup", "li", "a")
+	p.AllowElements("nav", "div", "span", "sup", "dl", "dt", "dd")
+
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+
+	p.AllowElements(mathMLElements...)
+	// bluemonday drops unknown elements that have no attributes
+	p.AllowNoAttrs().OnElements(mathMLElements...)
+	p.AllowAttrs("xmlns").Matching(regexp.MustCompile(`^http://www\.w3\.org/1998/Math/MathML$`)).OnElements("math")
+	p.AllowAttrs("display").Matching(regexp.MustCompile(`^(block|inline)$`)).OnElements("math")
+	p.AllowAttrs("mathvariant").Matching(regexp.MustCompile(`^[a-z-]+$`)).OnElements("mi")
+	p.AllowAttrs("stretchy", "largeop", "accent").Matching(regexp.MustCompile(`^(true|false)$`)).OnElements("mo", "mover")
+	p.AllowAttrs("linethickness", "width").Matching(regexp.MustCompile(`^[0-9.]+(em)?$`)).OnElements("mfrac", "mspace")
+	p.AllowAttrs("aria-label").OnElements("a")
+
+	// links opened in a new tab automatically get rel="noopener" added
+	p.AllowAttrs("target").Matching(regexp.MustCompile(`^_blank$`)).OnElements("a")
+	p.RequireNoFollowOnLinks(true)
+	p.AllowRelativeURLs(true)
+	p.RequireParseableURLs(true)
+	p.AllowURLSchemes("http", "https", "mailto")
+}
+
+// Sanitize cleans html using the given policy, falling back to the default
+// policy for unknown names.
+func Sanitize(name PolicyName, html []byte) []byte {
+	policiesOnce.Do(buildPolicies)
+
+	policy, ok := policies[name]
+	if !ok {
+		policy = policies[DefaultPolicy]
+	}
+	return policy.SanitizeBytes(html)
+}
@@ -0,0 +1,145 @@
+package sanitizer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+var xssPayloads = []struct {
+	name    string
+	payload string
+}{
+	{"script", `<script>alert(1)</script>`},
+	{"script with src", `<script src="https://evil.example/x.js"></script>`},
+	{"img onerror", `<img src="x" onerror="alert(1)">`},
+	{"body onload", `<body onload="alert(1)">`},
+	{"svg onload", `<svg onload="alert(1)"></svg>`},
+	{"svg script", `<svg><script>alert(1)</script></svg>`},
+	{"javascript href", `<a href="javascript:alert(1)">click</a>`},
+	{"mixed case javascript href", `<a href="jAvAsCrIpT:alert(1)">click</a>`},
+	{"entity encoded javascript href", `<a href="&#106;&#97;&#118;&#97;&#115;&#99;&#114;&#105;&#112;&#116;&#58;alert(1)">click</a>`},
+	{"hex entity javascript href", `<a href="&#x6A;avascript&#x3A;alert(1)">click</a>`},
+	{"javascript href with whitespace", `<a href=" java	script:alert(1)">click</a>`},
+	{"data href", `<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">click</a>`},
+	{"data img", `<img src="data:image/svg+xml,<svg onload=alert(1)>">`},
+	{"iframe srcdoc", `<iframe srcdoc="<script>alert(1)</script>"></iframe>`},
+	{"iframe javascript src", `<iframe src="javascript:alert(1)"></iframe>`},
+	{"iframe unknown host", `<iframe src="https://evil.example/embed"></iframe>`},
+	{"style expression", `<p style="width: expression(alert(1))">text</p>`},
+	{"style element", `<style>body { background: url("javascript:alert(1)") }</style>`},
+	{"object", `<object data="https://evil.example/x.swf"></object>`},
+	{"form action", `<form action="javascript:alert(1)"><button>go</button></form>`},
+	{"meta refresh", `<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`},
+	{"unclosed script", `<script>alert(1)`},
+	{"unclosed img", `<img src=x onerror=alert(1)`},
+	{"unclosed attribute", `<a href="javascript:alert(1)`},
+	{"nested tags", `<scr<script>ipt>alert(1)</scr</script>ipt>`},
+	{"math href", `<math><mi xlink:href="javascript:alert(1)">x</mi></math>`},
+}
+
+// checkSafe parses sanitized output and reports anything that could run
+// scripts: dangerous elements, event handlers, inline styles and links with
+// a scheme other than http(s) and mailto.
+func checkSafe(t *testing.T, output []byte) {
+	t.Helper()
+
+	doc, err := html.Parse(bytes.NewReader(output))
+	if err != nil {
+		t.Fatalf("output doesn't parse: %v", err)
+	}
+
+	var visit func(*html.Node)
+	visit = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "script", "style", "svg", "object", "embed", "form", "meta", "base", "link":
+				t.Errorf("<%s> survived in %q", n.Data, output)
+			}
+
+			for _, attr := range n.Attr {
+				key := strings.ToLower(attr.Key)
+				value := strings.ToLower(strings.Join(strings.Fields(attr.Val), ""))
+				switch {
+				case strings.HasPrefix(key, "on"):
+					t.Errorf("event handler %s survived in %q", key, output)
+				case key == "style" || key == "srcdoc":
+					t.Errorf("%s attribute survived in %q", key, output)
+				case key == "href" || key == "src" || key == "action" || strings.HasSuffix(key, ":href"):
+					if !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") &&
+						!strings.HasPrefix(value, "mailto:") && strings.Contains(value, ":") {
+						t.Errorf("%s=%q survived in %q", key, attr.Val, output)
+					}
+				}
+			}
+
+			if n.Data == "iframe" {
+				src := ""
+				for _, attr := range n.Attr {
+					if attr.Key == "src" {
+						src = attr.Val
+					}
+				}
+				if !allowedEmbedSources.MatchString(src) {
+					t.Errorf("iframe from %q survived in %q", src, output)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			visit(c)
+		}
+	}
+	visit(doc)
+}
+
+func TestSanitizeXSSPayloads(t *testing.T) {
+	for _, policy := range append(AllPolicies, PolicyComments) {
+		for _, tc := range xssPayloads {
+			t.Run(string(policy)+"/"+tc.name, func(t *testing.T) {
+				checkSafe(t, Sanitize(policy, []byte(tc.payload)))
+			})
+		}
+	}
+}
+
+func TestSanitizeKeepsSafeMarkup(t *testing.T) {
+	tests := []struct {
+		policy PolicyName
+		input  string
+		want   string
+	}{
+		{PolicyStrict, `<p><strong>bold</strong> and <em>italic</em></p>`, `<p><strong>bold</strong> and <em>italic</em></p>`},
+		{PolicyStrict, `<a href="https://example.com">link</a>`, `<a href="https://example.com" rel="nofollow">link</a>`},
+		{PolicyStandard, `<h2 id="intro">Intro</h2>`, `<h2 id="intro">Intro</h2>`},
+		{PolicyStandard, `<img src="https://example.com/cat.png" alt="cat">`, `<img src="https://example.com/cat.png" alt="cat">`},
+		{PolicyEmbeds, `<iframe src="https://www.youtube.com/embed/abc"></iframe>`, `<iframe src="https://www.youtube.com/embed/abc"></iframe>`},
+		{PolicyComments, `<a href="https://example.com">link</a>`, `<a href="https://example.com" rel="nofollow noreferrer noopener" target="_blank">link</a>`},
+	}
+
+	for _, tc := range tests {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			got := string(Sanitize(tc.policy, []byte(tc.input)))
+			if got != tc.want {
+				t.Errorf("Sanitize(%q) = %q, want %q", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeStripsImagesFromComments(t *testing.T) {
+	got := string(Sanitize(PolicyComments, []byte(`<p><img src="https://example.com/x.png">text</p>`)))
+	if strings.Contains(got, "<img") {
+		t.Errorf("comments kept an image: %q", got)
+	}
+}
+
+func TestSanitizeUnknownPolicyFallsBackToDefault(t *testing.T) {
+	input := []byte(`<p>text<script>alert(1)</script></p>`)
+	got := Sanitize(PolicyName("nonexistent"), input)
+	want := Sanitize(DefaultPolicy, input)
+	if !bytes.Equal(got, want) {
+		t.Errorf("unknown policy gave %q, want the default policy's %q", got, want)
+	}
+}
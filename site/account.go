@@ -0,0 +1,206 @@
+package site
+
+import (
+	"encoding/json"
+	"fmt"
+	"kitty/database"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func AccountSettings(w http.ResponseWriter, r *http.Request) {
+	user := getSignedInUserOrFail(r)
+
+	var identity *database.OIDCIdentity
+	var identities []database.OIDCIdentity
+	result := database.GetDB().Where("admin_user_id = ?", user.ID).Limit(1).Find(&identities)
+	if result.Error != nil {
+		http.Error(w, "Error loading account", http.StatusInternalServerError)
+		return
+	}
+	if len(identities) > 0 {
+		identity = &identities[0]
+	}
+
+	RenderTemplate(w, r, "dashboard/account", struct {
+		Updated               string
+		HasPassword           bool
+		NeedsReauthentication bool
+		OIDCIdentity          *database.OIDCIdentity
+	}{
+		Updated:               r.URL.Query().Get("updated"),
+		HasPassword:           len(user.PasswordHash) > 0,
+		NeedsReauthentication: needsReauthentication(user),
+		OIDCIdentity:          identity,
+	})
+}
+
+func AccountChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getSignedInUserOrFail(r)
+
+	currentPassword := r.FormValue("current_password")
+	newPassword := r.FormValue("new_password")
+	confirmPassword := r.FormValue("confirm_password")
+
+	if err := checkCurrentPassword(user, currentPassword); err != nil {
+		http.Error(w, asSentence(err.Error()), http.StatusUnauthorized)
+		return
+	}
+
+	if err := validatePassword(newPassword, user.Username); err != nil {
+		http.Error(w, asSentence(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if newPassword != confirmPassword {
+		http.Error(w, "New password and confirmation don't match", http.StatusBadRequest)
+		return
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error changing password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// rotating the session token signs out every other session, since only the
+	// token we hand back to this client will be valid from now on
+	token, err := generateAuthToken()
+	if err != nil {
+		http.Error(w, "Error changing password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	user.PasswordHash = passwordHash
+	user.SessionToken = token
+	user.SignedInAt = &now
+
+	result := database.GetDB().Save(user)
+	if result.Error != nil {
+		http.Error(w, "Error changing password", http.StatusInternalServerError)
+		return
+	}
+
+	setSessionCookie(w, token)
+
+	http.Redirect(w, r, "/dashboard/account?updated=password", http.StatusSeeOther)
+}
+
+func AccountChangeUsername(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getSignedInUserOrFail(r)
+
+	newUsername := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+
+	if err := checkCurrentPassword(user, password); err != nil {
+		http.Error(w, asSentence(err.Error()), http.StatusUnauthorized)
+		return
+	}
+
+	if newUsername == user.Username {
+		http.Redirect(w, r, "/dashboard/account", http.StatusSeeOther)
+		return
+	}
+
+	if err := validateUsername(newUsername); err != nil {
+		http.Error(w, asSentence(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// a user is allowed to change the capitalization of their own username
+	if !strings.EqualFold(newUsername, user.Username) {
+		taken, err := database.IsUsernameTaken(newUsername)
+		if err != nil {
+			http.Error(w, "Error verifying if username exists", http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			http.Error(w, "That username is already taken", http.StatusBadRequest)
+			return
+		}
+	}
+
+	user.Username = newUsername
+	result := database.GetDB().Save(user)
+	if result.Error != nil {
+		http.Error(w, "Error changing username", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account?updated=username", http.StatusSeeOther)
+}
+
+// AccountExport downloads every post owned by the signed in user (including
+// drafts) as a JSON file.
+func AccountExport(w http.ResponseWriter, r *http.Request) {
+	user := getSignedInUserOrFail(r)
+
+	var posts []database.Post
+	result := database.GetDB().Preload("Tags").Preload("Series").Where(&database.Post{AdminUserID: user.ID}).Order("published_date DESC").Find(&posts)
+	if result.Error != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("kitty_export_%s_%s.json", user.Username, time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	exported := make([]apiPost, 0, len(posts))
+	for _, post := range posts {
+		exported = append(exported, newAPIPost(post, user, nil))
+	}
+	encoder.Encode(exported)
+}
+
+func AccountDelete(w http.ResponseWriter, r *http.Request) {
+	user := getSignedInUserOrFail(r)
+
+	switch r.Method {
+	case "GET":
+		RenderTemplate(w, r, "dashboard/delete_account", struct {
+			NeedsReauthentication bool
+		}{
+			NeedsReauthentication: needsReauthentication(user),
+		})
+
+	case "POST":
+		if r.FormValue("confirm_username") != user.Username {
+			http.Error(w, "The username you typed doesn't match your username", http.StatusBadRequest)
+			return
+		}
+
+		if err := checkCurrentPassword(user, r.FormValue("password")); err != nil {
+			http.Error(w, asSentence(err.Error()), http.StatusUnauthorized)
+			return
+		}
+
+		err := database.DeleteUserAndPosts(user.ID)
+		if err != nil {
+			http.Error(w, "Error deleting account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		clearSessionCookie(w)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,321 @@
+package site
+
+import (
+	"fmt"
+	"kitty/database"
+	"kitty/render"
+	"kitty/sanitizer"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	maxAuditLogEntriesToShow = 500
+	maxRobotsTxtLength       = 8 * 1024
+)
+
+// recordAuditEvent stores an admin action in the audit log. Failing to record
+// the event shouldn't undo an action that already happened, so errors are only
+// logged.
+func recordAuditEvent(r *http.Request, action string, targetType string, targetID uint, details string) {
+	actor := getSignedInUserOrFail(r)
+	err := database.RecordAuditEvent(actor.ID, action, targetType, targetID, details)
+	if err != nil {
+		log.Printf("Failed to record audit event '%s' by user %d: %v", action, actor.ID, err)
+	}
+}
+
+func AdminDashboard(w http.ResponseWriter, r *http.Request) {
+	users, err := database.ListUsersWithStats()
+	if err != nil {
+		http.Error(w, "Error fetching users", http.StatusInternalServerError)
+		return
+	}
+
+	settings, err := database.GetInstanceSettings()
+	if err != nil {
+		http.Error(w, "Error loading instance settings", http.StatusInternalServerError)
+		return
+	}
+
+	RenderTemplate(w, r, "admin/index", struct {
+		Users            []database.UserStats
+		Settings         *database.InstanceSettings
+		RenderCache      render.CacheStats
+		DefaultRobotsTxt string
+	}{
+		Users:            users,
+		Settings:         settings,
+		RenderCache:      getRenderCache().Stats(),
+		DefaultRobotsTxt: defaultRobotsTxt,
+	})
+}
+
+func AdminViewUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userID")
+
+	var user database.AdminUser
+	result := database.GetDB().Preload("Posts", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id, title, admin_user_id, published_date, published, hidden_by_admin").
+			Order("published_date DESC")
+	}).First(&user, userID)
+	if result.Error != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	RenderTemplate(w, r, "admin/user", user)
+}
+
+func AdminSuspendUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminLoadTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	suspend := r.FormValue("suspend") == "true"
+
+	var result *gorm.DB
+	var action string
+	if suspend {
+		// also rotate the session token so the user is signed out right away
+		token, err := generateAuthToken()
+		if err != nil {
+			http.Error(w, "Error suspending user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		result = database.GetDB().Model(user).Updates(map[string]any{"suspended_at": now, "session_token": token})
+		action = "suspend_user"
+	} else {
+		result = database.GetDB().Model(user).Update("suspended_at", nil)
+		action = "unsuspend_user"
+	}
+	if result.Error != nil {
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+
+	recordAuditEvent(r, action, "user", user.ID, user.Username)
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+func AdminSetUserRole(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminLoadTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	makeAdmin := r.FormValue("admin") == "true"
+	result := database.GetDB().Model(user).Update("is_admin", makeAdmin)
+	if result.Error != nil {
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+
+	action := "revoke_admin"
+	if makeAdmin {
+		action = "grant_admin"
+	}
+	recordAuditEvent(r, action, "user", user.ID, user.Username)
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+func AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminLoadTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if r.FormValue("confirm_username") != user.Username {
+		http.Error(w, "The username you typed doesn't match the user's username", http.StatusBadRequest)
+		return
+	}
+
+	err := database.DeleteUserAndPosts(user.ID)
+	if err != nil {
+		http.Error(w, "Error deleting user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recordAuditEvent(r, "delete_user", "user", user.ID, user.Username)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// adminLoadTargetUser loads the user an admin action is about to be applied to.
+// Admins can't act on their own account from the admin panel, so that they
+// can't accidentally lock themselves out.
+func adminLoadTargetUser(w http.ResponseWriter, r *http.Request) (*database.AdminUser, bool) {
+	userID := chi.URLParam(r, "userID")
+
+	var user database.AdminUser
+	result := database.GetDB().First(&user, userID)
+	if result.Error != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if user.ID == getSignedInUserOrFail(r).ID {
+		http.Error(w, "You can't perform this action on your own account", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return &user, true
+}
+
+func AdminHidePost(w http.ResponseWriter, r *http.Request) {
+	postID := chi.URLParam(r, "postID")
+
+	var post database.Post
+	result := database.GetDB().First(&post, postID)
+	if result.Error != nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	hide := r.FormValue("hide") == "true"
+	result = database.GetDB().Model(&post).Update("hidden_by_admin", hide)
+	if result.Error != nil {
+		http.Error(w, "Error updating post", http.StatusInternalServerError)
+		return
+	}
+
+	action := "unhide_post"
+	if hide {
+		action = "hide_post"
+	}
+	recordAuditEvent(r, action, "post", post.ID, post.Title)
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", post.AdminUserID), http.StatusSeeOther)
+}
+
+func AdminUpdateSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := database.GetInstanceSettings()
+	if err != nil {
+		http.Error(w, "Error loading instance settings", http.StatusInternalServerError)
+		return
+	}
+
+	mode := database.RegistrationMode(r.FormValue("registration_mode"))
+	switch mode {
+	case database.RegistrationModeOpen, database.RegistrationModeInviteOnly, database.RegistrationModeClosed:
+	default:
+		http.Error(w, "Unknown registration mode: "+string(mode), http.StatusBadRequest)
+		return
+	}
+
+	htmlPolicy := sanitizer.PolicyName(r.FormValue("html_policy"))
+	if !sanitizer.IsValidPolicy(htmlPolicy) {
+		http.Error(w, "Unknown HTML policy: "+string(htmlPolicy), http.StatusBadRequest)
+		return
+	}
+
+	robotsTxt := strings.TrimSpace(strings.ReplaceAll(r.FormValue("robots_txt"), "\r\n", "\n"))
+	if len(robotsTxt) > maxRobotsTxtLength {
+		http.Error(w, fmt.Sprintf("robots.txt rules can't be longer than %d characters", maxRobotsTxtLength), http.StatusBadRequest)
+		return
+	}
+
+	changes := fmt.Sprintf("registration mode: %s -> %s, HTML policy: %s -> %s",
+		settings.RegistrationMode, mode, settings.HTMLPolicy, htmlPolicy)
+	if robotsTxt != settings.RobotsTxt {
+		changes += ", robots.txt rules changed"
+	}
+	analyticsDisabled := r.FormValue("analytics_disabled") == "on"
+	if analyticsDisabled != settings.AnalyticsDisabled {
+		changes += fmt.Sprintf(", analytics disabled: %t -> %t", settings.AnalyticsDisabled, analyticsDisabled)
+	}
+
+	settings.RegistrationMode = mode
+	settings.HTMLPolicy = string(htmlPolicy)
+	settings.RobotsTxt = robotsTxt
+	settings.AnalyticsDisabled = analyticsDisabled
+	err = database.SaveInstanceSettings(settings)
+	if err != nil {
+		http.Error(w, "Error saving instance settings", http.StatusInternalServerError)
+		return
+	}
+
+	recordAuditEvent(r, "update_settings", "instance", 0, changes)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+func AdminInvites(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		var invites []database.InviteCode
+		result := database.GetDB().Order("created_at DESC").Find(&invites)
+		if result.Error != nil {
+			http.Error(w, "Error fetching invite codes", http.StatusInternalServerError)
+			return
+		}
+
+		RenderTemplate(w, r, "admin/invites", invites)
+
+	case "POST":
+		code, err := generateAuthToken()
+		if err != nil {
+			http.Error(w, "Error generating invite code: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		invite := database.InviteCode{Code: code}
+		invite.CreatedByID = &getSignedInUserOrFail(r).ID
+
+		if days, err := strconv.Atoi(r.FormValue("expires_in_days")); err == nil && days > 0 {
+			expiresAt := time.Now().AddDate(0, 0, days)
+			invite.ExpiresAt = &expiresAt
+		}
+
+		result := database.GetDB().Create(&invite)
+		if result.Error != nil {
+			http.Error(w, "Error creating invite code", http.StatusInternalServerError)
+			return
+		}
+
+		recordAuditEvent(r, "create_invite", "invite", invite.ID, "")
+		http.Redirect(w, r, "/admin/invites", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func AdminDeleteInvite(w http.ResponseWriter, r *http.Request) {
+	inviteID := chi.URLParam(r, "inviteID")
+
+	var invite database.InviteCode
+	result := database.GetDB().First(&invite, inviteID)
+	if result.Error != nil {
+		http.Error(w, "Invite code not found", http.StatusNotFound)
+		return
+	}
+
+	result = database.GetDB().Delete(&invite)
+	if result.Error != nil {
+		http.Error(w, "Error deleting invite code", http.StatusInternalServerError)
+		return
+	}
+
+	recordAuditEvent(r, "delete_invite", "invite", invite.ID, "")
+	http.Redirect(w, r, "/admin/invites", http.StatusSeeOther)
+}
+
+func AdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	var entries []database.AuditLogEntry
+	result := database.GetDB().Preload("Actor").
+		Order("created_at DESC").
+		Limit(maxAuditLogEntriesToShow).
+		Find(&entries)
+	if result.Error != nil {
+		http.Error(w, "Error fetching audit log", http.StatusInternalServerError)
+		return
+	}
+
+	RenderTemplate(w, r, "admin/audit_log", entries)
+}
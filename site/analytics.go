@@ -0,0 +1,237 @@
+package site
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"kitty/database"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	analyticsDayLayout = "2006-01-02"
+	analyticsTopLimit  = 10
+	// size of the SVG chart's coordinate system, it's scaled to the page
+	analyticsChartWidth  = 700
+	analyticsChartHeight = 200
+)
+
+// analyticsPeriods are the numbers of days the analytics page can show.
+var analyticsPeriods = []int{7, 30, 90}
+
+// botUserAgentMarkers are found in the user agents of crawlers, which aren't
+// readers.
+var botUserAgentMarkers = []string{"bot", "crawler", "spider", "slurp", "curl", "wget", "python", "http"}
+
+func isBotUserAgent(userAgent string) bool {
+	if userAgent == "" {
+		return true
+	}
+	userAgent = strings.ToLower(userAgent)
+	for _, marker := range botUserAgentMarkers {
+		if strings.Contains(userAgent, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// doesNotWantTracking reports whether the reader asked not to be tracked, with
+// either Do Not Track or Global Privacy Control.
+func doesNotWantTracking(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+// referrerDomain returns the domain of the page linking to the requested one,
+// or an empty string for direct visits and links within the same site.
+func referrerDomain(r *http.Request) string {
+	referrer, err := url.Parse(r.Referer())
+	if err != nil || referrer.Hostname() == "" {
+		return ""
+	}
+	domain := strings.ToLower(referrer.Hostname())
+	if domain == requestHost(r) {
+		return ""
+	}
+	return domain
+}
+
+// visitorHash identifies a visitor of the owner's pages for a day, without
+// storing anything that could identify them once the day's salt is gone.
+func visitorHash(salt []byte, r *http.Request, ownerID uint) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	hash := sha256.New()
+	hash.Write(salt)
+	hash.Write([]byte(ip + "\n" + r.UserAgent() + "\n" + strconv.Itoa(int(ownerID))))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recordPageView counts a view of a public page of owner, postID being 0 for
+// their homepage. Nothing is stored for crawlers, readers asking not to be
+// tracked, the owner themselves, or when analytics are disabled.
+func recordPageView(r *http.Request, owner *database.AdminUser, postID uint) {
+	if r.Method != "GET" || doesNotWantTracking(r) || isBotUserAgent(r.UserAgent()) {
+		return
+	}
+	if user := getSignedInUserOrNil(r); user != nil && user.ID == owner.ID {
+		return
+	}
+
+	settings, err := database.GetInstanceSettings()
+	if err != nil {
+		log.Printf("Failed to load instance settings: %v", err)
+		return
+	}
+	if settings.AnalyticsDisabled {
+		return
+	}
+
+	day := time.Now().UTC().Format(analyticsDayLayout)
+	salt, err := database.GetAnalyticsSalt(day)
+	if err != nil {
+		log.Printf("Failed to load the analytics salt: %v", err)
+		return
+	}
+
+	view := database.PageView{
+		AdminUserID:    owner.ID,
+		PostID:         postID,
+		Day:            day,
+		VisitorHash:    visitorHash(salt, r, owner.ID),
+		ReferrerDomain: referrerDomain(r),
+	}
+	// readers shouldn't wait for their view to be counted
+	go func() {
+		if err := database.RecordPageView(view); err != nil {
+			log.Printf("Failed to record a page view: %v", err)
+		}
+	}()
+}
+
+type analyticsChartBar struct {
+	Day      time.Time
+	Views    int64
+	Visitors int64
+	// coordinates in the chart's viewBox, whose origin is at the top
+	X              float64
+	Width          float64
+	ViewsY         float64
+	ViewsHeight    float64
+	VisitorsY      float64
+	VisitorsHeight float64
+}
+
+type analyticsData struct {
+	Disabled bool
+	Days     int
+	Periods  []int
+
+	Views     int64
+	Visitors  int64
+	MaxViews  int64
+	Bars      []analyticsChartBar
+	Pages     []database.PageViews
+	Referrers []database.ReferrerViews
+
+	ChartWidth  int
+	ChartHeight int
+}
+
+// analyticsChart spreads the daily views from since to today over the chart,
+// days without views included.
+func analyticsChart(daily []database.DailyViews, since time.Time, days int) ([]analyticsChartBar, int64) {
+	byDay := make(map[string]database.DailyViews, len(daily))
+	var maxViews int64
+	for _, d := range daily {
+		byDay[d.Day] = d
+		maxViews = max(maxViews, d.Views)
+	}
+
+	barWidth := float64(analyticsChartWidth) / float64(days)
+	bars := make([]analyticsChartBar, 0, days)
+	for i := 0; i < days; i++ {
+		day := since.AddDate(0, 0, i)
+		d := byDay[day.Format(analyticsDayLayout)]
+		bar := analyticsChartBar{
+			Day:      day,
+			Views:    d.Views,
+			Visitors: d.Visitors,
+			X:        float64(i) * barWidth,
+			Width:    barWidth * 0.8,
+		}
+		if maxViews > 0 {
+			bar.ViewsHeight = float64(d.Views) / float64(maxViews) * analyticsChartHeight
+			bar.VisitorsHeight = float64(d.Visitors) / float64(maxViews) * analyticsChartHeight
+		}
+		bar.ViewsY = analyticsChartHeight - bar.ViewsHeight
+		bar.VisitorsY = analyticsChartHeight - bar.VisitorsHeight
+		bars = append(bars, bar)
+	}
+	return bars, maxViews
+}
+
+func DashboardAnalytics(w http.ResponseWriter, r *http.Request) {
+	user := getSignedInUserOrFail(r)
+
+	days := 30
+	if value, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil {
+		for _, period := range analyticsPeriods {
+			if value == period {
+				days = value
+			}
+		}
+	}
+
+	settings, err := database.GetInstanceSettings()
+	if err != nil {
+		http.Error(w, "Error loading instance settings", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	sinceDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -(days - 1))
+	since := sinceDay.Format(analyticsDayLayout)
+
+	daily, err := database.GetDailyViews(user.ID, since)
+	if err != nil {
+		http.Error(w, "Error fetching analytics", http.StatusInternalServerError)
+		return
+	}
+	pages, err := database.GetTopPages(user.ID, since, analyticsTopLimit)
+	if err != nil {
+		http.Error(w, "Error fetching analytics", http.StatusInternalServerError)
+		return
+	}
+	referrers, err := database.GetTopReferrers(user.ID, since, analyticsTopLimit)
+	if err != nil {
+		http.Error(w, "Error fetching analytics", http.StatusInternalServerError)
+		return
+	}
+
+	data := analyticsData{
+		Disabled:    settings.AnalyticsDisabled,
+		Days:        days,
+		Periods:     analyticsPeriods,
+		Pages:       pages,
+		Referrers:   referrers,
+		ChartWidth:  analyticsChartWidth,
+		ChartHeight: analyticsChartHeight,
+	}
+	for _, d := range daily {
+		data.Views += d.Views
+		// readers coming back on another day can't be told apart
+		data.Visitors += d.Visitors
+	}
+	data.Bars, data.MaxViews = analyticsChart(daily, sinceDay, days)
+
+	RenderTemplate(w, r, "dashboard/analytics", data)
+}
@@ -0,0 +1,196 @@
+package site
+
+import (
+	"encoding/json"
+	"errors"
+	"kitty/constants"
+	"kitty/database"
+	"kitty/render"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// Optional fields API clients can ask for with "?include=", as a comma
+// separated list. Rendering isn't free, so nothing is included by default.
+const (
+	apiIncludeBodyHTML    = "body_html"
+	apiIncludeExcerpt     = "excerpt"
+	apiIncludeWordCount   = "word_count"
+	apiIncludeReadingTime = "reading_time"
+	apiIncludeHeadings    = "headings"
+)
+
+var apiIncludableFields = map[string]bool{
+	apiIncludeBodyHTML:    true,
+	apiIncludeExcerpt:     true,
+	apiIncludeWordCount:   true,
+	apiIncludeReadingTime: true,
+	apiIncludeHeadings:    true,
+}
+
+type apiPost struct {
+	database.Post
+	// tag names rather than the tag rows, shadowing database.Post.Tags
+	Tags               []string         `json:"Tags"`
+	BodyHTML           *string          `json:"body_html,omitempty"`
+	Excerpt            *string          `json:"excerpt,omitempty"`
+	WordCount          *int             `json:"word_count,omitempty"`
+	ReadingTimeMinutes *int             `json:"reading_time_minutes,omitempty"`
+	Headings           []render.Heading `json:"headings,omitempty"`
+}
+
+// parseAPIIncludes reads the "include" query parameter. "all" includes every
+// optional field.
+func parseAPIIncludes(r *http.Request) (map[string]bool, bool) {
+	includes := map[string]bool{}
+	for _, field := range strings.Split(r.URL.Query().Get("include"), ",") {
+		field = strings.TrimSpace(field)
+		switch {
+		case field == "":
+		case field == "all":
+			for name := range apiIncludableFields {
+				includes[name] = true
+			}
+		case apiIncludableFields[field]:
+			includes[field] = true
+		default:
+			return nil, false
+		}
+	}
+	return includes, true
+}
+
+func newAPIPost(post database.Post, author *database.AdminUser, includes map[string]bool) apiPost {
+	result := apiPost{Post: post, Tags: tagNames(post.Tags)}
+	if len(includes) == 0 {
+		return result
+	}
+
+	opts := effectiveRenderOptions(&post, author)
+
+	if includes[apiIncludeBodyHTML] {
+		bodyHTML := string(renderMarkdown(post.Body, opts))
+		result.BodyHTML = &bodyHTML
+	}
+
+	if !includes[apiIncludeExcerpt] && !includes[apiIncludeWordCount] &&
+		!includes[apiIncludeReadingTime] && !includes[apiIncludeHeadings] {
+		return result
+	}
+
+	summary := render.Summarize(post.Body, opts)
+	if includes[apiIncludeExcerpt] {
+		excerpt := post.MetaDescription
+		if excerpt == "" {
+			excerpt = summary.Excerpt
+		}
+		result.Excerpt = &excerpt
+	}
+	if includes[apiIncludeWordCount] {
+		result.WordCount = &summary.WordCount
+	}
+	if includes[apiIncludeReadingTime] {
+		result.ReadingTimeMinutes = &summary.ReadingTimeMinutes
+	}
+	if includes[apiIncludeHeadings] {
+		// an empty list rather than a missing field when the post has no headings
+		result.Headings = summary.Headings
+		if result.Headings == nil {
+			result.Headings = []render.Heading{}
+		}
+	}
+
+	return result
+}
+
+func APIGetUserPosts(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userID")
+
+	userIDUint, err := strconv.ParseUint(userID, 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	includes, ok := parseAPIIncludes(r)
+	if !ok {
+		http.Error(w, "Unknown field in include, valid values are all, body_html, excerpt, word_count, reading_time and headings", http.StatusBadRequest)
+		return
+	}
+
+	var author database.AdminUser
+	result := database.GetDB().First(&author, userIDUint)
+	if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// ?tag= takes a tag slug. An unknown tag has no posts rather than being
+	// an error, tags come and go as posts are edited.
+	var tag *database.Tag
+	tagSlug := r.URL.Query().Get("tag")
+	if tagSlug != "" {
+		tag, err = database.GetTagBySlug(uint(userIDUint), tagSlug)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	postsLastModified, err := database.PostsLastModified(uint(userIDUint))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	upvotes, err := database.TotalUpvotes(uint(userIDUint))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	validators := newCacheValidators(r)
+	validators.add("author", author.ID, author.UpdatedAt)
+	validators.add("posts", userIDUint, postsLastModified)
+	validators.addValue("upvotes", strconv.FormatInt(upvotes, 10))
+	validators.addValue("include", r.URL.Query().Get("include"))
+	validators.addValue("tag", tagSlug)
+	if writeCacheHeaders(w, r, validators) {
+		return
+	}
+
+	posts := []database.Post{}
+	if tagSlug == "" || tag != nil {
+		query := database.GetDB().
+			Preload("Tags").
+			Preload("Series").
+			Joins("JOIN admin_users ON admin_users.id = posts.admin_user_id AND admin_users.suspended_at IS NULL").
+			Where(&database.Post{AdminUserID: uint(userIDUint)}).
+			Scopes(database.ListedPosts).
+			Limit(constants.MAX_POSTS_TO_SHOW)
+		if tag != nil {
+			query = query.Scopes(database.PostsWithTag(tag.ID))
+		}
+		// password protected posts are only listed to their author
+		if currentUser := getSignedInUserOrNil(r); currentUser == nil || currentUser.ID != uint(userIDUint) {
+			query = query.Where("posts.password_hash = ''")
+		}
+		result = query.Find(&posts)
+		if result.Error != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response := make([]apiPost, 0, len(posts))
+	for _, post := range posts {
+		response = append(response, newAPIPost(post, &author, includes))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,184 @@
+package site
+
+import (
+	"encoding/json"
+	"kitty/database"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxAPITokenNameLength = 100
+
+// apiScope is something an API token can be allowed to do.
+type apiScope struct {
+	Name        string
+	Description string
+}
+
+// apiScopes are the scopes of the Micropub specification that Kitty supports.
+var apiScopes = []apiScope{
+	{"create", "Publish new posts"},
+	{"draft", "Create drafts, but not publish them"},
+	{"update", "Edit your posts"},
+	{"delete", "Delete your posts"},
+	{"media", "Upload images"},
+}
+
+func isKnownAPIScope(name string) bool {
+	for _, scope := range apiScopes {
+		if scope.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// apiTokenFromRequest returns the token sent in the Authorization header, or
+// in the access_token parameter as Micropub allows. Looking for the parameter
+// parses the form, so the body must have been limited with MaxBytesReader.
+func apiTokenFromRequest(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if r.Method != "POST" {
+		return ""
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "application/json"):
+		return ""
+	case strings.HasPrefix(contentType, "multipart/form-data"):
+		if err := r.ParseMultipartForm(maxMicropubRequestSize); err != nil {
+			return ""
+		}
+	default:
+		if err := r.ParseForm(); err != nil {
+			return ""
+		}
+	}
+	return r.PostForm.Get("access_token")
+}
+
+// authenticateAPIRequest returns the token the request was made with and its
+// user, or nils when there's no valid token.
+func authenticateAPIRequest(r *http.Request) (*database.APIToken, *database.AdminUser, error) {
+	secret := apiTokenFromRequest(r)
+	if secret == "" {
+		return nil, nil, nil
+	}
+
+	token, user, err := database.GetAPIToken(secret)
+	if err != nil || token == nil || user.IsSuspended() {
+		return nil, nil, err
+	}
+	return token, user, nil
+}
+
+// apiError writes an OAuth 2.0 style error, the format both Micropub and
+// IndieAuth use.
+func apiError(w http.ResponseWriter, status int, code string, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+func writeAPIJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+type apiTokensData struct {
+	Tokens []database.APIToken
+	Scopes []apiScope
+	// the value of a token that was just created, it can't be shown again
+	NewToken string
+}
+
+func renderAPITokens(w http.ResponseWriter, r *http.Request, newToken string) {
+	tokens, err := database.GetUserAPITokens(getSignedInUserOrFail(r).ID)
+	if err != nil {
+		http.Error(w, "Error fetching tokens", http.StatusInternalServerError)
+		return
+	}
+
+	RenderTemplate(w, r, "dashboard/api_tokens", apiTokensData{
+		Tokens:   tokens,
+		Scopes:   apiScopes,
+		NewToken: newToken,
+	})
+}
+
+// DashboardAPITokens lists the user's API tokens and creates new ones.
+func DashboardAPITokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		renderAPITokens(w, r, "")
+
+	case "POST":
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" || len(name) > maxAPITokenNameLength {
+			http.Error(w, "The name must be between 1 and "+strconv.Itoa(maxAPITokenNameLength)+" characters", http.StatusBadRequest)
+			return
+		}
+
+		r.ParseForm()
+		var scopes []string
+		for _, scope := range r.PostForm["scope"] {
+			if !isKnownAPIScope(scope) {
+				http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+				return
+			}
+			scopes = append(scopes, scope)
+		}
+		if len(scopes) == 0 {
+			http.Error(w, "Pick at least one scope", http.StatusBadRequest)
+			return
+		}
+
+		secret, err := generateAuthToken()
+		if err != nil {
+			http.Error(w, "Error creating token", http.StatusInternalServerError)
+			return
+		}
+		token := database.APIToken{
+			AdminUserID: getSignedInUserOrFail(r).ID,
+			Name:        name,
+			Scope:       strings.Join(scopes, " "),
+		}
+		if err := database.CreateAPIToken(&token, secret); err != nil {
+			http.Error(w, "Error creating token", http.StatusInternalServerError)
+			return
+		}
+
+		// shown right away rather than after a redirect, it isn't stored
+		w.Header().Set("Cache-Control", "no-store")
+		renderAPITokens(w, r, secret)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func DashboardRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(chi.URLParam(r, "tokenID"))
+	if err != nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	err = database.RevokeAPIToken(getSignedInUserOrFail(r).ID, uint(tokenID))
+	if err != nil {
+		http.Error(w, "Error revoking token", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/dashboard/tokens", http.StatusSeeOther)
+}
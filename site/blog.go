@@ -0,0 +1,591 @@
+package site
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"kitty/blog"
+	"kitty/constants"
+	"kitty/database"
+	"kitty/domains"
+	"kitty/render"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// blogContentSecurityPolicy applies to every blog page. Rendered posts never
+// need scripts, and custom templates must not be able to run any on our
+// origin either.
+const blogContentSecurityPolicy = "script-src 'none'; object-src 'none'; base-uri 'none'; form-action 'self'"
+
+var (
+	defaultBlogTemplate     *template.Template
+	defaultBlogTemplateLock sync.Mutex
+	// blog ID -> customBlogTemplate
+	customBlogTemplates sync.Map
+)
+
+type customBlogTemplate struct {
+	updatedAt time.Time
+	tmpl      *template.Template
+}
+
+func getDefaultBlogTemplate() (*template.Template, error) {
+	defaultBlogTemplateLock.Lock()
+	defer defaultBlogTemplateLock.Unlock()
+
+	if defaultBlogTemplate != nil && !constants.DEBUG_MODE {
+		return defaultBlogTemplate, nil
+	}
+
+	text, err := os.ReadFile(filepath.Join("templates", "blog", "layout.html"))
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := blog.ParseTemplate(string(text))
+	if err != nil {
+		return nil, err
+	}
+
+	defaultBlogTemplate = tmpl
+	return tmpl, nil
+}
+
+// getBlogTemplate returns the user's custom template if they have one, the
+// bundled one otherwise.
+func getBlogTemplate(b *database.Blog) (*template.Template, error) {
+	if b.CustomTemplate == "" {
+		return getDefaultBlogTemplate()
+	}
+
+	if cached, ok := customBlogTemplates.Load(b.ID); ok && cached.(customBlogTemplate).updatedAt.Equal(b.UpdatedAt) {
+		return cached.(customBlogTemplate).tmpl, nil
+	}
+
+	tmpl, err := blog.ParseTemplate(b.CustomTemplate)
+	if err != nil {
+		return nil, err
+	}
+	customBlogTemplates.Store(b.ID, customBlogTemplate{updatedAt: b.UpdatedAt, tmpl: tmpl})
+	return tmpl, nil
+}
+
+// getBlog returns the blog settings of the user, with defaults filled in
+// for users that never saved them.
+func getBlog(user *database.AdminUser) (*database.Blog, error) {
+	var b database.Blog
+	result := database.GetDB().Where(&database.Blog{AdminUserID: user.ID}).First(&b)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return &database.Blog{
+			AdminUserID:  user.ID,
+			Title:        user.Username + "'s blog",
+			Theme:        blog.DefaultTheme,
+			PostsPerPage: blog.DefaultPostsPerPage,
+		}, nil
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	return &b, nil
+}
+
+// loadPublicBlog finds the enabled blog of the user with the given username,
+// returning nil if there's no such blog to show.
+func loadPublicBlog(username string) (*database.AdminUser, *database.Blog, error) {
+	var user database.AdminUser
+	result := database.GetDB().Where("LOWER(username) = LOWER(?)", username).First(&user)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil, nil
+	} else if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	if user.IsSuspended() {
+		return nil, nil, nil
+	}
+
+	b, err := getBlog(&user)
+	if err != nil || !b.Enabled {
+		return nil, nil, err
+	}
+	return &user, b, nil
+}
+
+// publicPostsQuery selects the posts of the user that are listed publicly.
+func publicPostsQuery(userID uint) *gorm.DB {
+	return database.GetDB().Model(&database.Post{}).
+		Where("admin_user_id = ?", userID).
+		Scopes(database.ListedPosts)
+}
+
+// readablePostsQuery selects the posts of the user that anyone can read given
+// their URL, including unlisted ones.
+func readablePostsQuery(userID uint) *gorm.DB {
+	return database.GetDB().Model(&database.Post{}).
+		Where("admin_user_id = ?", userID).
+		Scopes(database.ReadablePosts)
+}
+
+// blogRequest is a request to a blog, either under /b/{username} or on the
+// blog's own domain. basePath is the path of the blog's homepage without the
+// trailing slash, so it's empty on custom domains.
+//
+// canonicalBase is the absolute version of basePath where the blog should be
+// reached, which is the custom domain once it's verified.
+type blogRequest struct {
+	user          *database.AdminUser
+	blog          *database.Blog
+	basePath      string
+	canonicalBase string
+}
+
+func (br *blogRequest) homeURL() string {
+	return br.basePath + "/"
+}
+
+func (br *blogRequest) postURL(post *database.Post) string {
+	return br.basePath + "/" + url.PathEscape(post.Slug)
+}
+
+func (br *blogRequest) site() (blog.Site, error) {
+	var pages []database.Post
+	result := publicPostsQuery(br.user.ID).
+		Select("id, title, slug, published_date").
+		Where("is_page = ?", true).
+		Order("published_date ASC").
+		Find(&pages)
+	if result.Error != nil {
+		return blog.Site{}, result.Error
+	}
+
+	nav := make([]blog.NavLink, 0, len(pages))
+	for i := range pages {
+		nav = append(nav, blog.NavLink{Title: pages[i].Title, URL: br.postURL(&pages[i])})
+	}
+
+	title := br.blog.Title
+	if title == "" {
+		title = br.user.Username
+	}
+
+	return blog.Site{
+		Title:       title,
+		Description: br.blog.Description,
+		Author:      br.user.Username,
+		URL:         br.homeURL(),
+		Lang:        "en",
+		Nav:         nav,
+		Stylesheet:  blog.FindTheme(br.blog.Theme).Stylesheet,
+		CustomCSS:   blog.SanitizeCSS(br.blog.CustomCSS),
+	}, nil
+}
+
+func (br *blogRequest) summary(post *database.Post) blog.PostSummary {
+	opts := effectiveRenderOptions(post, br.user)
+	summary := render.Summarize(post.Body, opts)
+
+	// the content of protected posts is only described by their author
+	excerpt := post.MetaDescription
+	if excerpt == "" && !post.IsPasswordProtected() {
+		excerpt = summary.Excerpt
+	}
+
+	return blog.PostSummary{
+		Title:              post.Title,
+		URL:                br.postURL(post),
+		Excerpt:            excerpt,
+		PublishedDate:      post.PublishedDate,
+		Tags:               tagNames(post.Tags),
+		ReadingTimeMinutes: max(summary.ReadingTimeMinutes, 1),
+	}
+}
+
+// checkNotModified writes the caching headers of a blog page, returning true
+// if the client's copy is still fresh.
+func (br *blogRequest) checkNotModified(w http.ResponseWriter, r *http.Request) (bool, error) {
+	postsLastModified, err := database.PostsLastModified(br.user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	validators := newCacheValidators(r)
+	validators.add("user", br.user.ID, br.user.UpdatedAt)
+	validators.add("blog", br.blog.ID, br.blog.UpdatedAt)
+	validators.add("posts", br.user.ID, postsLastModified)
+	validators.addValue("page", r.URL.Query().Get("page"))
+	return writeCacheHeaders(w, r, validators), nil
+}
+
+// execute runs a template of the blog, answering with status once it ran
+// fine.
+func (br *blogRequest) execute(w http.ResponseWriter, r *http.Request, name string, status int, data any) {
+	tmpl, err := getBlogTemplate(br.blog)
+	if err != nil {
+		log.Printf("Failed to parse the template of blog %d: %v", br.blog.ID, err)
+		http.Error(w, "This blog's template is broken", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	err = blog.Execute(r.Context(), &buf, tmpl, name, data)
+	if err != nil {
+		log.Printf("Failed to execute the template of blog %d: %v", br.blog.ID, err)
+		http.Error(w, "This blog's template is broken", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", blogContentSecurityPolicy)
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+func (br *blogRequest) serveIndex(w http.ResponseWriter, r *http.Request) {
+	page := 1
+	if value := r.URL.Query().Get("page"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Page not found", http.StatusNotFound)
+			return
+		}
+		page = parsed
+	}
+
+	recordPageView(r, br.user, 0)
+	advertiseMicropubEndpoint(w)
+	advertiseIndieAuth(w)
+
+	notModified, err := br.checkNotModified(w, r)
+	if err != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	} else if notModified {
+		return
+	}
+
+	perPage := br.blog.PostsPerPage
+	if perPage < 1 || perPage > blog.MaxPostsPerPage {
+		perPage = blog.DefaultPostsPerPage
+	}
+
+	var total int64
+	result := publicPostsQuery(br.user.ID).Where("is_page = ?", false).Count(&total)
+	if result.Error != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	totalPages := max(int(math.Ceil(float64(total)/float64(perPage))), 1)
+	if page > totalPages {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return
+	}
+
+	var posts []database.Post
+	result = publicPostsQuery(br.user.ID).
+		Preload("Tags").
+		Where("is_page = ?", false).
+		Order("published_date DESC").
+		Limit(perPage).
+		Offset((page - 1) * perPage).
+		Find(&posts)
+	if result.Error != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	site, err := br.site()
+	if err != nil {
+		http.Error(w, "Error fetching pages", http.StatusInternalServerError)
+		return
+	}
+
+	data := blog.IndexData{
+		Site:         site,
+		CanonicalURL: br.canonicalBase + strings.TrimPrefix(br.pageURL(page), br.basePath),
+		Posts:        make([]blog.PostSummary, 0, len(posts)),
+		Pagination:   blog.Pagination{Page: page, TotalPages: totalPages},
+	}
+	for i := range posts {
+		data.Posts = append(data.Posts, br.summary(&posts[i]))
+	}
+	if page > 1 {
+		data.Pagination.PrevURL = br.pageURL(page - 1)
+	}
+	if page < totalPages {
+		data.Pagination.NextURL = br.pageURL(page + 1)
+	}
+
+	br.execute(w, r, "index", http.StatusOK, data)
+}
+
+func (br *blogRequest) pageURL(page int) string {
+	if page == 1 {
+		return br.homeURL()
+	}
+	return fmt.Sprintf("%s?page=%d", br.homeURL(), page)
+}
+
+func (br *blogRequest) servePost(w http.ResponseWriter, r *http.Request, slug string) {
+	var post database.Post
+	result := readablePostsQuery(br.user.ID).Preload("Tags").Where("slug = ?", slug).First(&post)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	} else if result.Error != nil {
+		http.Error(w, "Error fetching post", http.StatusInternalServerError)
+		return
+	}
+
+	body := template.HTML("")
+	status := http.StatusOK
+	if canReadProtectedPost(r, &post) {
+		if r.Method == "POST" {
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+		body = renderPostBody(&post, br.user)
+		recordPageView(r, br.user, post.ID)
+		if isMentionable(&post, br.user) {
+			advertiseWebmentionEndpoint(w)
+		}
+	} else if r.Method == "POST" {
+		err := unlockPost(w, r, &post)
+		if errors.Is(err, errWrongPostPassword) {
+			body = renderBlogPostPasswordForm("Wrong password.")
+			status = http.StatusForbidden
+		} else if err != nil {
+			http.Error(w, "Error checking the password", http.StatusInternalServerError)
+			return
+		} else {
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+	} else {
+		body = renderBlogPostPasswordForm("")
+	}
+
+	noIndex := post.NoIndex || post.Visibility != database.PostVisibilityPublic || post.IsPasswordProtected()
+	if noIndex {
+		w.Header().Set("X-Robots-Tag", "noindex")
+	}
+
+	if post.IsPasswordProtected() {
+		// the page depends on the reader's access cookie, which shared
+		// caches must never see
+		w.Header().Set("Cache-Control", "private, no-store")
+	} else {
+		notModified, err := br.checkNotModified(w, r)
+		if err != nil {
+			http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+			return
+		} else if notModified {
+			return
+		}
+	}
+
+	site, err := br.site()
+	if err != nil {
+		http.Error(w, "Error fetching pages", http.StatusInternalServerError)
+		return
+	}
+
+	lang := post.Lang
+	if lang == "" {
+		lang = site.Lang
+	}
+
+	br.execute(w, r, "post", status, blog.PostData{
+		Site:         site,
+		CanonicalURL: br.canonicalBase + "/" + url.PathEscape(post.Slug),
+		Post: blog.Post{
+			PostSummary: br.summary(&post),
+			Lang:        lang,
+			Body:        body,
+			NoIndex:     noIndex,
+		},
+	})
+}
+
+// mainSiteBlog loads the blog for a request to /b/{username}. If the blog
+// has a verified custom domain, the client is redirected there instead and
+// nil is returned.
+func mainSiteBlog(w http.ResponseWriter, r *http.Request) *blogRequest {
+	user, b, err := loadPublicBlog(chi.URLParam(r, "username"))
+	if err != nil {
+		http.Error(w, "Error fetching blog", http.StatusInternalServerError)
+		return nil
+	} else if b == nil {
+		http.Error(w, "Blog not found", http.StatusNotFound)
+		return nil
+	}
+
+	domain, err := verifiedDomainOf(user)
+	if err != nil {
+		http.Error(w, "Error fetching blog", http.StatusInternalServerError)
+		return nil
+	}
+
+	basePath := "/b/" + user.Username
+	if domain != "" {
+		target := customDomainURL(domain) + "/" + chi.URLParam(r, "slug")
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return nil
+	}
+
+	return &blogRequest{user: user, blog: b, basePath: basePath, canonicalBase: PublicURL() + basePath}
+}
+
+func BlogIndex(w http.ResponseWriter, r *http.Request) {
+	if br := mainSiteBlog(w, r); br != nil {
+		br.serveIndex(w, r)
+	}
+}
+
+func BlogPost(w http.ResponseWriter, r *http.Request) {
+	if br := mainSiteBlog(w, r); br != nil {
+		br.servePost(w, r, chi.URLParam(r, "slug"))
+	}
+}
+
+type blogSettingsFormData struct {
+	Blog   *database.Blog
+	Themes []blog.Theme
+	// absolute URL of the blog's homepage
+	URL    string
+	Saved  bool
+	Errors []string
+
+	Domain         *database.CustomDomain
+	DomainStatus   string
+	ChallengeName  string
+	ChallengeValue string
+	PrimaryHost    string
+}
+
+// renderBlogSettings shows the blog settings page. b can be nil to show the
+// saved settings.
+func renderBlogSettings(w http.ResponseWriter, r *http.Request, status int, b *database.Blog, formErrors ...string) {
+	user := getSignedInUserOrFail(r)
+
+	if b == nil {
+		var err error
+		b, err = getBlog(user)
+		if err != nil {
+			http.Error(w, "Error loading blog settings", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	customDomain, err := database.GetCustomDomain(user.ID)
+	if err != nil {
+		http.Error(w, "Error loading blog settings", http.StatusInternalServerError)
+		return
+	}
+
+	canonicalBase, err := blogCanonicalBase(user)
+	if err != nil {
+		http.Error(w, "Error loading blog settings", http.StatusInternalServerError)
+		return
+	}
+
+	formData := blogSettingsFormData{
+		Blog:         b,
+		Themes:       blog.Themes,
+		URL:          canonicalBase + "/",
+		Saved:        r.URL.Query().Get("saved") == "1",
+		Errors:       formErrors,
+		Domain:       customDomain,
+		DomainStatus: r.URL.Query().Get("domain"),
+		PrimaryHost:  PrimaryHost(),
+	}
+	if customDomain != nil {
+		formData.ChallengeName, formData.ChallengeValue = domains.ChallengeRecord(customDomain.Domain, customDomain.VerificationToken)
+	}
+
+	RenderTemplateStatus(w, r, "dashboard/blog", status, formData)
+}
+
+func DashboardBlogSettings(w http.ResponseWriter, r *http.Request) {
+	user := getSignedInUserOrFail(r)
+
+	b, err := getBlog(user)
+	if err != nil {
+		http.Error(w, "Error loading blog settings", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		renderBlogSettings(w, r, http.StatusOK, b)
+
+	case "POST":
+		b.Enabled = r.FormValue("enabled") == "on"
+		b.Title = strings.TrimSpace(r.FormValue("title"))
+		b.Description = strings.TrimSpace(r.FormValue("description"))
+		b.Theme = r.FormValue("theme")
+		b.CustomCSS = r.FormValue("custom_css")
+		b.CustomTemplate = r.FormValue("custom_template")
+
+		// an uploaded file takes precedence over the text area
+		if file, _, err := r.FormFile("custom_template_file"); err == nil {
+			text, err := io.ReadAll(io.LimitReader(file, blog.MaxTemplateLength+1))
+			file.Close()
+			if err != nil {
+				http.Error(w, "Error reading the uploaded template", http.StatusBadRequest)
+				return
+			}
+			b.CustomTemplate = string(text)
+		}
+		b.CustomTemplate = strings.TrimSpace(b.CustomTemplate)
+
+		var formErrors []string
+		perPage, err := strconv.Atoi(r.FormValue("posts_per_page"))
+		if err != nil || perPage < 1 || perPage > blog.MaxPostsPerPage {
+			formErrors = append(formErrors, fmt.Sprintf("Posts per page must be between 1 and %d.", blog.MaxPostsPerPage))
+		} else {
+			b.PostsPerPage = perPage
+		}
+		if !blog.IsValidTheme(b.Theme) {
+			formErrors = append(formErrors, "Please pick one of the themes.")
+		}
+		if len(b.CustomCSS) > blog.MaxCustomCSSLength {
+			formErrors = append(formErrors, fmt.Sprintf("Custom CSS can't be longer than %d KiB.", blog.MaxCustomCSSLength/1024))
+		}
+		if b.CustomTemplate != "" {
+			if err := blog.CheckTemplate(b.CustomTemplate); err != nil {
+				formErrors = append(formErrors, "Custom template: "+asSentence(err.Error()))
+			}
+		}
+
+		if len(formErrors) > 0 {
+			renderBlogSettings(w, r, http.StatusBadRequest, b, formErrors...)
+			return
+		}
+
+		result := database.GetDB().Save(b)
+		if result.Error != nil {
+			http.Error(w, "Error saving blog settings", http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/dashboard/blog?saved=1", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
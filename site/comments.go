@@ -0,0 +1,349 @@
+package site
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"kitty/database"
+	"kitty/mail"
+	"kitty/render"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxCommentAuthorNameLength = 80
+	maxCommentAuthorURLLength  = 500
+	maxCommentBodyLength       = 5000
+	// hidden from readers, only bots fill it in
+	commentHoneypotField = "website"
+	// comments of each status shown in the moderation queue
+	commentsPerStatus = 100
+)
+
+type commentView struct {
+	ID         uint      `json:"id"`
+	AuthorName string    `json:"author_name"`
+	AuthorURL  string    `json:"author_url,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	// the body rendered with the comments Markdown subset and sanitized
+	BodyHTML template.HTML `json:"body_html"`
+}
+
+func newCommentView(comment *database.Comment) commentView {
+	return commentView{
+		ID:         comment.ID,
+		AuthorName: comment.AuthorName,
+		AuthorURL:  comment.AuthorURL,
+		CreatedAt:  comment.CreatedAt,
+		BodyHTML:   template.HTML(render.CommentToHTML(comment.Body)),
+	}
+}
+
+func approvedCommentViews(post *database.Post) ([]commentView, error) {
+	comments, err := database.GetApprovedComments(post.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	views := make([]commentView, 0, len(comments))
+	for i := range comments {
+		views = append(views, newCommentView(&comments[i]))
+	}
+	return views, nil
+}
+
+// getCommentablePost loads the post in the URL if the request may read it
+// and it accepts comments, otherwise it writes an error and returns nil.
+func getCommentablePost(w http.ResponseWriter, r *http.Request) (*database.Post, *database.AdminUser) {
+	var post database.Post
+	result := database.GetDB().First(&post, chi.URLParam(r, "postID"))
+	if result.Error != nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return nil, nil
+	}
+
+	var author database.AdminUser
+	result = database.GetDB().First(&author, post.AdminUserID)
+	if result.Error != nil || author.IsSuspended() || post.HiddenByAdmin ||
+		!post.IsReadableByURL() || !canReadProtectedPost(r, &post) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return nil, nil
+	}
+
+	if !post.CommentsEnabled {
+		http.Error(w, "Comments are closed on this post", http.StatusForbidden)
+		return nil, nil
+	}
+	return &post, &author
+}
+
+// commentFromForm reads and validates the comment form.
+func commentFromForm(r *http.Request) (database.Comment, error) {
+	comment := database.Comment{
+		AuthorName: strings.TrimSpace(r.FormValue("author_name")),
+		AuthorURL:  strings.TrimSpace(r.FormValue("author_url")),
+		Body:       strings.TrimSpace(r.FormValue("body")),
+	}
+
+	if comment.AuthorName == "" {
+		return comment, fmt.Errorf("your name is required")
+	}
+	if utf8.RuneCountInString(comment.AuthorName) > maxCommentAuthorNameLength {
+		return comment, fmt.Errorf("your name can't be longer than %d characters", maxCommentAuthorNameLength)
+	}
+	if comment.Body == "" {
+		return comment, fmt.Errorf("the comment is empty")
+	}
+	if utf8.RuneCountInString(comment.Body) > maxCommentBodyLength {
+		return comment, fmt.Errorf("the comment can't be longer than %d characters", maxCommentBodyLength)
+	}
+
+	if comment.AuthorURL != "" {
+		parsed, err := url.Parse(comment.AuthorURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+			len(comment.AuthorURL) > maxCommentAuthorURLLength {
+			return comment, fmt.Errorf("your website must be an http(s) URL")
+		}
+	}
+
+	return comment, nil
+}
+
+// notifyNewComment tells the post's author that a comment awaits
+// moderation, if they have a verified email address.
+func notifyNewComment(author *database.AdminUser, post *database.Post, comment *database.Comment) {
+	if author.Email == "" || author.EmailVerifiedAt == nil {
+		return
+	}
+
+	sendEmailInBackground(mail.Message{
+		To:      author.Email,
+		Subject: fmt.Sprintf("New comment on \"%s\"", post.Title),
+		Body: fmt.Sprintf("Hi %s,\n\n%s commented on your post \"%s\":\n\n%s\n\n"+
+			"The comment is only shown once you approve it, in the moderation queue at:\n\n%s\n\n"+
+			"You can disable comments on the post from the editor.\n",
+			author.Username, comment.AuthorName, post.Title, comment.Body, PublicURL()+"/dashboard/comments"),
+	})
+}
+
+// SubmitComment adds a reader's comment to the post's moderation queue.
+// Comments by the post's author are approved right away.
+func SubmitComment(w http.ResponseWriter, r *http.Request) {
+	post, author := getCommentablePost(w, r)
+	if post == nil {
+		return
+	}
+	postURL := "/post/" + strconv.Itoa(int(post.ID))
+
+	// bots get the same answer as readers, so that they don't learn about
+	// the honeypot
+	if r.FormValue(commentHoneypotField) != "" {
+		http.Redirect(w, r, postURL+"?comment=pending#comments", http.StatusSeeOther)
+		return
+	}
+
+	comment, err := commentFromForm(r)
+	if err != nil {
+		http.Error(w, "Error submitting the comment: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	comment.PostID = post.ID
+	comment.AdminUserID = author.ID
+	comment.Status = database.CommentStatusPending
+	if user := getSignedInUserOrNil(r); user != nil && user.ID == author.ID {
+		comment.Status = database.CommentStatusApproved
+	}
+
+	result := database.GetDB().Create(&comment)
+	if result.Error != nil {
+		http.Error(w, "Error submitting the comment", http.StatusInternalServerError)
+		return
+	}
+
+	if comment.Status == database.CommentStatusApproved {
+		http.Redirect(w, r, postURL+"#comment-"+strconv.Itoa(int(comment.ID)), http.StatusSeeOther)
+		return
+	}
+	notifyNewComment(author, post, &comment)
+	http.Redirect(w, r, postURL+"?comment=pending#comments", http.StatusSeeOther)
+}
+
+type commentsQueueData struct {
+	Status   database.CommentStatus
+	Statuses []database.CommentStatus
+	Counts   map[database.CommentStatus]int64
+	Comments []database.Comment
+	// rendered bodies, by comment ID
+	BodiesHTML map[uint]template.HTML
+}
+
+var commentStatuses = []database.CommentStatus{
+	database.CommentStatusPending,
+	database.CommentStatusApproved,
+	database.CommentStatusRejected,
+	database.CommentStatusSpam,
+}
+
+// DashboardComments is the moderation queue of the comments on the user's
+// posts, ?status= picks which comments are shown.
+func DashboardComments(w http.ResponseWriter, r *http.Request) {
+	user := getSignedInUserOrFail(r)
+
+	status := database.CommentStatus(r.URL.Query().Get("status"))
+	if status == "" {
+		status = database.CommentStatusPending
+	} else if !database.IsValidCommentStatus(status) {
+		http.Error(w, "Unknown comment status", http.StatusBadRequest)
+		return
+	}
+
+	comments, err := database.GetUserComments(user.ID, status, commentsPerStatus)
+	if err != nil {
+		http.Error(w, "Error fetching comments", http.StatusInternalServerError)
+		return
+	}
+	counts, err := database.CountCommentsByStatus(user.ID)
+	if err != nil {
+		http.Error(w, "Error fetching comments", http.StatusInternalServerError)
+		return
+	}
+
+	bodies := make(map[uint]template.HTML, len(comments))
+	for _, comment := range comments {
+		bodies[comment.ID] = template.HTML(render.CommentToHTML(comment.Body))
+	}
+
+	RenderTemplate(w, r, "dashboard/comments", commentsQueueData{
+		Status:     status,
+		Statuses:   commentStatuses,
+		Counts:     counts,
+		Comments:   comments,
+		BodiesHTML: bodies,
+	})
+}
+
+// DashboardModerateComment approves, rejects or marks as spam a comment on
+// one of the user's posts.
+func DashboardModerateComment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getSignedInUserOrFail(r)
+	commentID, err := strconv.Atoi(chi.URLParam(r, "commentID"))
+	if err != nil {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	comment, err := database.GetComment(user.ID, uint(commentID))
+	if err != nil {
+		http.Error(w, "Error fetching comment", http.StatusInternalServerError)
+		return
+	} else if comment == nil {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+
+	status := database.CommentStatus(r.FormValue("status"))
+	if !database.IsValidCommentStatus(status) {
+		http.Error(w, "Unknown comment status", http.StatusBadRequest)
+		return
+	}
+
+	err = database.SetCommentStatus(comment, status)
+	if err != nil {
+		http.Error(w, "Error moderating comment", http.StatusInternalServerError)
+		return
+	}
+
+	// back to the list the comment was moderated from
+	from := database.CommentStatus(r.FormValue("from"))
+	if !database.IsValidCommentStatus(from) {
+		from = database.CommentStatusPending
+	}
+	http.Redirect(w, r, "/dashboard/comments?status="+string(from), http.StatusSeeOther)
+}
+
+// DashboardPostComments opens or closes comments on one of the user's posts.
+// Comments already approved stay visible once closed.
+func DashboardPostComments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	post := getOwnPost(w, r)
+	if post == nil {
+		return
+	}
+
+	result := database.GetDB().Model(post).Update("comments_enabled", r.FormValue("enabled") == "on")
+	if result.Error != nil {
+		http.Error(w, "Error updating post", http.StatusInternalServerError)
+		return
+	}
+
+	redirect := r.FormValue("redirect")
+	if !strings.HasPrefix(redirect, "/dashboard/") {
+		redirect = "/dashboard/comments"
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// APIGetPostComments returns the approved comments of a post, for sites
+// embedding them.
+func APIGetPostComments(w http.ResponseWriter, r *http.Request) {
+	var post database.Post
+	result := database.GetDB().First(&post, chi.URLParam(r, "postID"))
+	if result.Error != nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	var author database.AdminUser
+	result = database.GetDB().First(&author, post.AdminUserID)
+	if result.Error != nil || author.IsSuspended() || post.HiddenByAdmin || !post.IsReadableByURL() {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	// comments can quote protected posts, they're only given to the author
+	if currentUser := getSignedInUserOrNil(r); post.IsPasswordProtected() &&
+		(currentUser == nil || currentUser.ID != author.ID) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	commentsLastModified, err := database.CommentsLastModified(post.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	validators := newCacheValidators(r)
+	validators.add("post", post.ID, post.UpdatedAt)
+	validators.add("comments", post.ID, commentsLastModified)
+	if writeCacheHeaders(w, r, validators) {
+		return
+	}
+
+	comments, err := approvedCommentViews(&post)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"post_id":          post.ID,
+		"comments_enabled": post.CommentsEnabled,
+		"comments":         comments,
+	})
+}
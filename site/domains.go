@@ -0,0 +1,266 @@
+package site
+
+import (
+	"context"
+	"errors"
+	"kitty/constants"
+	"kitty/database"
+	"kitty/domains"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+const domainVerificationTimeout = 10 * time.Second
+
+var (
+	publicURL     *url.URL
+	publicURLOnce sync.Once
+)
+
+func getPublicURL() *url.URL {
+	publicURLOnce.Do(func() {
+		value := strings.TrimSuffix(os.Getenv("KITTY_PUBLIC_URL"), "/")
+		if value == "" {
+			value = constants.PUBLIC_URL
+		}
+
+		parsed, err := url.Parse(value)
+		if err != nil || parsed.Host == "" {
+			log.Printf("Invalid KITTY_PUBLIC_URL %q, using %s", value, constants.PUBLIC_URL)
+			parsed, _ = url.Parse(constants.PUBLIC_URL)
+		}
+		publicURL = parsed
+	})
+	return publicURL
+}
+
+// PublicURL is the canonical URL of the instance without a trailing slash,
+// set with KITTY_PUBLIC_URL and defaulting to constants.PUBLIC_URL.
+func PublicURL() string {
+	return getPublicURL().String()
+}
+
+// PrimaryHost is the hostname of PublicURL, the only host serving anything
+// besides blogs.
+func PrimaryHost() string {
+	return getPublicURL().Hostname()
+}
+
+// customDomainURL is the URL of the homepage of a blog served on domain. It
+// uses the same scheme as the instance.
+func customDomainURL(domain string) string {
+	return getPublicURL().Scheme + "://" + domain
+}
+
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+type customDomainOwnerKey struct{}
+
+// HostRouter sends requests for verified custom domains to the blogs
+// handler, with the domain's owner in the context, and every other request to
+// main.
+func HostRouter(main http.Handler, blogs http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := requestHost(r)
+		if host == PrimaryHost() {
+			main.ServeHTTP(w, r)
+			return
+		}
+
+		userID, ok, err := database.LookupVerifiedDomain(host)
+		if err != nil {
+			log.Printf("Failed to look up custom domain %q: %v", host, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			main.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), customDomainOwnerKey{}, userID)
+		blogs.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// customDomainBlog loads the blog served on the requested custom domain,
+// returning nil if there's nothing to show.
+func customDomainBlog(r *http.Request) (*blogRequest, error) {
+	userID, ok := r.Context().Value(customDomainOwnerKey{}).(uint)
+	if !ok {
+		return nil, nil
+	}
+
+	var user database.AdminUser
+	result := database.GetDB().First(&user, userID)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	if user.IsSuspended() {
+		return nil, nil
+	}
+
+	b, err := getBlog(&user)
+	if err != nil || !b.Enabled {
+		return nil, err
+	}
+
+	return &blogRequest{user: &user, blog: b, basePath: "", canonicalBase: customDomainURL(requestHost(r))}, nil
+}
+
+func CustomDomainBlogIndex(w http.ResponseWriter, r *http.Request) {
+	br, err := customDomainBlog(r)
+	if err != nil {
+		http.Error(w, "Error fetching blog", http.StatusInternalServerError)
+		return
+	} else if br == nil {
+		http.Error(w, "Blog not found", http.StatusNotFound)
+		return
+	}
+	br.serveIndex(w, r)
+}
+
+func CustomDomainBlogPost(w http.ResponseWriter, r *http.Request) {
+	br, err := customDomainBlog(r)
+	if err != nil {
+		http.Error(w, "Error fetching blog", http.StatusInternalServerError)
+		return
+	} else if br == nil {
+		http.Error(w, "Blog not found", http.StatusNotFound)
+		return
+	}
+	br.servePost(w, r, chi.URLParam(r, "slug"))
+}
+
+// verifiedDomainOf returns the custom domain the user verified, or "".
+func verifiedDomainOf(user *database.AdminUser) (string, error) {
+	customDomain, err := database.GetCustomDomain(user.ID)
+	if err != nil || customDomain == nil || customDomain.VerifiedAt == nil {
+		return "", err
+	}
+	return customDomain.Domain, nil
+}
+
+// blogCanonicalBase is the absolute URL of a user's blog homepage, without
+// the trailing slash: their custom domain once verified, a path on the
+// instance otherwise.
+func blogCanonicalBase(user *database.AdminUser) (string, error) {
+	domain, err := verifiedDomainOf(user)
+	if err != nil {
+		return "", err
+	}
+	if domain != "" {
+		return customDomainURL(domain), nil
+	}
+	return PublicURL() + "/b/" + user.Username, nil
+}
+
+func DashboardSetCustomDomain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getSignedInUserOrFail(r)
+
+	if strings.TrimSpace(r.FormValue("domain")) == "" {
+		err := database.DeleteCustomDomain(user.ID)
+		if err != nil {
+			http.Error(w, "Error removing domain", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/dashboard/blog?domain=removed", http.StatusSeeOther)
+		return
+	}
+
+	domain, err := domains.Normalize(r.FormValue("domain"))
+	if err == nil && (domain == PrimaryHost() || domain == "localhost") {
+		err = errors.New("that domain can't be used for a blog")
+	}
+	if err != nil {
+		renderBlogSettings(w, r, http.StatusBadRequest, nil, asSentence(err.Error()))
+		return
+	}
+
+	current, err := database.GetCustomDomain(user.ID)
+	if err != nil {
+		http.Error(w, "Error loading domain", http.StatusInternalServerError)
+		return
+	}
+	if current != nil && current.Domain == domain {
+		http.Redirect(w, r, "/dashboard/blog", http.StatusSeeOther)
+		return
+	}
+
+	token, err := generateAuthToken()
+	if err != nil {
+		http.Error(w, "Error saving domain: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = database.ClaimCustomDomain(user.ID, domain, token)
+	if err != nil {
+		http.Error(w, "Error saving domain", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/blog?domain=claimed", http.StatusSeeOther)
+}
+
+func DashboardVerifyCustomDomain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getSignedInUserOrFail(r)
+
+	customDomain, err := database.GetCustomDomain(user.ID)
+	if err != nil {
+		http.Error(w, "Error loading domain", http.StatusInternalServerError)
+		return
+	}
+	if customDomain == nil {
+		http.Redirect(w, r, "/dashboard/blog", http.StatusSeeOther)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), domainVerificationTimeout)
+	defer cancel()
+
+	verified, err := domains.Verify(ctx, customDomain.Domain, customDomain.VerificationToken)
+	if err != nil {
+		log.Printf("Failed to verify domain %q: %v", customDomain.Domain, err)
+		http.Redirect(w, r, "/dashboard/blog?domain=lookup_failed", http.StatusSeeOther)
+		return
+	}
+	if !verified {
+		http.Redirect(w, r, "/dashboard/blog?domain=not_verified", http.StatusSeeOther)
+		return
+	}
+
+	err = database.MarkCustomDomainVerified(customDomain)
+	if err != nil {
+		http.Error(w, "Error verifying domain", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/blog?domain=verified", http.StatusSeeOther)
+}
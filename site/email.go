@@ -0,0 +1,371 @@
+package site
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kitty/constants"
+	"kitty/database"
+	"kitty/mail"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	emailVerificationTokenTTL = 48 * time.Hour
+	passwordResetTokenTTL     = time.Hour
+)
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// sendEmailInBackground delivers msg without making the request wait for the
+// mail server (and without leaking, through response times, whether an email
+// was actually sent).
+func sendEmailInBackground(msg mail.Message) {
+	go func() {
+		err := mail.GetSender().Send(context.Background(), msg)
+		if err != nil {
+			log.Printf("Failed to send email '%s': %v", msg.Subject, err)
+		}
+	}()
+}
+
+func sendVerificationEmail(user *database.AdminUser) error {
+	token, err := generateAuthToken()
+	if err != nil {
+		return err
+	}
+
+	err = database.CreateUserToken(user.ID, database.UserTokenPurposeEmailVerification, token, user.Email, emailVerificationTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := PublicURL() + "/verify-email?token=" + url.QueryEscape(token)
+	sendEmailInBackground(mail.Message{
+		To:      user.Email,
+		Subject: fmt.Sprintf("Verify your %s email address", constants.APP_NAME),
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm this is your email address by opening the link below:\n\n%s\n\n"+
+			"The link expires in %d hours. If you didn't add this address to your %s account you can ignore this email.\n",
+			user.Username, link, int(emailVerificationTokenTTL.Hours()), constants.APP_NAME),
+	})
+	return nil
+}
+
+func validateEmail(email string) error {
+	addr, err := netmail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("that doesn't look like a valid email address")
+	}
+	return nil
+}
+
+func AccountChangeEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getSignedInUserOrFail(r)
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	password := r.FormValue("password")
+
+	if err := checkCurrentPassword(user, password); err != nil {
+		http.Error(w, asSentence(err.Error()), http.StatusUnauthorized)
+		return
+	}
+
+	if email != "" {
+		if err := validateEmail(email); err != nil {
+			http.Error(w, asSentence(err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if email == user.Email {
+		http.Redirect(w, r, "/dashboard/account", http.StatusSeeOther)
+		return
+	}
+
+	user.Email = email
+	user.EmailVerifiedAt = nil
+	result := database.GetDB().Save(user)
+	if result.Error != nil {
+		http.Error(w, "Error changing email", http.StatusInternalServerError)
+		return
+	}
+
+	// any outstanding verification and reset links were sent to the old
+	// address
+	err := database.RevokeUserTokens(database.GetDB(), user.ID, database.UserTokenPurposeEmailVerification)
+	if err != nil {
+		log.Printf("Failed to revoke verification tokens for user %d: %v", user.ID, err)
+	}
+	err = database.RevokeUserTokens(database.GetDB(), user.ID, database.UserTokenPurposePasswordReset)
+	if err != nil {
+		log.Printf("Failed to revoke password reset tokens for user %d: %v", user.ID, err)
+	}
+
+	if email == "" {
+		http.Redirect(w, r, "/dashboard/account?updated=email_removed", http.StatusSeeOther)
+		return
+	}
+
+	err = sendVerificationEmail(user)
+	if err != nil {
+		http.Error(w, "Error sending verification email", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account?updated=email", http.StatusSeeOther)
+}
+
+func AccountResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getSignedInUserOrFail(r)
+	if user.Email == "" || user.EmailVerifiedAt != nil {
+		http.Redirect(w, r, "/dashboard/account", http.StatusSeeOther)
+		return
+	}
+
+	err := sendVerificationEmail(user)
+	if err != nil {
+		http.Error(w, "Error sending verification email", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account?updated=email", http.StatusSeeOther)
+}
+
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	var verified bool
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		userToken, err := database.ConsumeUserToken(tx, database.UserTokenPurposeEmailVerification, token)
+		if err != nil || userToken == nil {
+			return err
+		}
+
+		var user database.AdminUser
+		if result := tx.First(&user, userToken.AdminUserID); result.Error != nil {
+			return result.Error
+		}
+
+		// the user changed their address after the link was sent
+		if user.Email != userToken.Email {
+			return nil
+		}
+
+		var ownersCount int64
+		result := tx.Model(&database.AdminUser{}).
+			Where("LOWER(email) = LOWER(?) AND email_verified_at IS NOT NULL AND id <> ?", user.Email, user.ID).
+			Count(&ownersCount)
+		if result.Error != nil {
+			return result.Error
+		}
+		if ownersCount > 0 {
+			return nil
+		}
+
+		verified = true
+		return tx.Model(&user).Update("email_verified_at", time.Now()).Error
+	})
+	if err != nil {
+		http.Error(w, "Error verifying email", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if !verified {
+		status = http.StatusBadRequest
+	}
+	RenderTemplateStatus(w, r, "verify_email", status, verified)
+}
+
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		RenderTemplate(w, r, "forgot_password", false)
+
+	case "POST":
+		identifier := strings.TrimSpace(r.FormValue("identifier"))
+
+		user, err := findUserForPasswordReset(identifier)
+		if err != nil {
+			http.Error(w, "Error requesting password reset", http.StatusInternalServerError)
+			return
+		}
+
+		// we show the same page whether we found the user or not, so that this
+		// can't be used to find out who has an account
+		if user != nil && !user.IsSuspended() {
+			err = sendPasswordResetEmail(user)
+			if err != nil {
+				log.Printf("Failed to create password reset for user %d: %v", user.ID, err)
+			}
+		}
+
+		RenderTemplate(w, r, "forgot_password", true)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// findUserForPasswordReset looks up a user with a verified email address by
+// either their username or their email.
+func findUserForPasswordReset(identifier string) (*database.AdminUser, error) {
+	if identifier == "" {
+		return nil, nil
+	}
+
+	if strings.Contains(identifier, "@") {
+		return database.GetUserWithVerifiedEmail(identifier)
+	}
+
+	var user database.AdminUser
+	result := database.GetDB().
+		Where("LOWER(username) = LOWER(?) AND email <> '' AND email_verified_at IS NOT NULL", identifier).
+		First(&user)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+	return &user, nil
+}
+
+func sendPasswordResetEmail(user *database.AdminUser) error {
+	token, err := generateAuthToken()
+	if err != nil {
+		return err
+	}
+
+	err = database.CreateUserToken(user.ID, database.UserTokenPurposePasswordReset, token, user.Email, passwordResetTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := PublicURL() + "/reset-password?token=" + url.QueryEscape(token)
+	sendEmailInBackground(mail.Message{
+		To:      user.Email,
+		Subject: fmt.Sprintf("Reset your %s password", constants.APP_NAME),
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone (hopefully you) asked to reset the password of your %s account. "+
+			"You can choose a new password by opening the link below:\n\n%s\n\n"+
+			"The link can only be used once and expires in %d minutes. If you didn't ask for this you can ignore this email.\n",
+			user.Username, constants.APP_NAME, link, int(passwordResetTokenTTL.Minutes())),
+	})
+	return nil
+}
+
+type resetPasswordFormData struct {
+	Token        string
+	InvalidToken bool
+	Errors       []string
+}
+
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	formData := resetPasswordFormData{Token: r.FormValue("token")}
+
+	userToken, err := database.GetValidUserToken(database.UserTokenPurposePasswordReset, formData.Token)
+	if err != nil {
+		http.Error(w, "Error verifying reset link", http.StatusInternalServerError)
+		return
+	}
+	if userToken == nil {
+		formData.InvalidToken = true
+		RenderTemplateStatus(w, r, "reset_password", http.StatusBadRequest, formData)
+		return
+	}
+
+	var user database.AdminUser
+	result := database.GetDB().First(&user, userToken.AdminUserID)
+	if result.Error != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	// links sent to an address the user no longer has are void
+	if !strings.EqualFold(userToken.Email, user.Email) {
+		formData.InvalidToken = true
+		RenderTemplateStatus(w, r, "reset_password", http.StatusBadRequest, formData)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		RenderTemplate(w, r, "reset_password", formData)
+
+	case "POST":
+
+		password := r.FormValue("password")
+		if password != r.FormValue("confirm_password") {
+			formData.Errors = []string{"Password and confirmation don't match."}
+		} else if err := validatePassword(password, user.Username); err != nil {
+			formData.Errors = []string{asSentence(err.Error())}
+		}
+		if len(formData.Errors) > 0 {
+			RenderTemplateStatus(w, r, "reset_password", http.StatusBadRequest, formData)
+			return
+		}
+
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "Error resetting password: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// signs out every existing session
+		sessionToken, err := generateAuthToken()
+		if err != nil {
+			http.Error(w, "Error resetting password: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+			consumed, err := database.ConsumeUserToken(tx, database.UserTokenPurposePasswordReset, formData.Token)
+			if err != nil {
+				return err
+			}
+			if consumed == nil {
+				return errInvalidToken
+			}
+
+			result := tx.Model(&user).Updates(map[string]any{
+				"password_hash": passwordHash,
+				"session_token": sessionToken,
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+
+			return database.RevokeUserTokens(tx, user.ID, database.UserTokenPurposePasswordReset)
+		})
+		if errors.Is(err, errInvalidToken) {
+			formData.InvalidToken = true
+			RenderTemplateStatus(w, r, "reset_password", http.StatusBadRequest, formData)
+			return
+		} else if err != nil {
+			http.Error(w, "Error resetting password", http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
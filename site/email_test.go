@@ -0,0 +1,207 @@
+package site
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"kitty/constants"
+	"kitty/database"
+	"kitty/mail"
+)
+
+// smtpMessage is what the fake SMTP server received for one message.
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// startFakeSMTPServer accepts SMTP sessions on a local port and reports every
+// message it receives on the returned channel. It doesn't offer STARTTLS or
+// authentication.
+func startFakeSMTPServer(t *testing.T) (int, <-chan smtpMessage) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan smtpMessage, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn, messages)
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port, messages
+}
+
+func serveFakeSMTP(conn net.Conn, messages chan<- smtpMessage) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	var msg smtpMessage
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			msg.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, "."))
+			}
+			msg.data = data.String()
+			messages <- msg
+			msg = smtpMessage{}
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestPasswordResetEmailIsDeliveredOverSMTP(t *testing.T) {
+	port, messages := startFakeSMTPServer(t)
+	mail.SetSender(&mail.SMTPSender{Host: "127.0.0.1", Port: port, From: "kitty@example.com"})
+	t.Cleanup(func() { mail.SetSender(nil) })
+
+	user := createTestUser(t, "resetme")
+	user.Email = "resetme@example.com"
+	if err := database.GetDB().Save(user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendPasswordResetEmail(user); err != nil {
+		t.Fatalf("sendPasswordResetEmail: %v", err)
+	}
+
+	var msg smtpMessage
+	select {
+	case msg = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email reached the SMTP server")
+	}
+
+	if msg.from != "kitty@example.com" {
+		t.Errorf("MAIL FROM = %q, want kitty@example.com", msg.from)
+	}
+	if len(msg.to) != 1 || msg.to[0] != "resetme@example.com" {
+		t.Errorf("RCPT TO = %q, want resetme@example.com", msg.to)
+	}
+	if want := "Subject: Reset your " + constants.APP_NAME + " password\r\n"; !strings.Contains(msg.data, want) {
+		t.Errorf("message has no %q header:\n%s", strings.TrimSpace(want), msg.data)
+	}
+
+	link := regexp.MustCompile(regexp.QuoteMeta(PublicURL()) + `/reset-password\?token=\S+`).FindString(msg.data)
+	if link == "" {
+		t.Fatalf("message has no reset link:\n%s", msg.data)
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("reset link %q doesn't parse: %v", link, err)
+	}
+	token, err := database.GetValidUserToken(database.UserTokenPurposePasswordReset, parsed.Query().Get("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.AdminUserID != user.ID {
+		t.Errorf("the token of link %q doesn't reset the password of user %d", link, user.ID)
+	}
+}
+
+func TestChangingEmailRevokesPasswordResetLinks(t *testing.T) {
+	user := createUserWithVerifiedEmail(t, "email-changer", "old@example.com")
+	now := time.Now()
+	user.SignedInAt = &now
+	if err := database.GetDB().Save(user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	const token = "reset-token-sent-to-old-address"
+	err := database.CreateUserToken(user.ID, database.UserTokenPurposePasswordReset, token, user.Email, passwordResetTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"email": {"new@example.com"}}
+	rec := httptest.NewRecorder()
+	AccountChangeEmail(rec, signedInRequest("POST", "/dashboard/account/email", strings.NewReader(form.Encode()), user))
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusSeeOther, rec.Body.String())
+	}
+
+	valid, err := database.GetValidUserToken(database.UserTokenPurposePasswordReset, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid != nil {
+		t.Error("a reset link sent to the old address is still valid")
+	}
+}
+
+func TestResetPasswordRejectsLinksSentToAnotherAddress(t *testing.T) {
+	user := createUserWithVerifiedEmail(t, "reset-other-address", "current@example.com")
+
+	const token = "reset-token-for-another-address"
+	err := database.CreateUserToken(user.ID, database.UserTokenPurposePasswordReset, token, "previous@example.com", passwordResetTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"token": {token}, "password": {"An0ther-Passw0rd!"}, "confirm_password": {"An0ther-Passw0rd!"}}
+	req := httptest.NewRequest("POST", "/reset-password", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	ResetPassword(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var reloaded database.AdminUser
+	if err := database.GetDB().First(&reloaded, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.PasswordHash) != 0 {
+		t.Error("the password was reset through a link sent to another address")
+	}
+}
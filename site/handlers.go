@@ -3,27 +3,36 @@ package site
 import (
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"kitty/constants"
 	"kitty/database"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gosimple/slug"
 	"golang.org/x/crypto/bcrypt"
-	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
+type signInData struct {
+	// where to go once signed in, see localRedirectPath
+	Next string
+}
+
 func UserSignIn(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		adminUser := getSignedInUserOrNil(r)
 		if adminUser == nil {
-			RenderTemplate(w, r, "signin", nil)
+			RenderTemplate(w, r, "signin", signInData{Next: r.URL.Query().Get("next")})
 			return
 		} else {
-			http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+			http.Redirect(w, r, localRedirectPath(r.URL.Query().Get("next")), http.StatusSeeOther)
 			return
 		}
 
@@ -44,6 +53,11 @@ func UserSignIn(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if admin.IsSuspended() {
+			http.Error(w, "This account has been suspended", http.StatusForbidden)
+			return
+		}
+
 		// Generate a new token for the session
 		token, err := generateAuthToken()
 		if err != nil {
@@ -51,73 +65,160 @@ func UserSignIn(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		now := time.Now()
 		admin.SessionToken = token
+		admin.SignedInAt = &now
 		database.GetDB().Save(&admin)
 
-		http.SetCookie(w, &http.Cookie{
-			Name:  string(AuthenticatedUserTokenCookieName),
-			Value: token,
-			Path:  "/",
-		})
+		setSessionCookie(w, token)
 
-		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		// the form is posted to the page's URL, next included
+		http.Redirect(w, r, localRedirectPath(r.FormValue("next")), http.StatusSeeOther)
 	}
 }
 
+var errInviteAlreadyUsed = errors.New("invite code already used")
+
+type signUpFormData struct {
+	RegistrationMode database.RegistrationMode
+	Username         string
+	InviteCode       string
+	Errors           []string
+}
+
 func UserSignUp(w http.ResponseWriter, r *http.Request) {
+	if getSignedInUserOrNil(r) != nil {
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	settings, err := database.GetInstanceSettings()
+	if err != nil {
+		http.Error(w, "Error loading instance settings", http.StatusInternalServerError)
+		return
+	}
+
+	formData := signUpFormData{
+		RegistrationMode: settings.RegistrationMode,
+		Username:         strings.TrimSpace(r.FormValue("username")),
+		InviteCode:       strings.TrimSpace(r.FormValue("invite")),
+	}
+
+	renderWithErrors := func(status int, errs ...string) {
+		formData.Errors = errs
+		RenderTemplateStatus(w, r, "signup", status, formData)
+	}
+
 	if r.Method == "GET" {
-		adminUser := getSignedInUserOrNil(r)
-		if adminUser == nil {
-			RenderTemplate(w, r, "signup", nil)
-			return
-		} else {
-			http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
-			return
-		}
+		RenderTemplate(w, r, "signup", formData)
+		return
+	}
 
-	} else {
-		username := r.FormValue("username")
-		password := r.FormValue("password")
+	if settings.RegistrationMode == database.RegistrationModeClosed {
+		renderWithErrors(http.StatusForbidden, "Registrations are currently closed on this instance.")
+		return
+	}
 
-		passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-		if err != nil {
-			http.Error(w, "Error creating account: "+err.Error(), http.StatusInternalServerError)
+	username := formData.Username
+	password := r.FormValue("password")
+
+	var validationErrors []string
+	if err := validateUsername(username); err != nil {
+		validationErrors = append(validationErrors, asSentence(err.Error()))
+	}
+	if err := validatePassword(password, username); err != nil {
+		validationErrors = append(validationErrors, asSentence(err.Error()))
+	}
+	if len(validationErrors) > 0 {
+		renderWithErrors(http.StatusBadRequest, validationErrors...)
+		return
+	}
+
+	taken, err := database.IsUsernameTaken(username)
+	if err != nil {
+		log.Printf("Error verifying if username exists: %v", err)
+		renderWithErrors(http.StatusInternalServerError, "Something went wrong creating your account, please try again.")
+		return
+	}
+	if taken {
+		renderWithErrors(http.StatusBadRequest, "That username is already taken.")
+		return
+	}
+
+	var invite *database.InviteCode
+	if settings.RegistrationMode == database.RegistrationModeInviteOnly {
+		if formData.InviteCode == "" {
+			renderWithErrors(http.StatusBadRequest, "An invite code is required to sign up on this instance.")
 			return
 		}
 
-		// Create a new token and store it in a cookie
-		token, err := generateAuthToken()
+		invite, err = database.GetInviteCode(formData.InviteCode)
 		if err != nil {
-			http.Error(w, "Error creating account: "+err.Error(), http.StatusInternalServerError)
+			log.Printf("Error fetching invite code: %v", err)
+			renderWithErrors(http.StatusInternalServerError, "Something went wrong creating your account, please try again.")
+			return
+		}
+		if invite == nil || !invite.IsUsable(time.Now()) {
+			renderWithErrors(http.StatusBadRequest, "That invite code is invalid, expired or has already been used.")
 			return
 		}
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error creating account: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Create a new token and store it in a cookie
+	token, err := generateAuthToken()
+	if err != nil {
+		http.Error(w, "Error creating account: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	newAdmin := database.AdminUser{Username: username, PasswordHash: passwordHash, SessionToken: token, SignedInAt: &now}
+
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := database.CreateUser(tx, &newAdmin); err != nil {
+			return err
+		}
 
-		newAdmin := database.AdminUser{Username: username, PasswordHash: passwordHash, SessionToken: token}
+		if invite == nil {
+			return nil
+		}
 
-		result := database.GetDB().Create(&newAdmin)
+		// only mark the code as used if nobody beat us to it
+		now := time.Now()
+		result := tx.Model(&database.InviteCode{}).
+			Where("id = ? AND used_by_id IS NULL", invite.ID).
+			Updates(map[string]any{"used_by_id": newAdmin.ID, "used_at": now})
 		if result.Error != nil {
-			http.Error(w, "Error creating account: "+result.Error.Error(), http.StatusInternalServerError)
-			return
+			return result.Error
 		}
+		if result.RowsAffected != 1 {
+			return errInviteAlreadyUsed
+		}
+		return nil
+	})
+	if errors.Is(err, errInviteAlreadyUsed) {
+		renderWithErrors(http.StatusBadRequest, "That invite code is invalid, expired or has already been used.")
+		return
+	} else if err != nil {
+		log.Printf("Error creating account: %v", err)
+		renderWithErrors(http.StatusInternalServerError, "Something went wrong creating your account, please try again.")
+		return
+	}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:  string(AuthenticatedUserTokenCookieName),
-			Value: token,
-			Path:  "/",
-		})
+	setSessionCookie(w, token)
 
-		// Redirect to the admin sign-in page after successful sign-up
-		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
-	}
+	// Redirect to the admin sign-in page after successful sign-up
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
 }
 
 func UserLogout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:   string(AuthenticatedUserTokenCookieName),
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	})
+	clearSessionCookie(w)
 	http.Redirect(w, r, "/signin", http.StatusSeeOther)
 }
 
@@ -195,7 +296,11 @@ func ImportPosts(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Convert CSV records to Post structs
-		var incomingPosts []database.Post
+		type incomingPost struct {
+			post database.Post
+			tags []string
+		}
+		var incomingPosts []incomingPost
 		for _, record := range records {
 			if len(record) < 2 {
 				http.Error(w, "Invalid CSV format", http.StatusBadRequest)
@@ -206,9 +311,9 @@ func ImportPosts(w http.ResponseWriter, r *http.Request) {
 			if existingPost, exists := allCurrentPosts[slug]; exists {
 				if overwriteExisting {
 					// Delete the existing post
-					result := database.GetDB().Delete(&existingPost)
-					if result.Error != nil {
-						http.Error(w, "Failed to delete existing post: "+result.Error.Error(), http.StatusInternalServerError)
+					err := database.DeletePost(&existingPost)
+					if err != nil {
+						http.Error(w, "Failed to delete existing post: "+err.Error(), http.StatusInternalServerError)
 						return
 					}
 
@@ -226,7 +331,7 @@ func ImportPosts(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			var tags datatypes.JSON
+			var tags []string
 			err = json.Unmarshal([]byte(record[8]), &tags)
 			if err != nil {
 				http.Error(w, "Failed to parse tags JSON: "+err.Error(), http.StatusBadRequest)
@@ -251,7 +356,6 @@ func ImportPosts(w http.ResponseWriter, r *http.Request) {
 				Title:           title,
 				Slug:            slug,
 				PublishedDate:   publishedDate,
-				Tags:            tags,
 				Published:       record[9] == "TRUE" || record[9] == "true" || record[9] == "True",
 				IsPage:          record[11] == "TRUE" || record[11] == "true" || record[11] == "True",
 				Body:            body,
@@ -260,14 +364,19 @@ func ImportPosts(w http.ResponseWriter, r *http.Request) {
 				Lang:            lang,
 				AdminUserID:     user.ID,
 			}
-			incomingPosts = append(incomingPosts, post)
+			incomingPosts = append(incomingPosts, incomingPost{post: post, tags: database.NormalizeTagNames(tags)})
 		}
 
 		// Insert the posts into the database
-		for _, post := range incomingPosts {
-			result := database.GetDB().Create(&post)
-			if result.Error != nil {
-				http.Error(w, "Failed to insert post: "+result.Error.Error(), http.StatusInternalServerError)
+		for _, incoming := range incomingPosts {
+			err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+				if err := tx.Create(&incoming.post).Error; err != nil {
+					return err
+				}
+				return database.SetPostTags(tx, &incoming.post, incoming.tags)
+			})
+			if err != nil {
+				http.Error(w, "Failed to insert post: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
 		}
@@ -279,17 +388,55 @@ func ImportPosts(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// postEditorData is given to the post editor. Post is the zero value for new
+// posts.
+type postEditorData struct {
+	database.Post
+	Series           []database.SeriesCount
+	SelectedSeriesID uint
+	HasPassword      bool
+}
+
+func renderPostEditor(w http.ResponseWriter, r *http.Request, post database.Post) {
+	series, err := database.GetUserSeries(getSignedInUserOrFail(r).ID, false)
+	if err != nil {
+		http.Error(w, "Error fetching series", http.StatusInternalServerError)
+		return
+	}
+
+	data := postEditorData{Post: post, Series: series, HasPassword: post.IsPasswordProtected()}
+	if post.SeriesID != nil {
+		data.SelectedSeriesID = *post.SeriesID
+	}
+	RenderTemplate(w, r, "dashboard/create_edit_post", data)
+}
+
 func CreatePost(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		RenderTemplate(w, r, "dashboard/create_edit_post", nil)
+		renderPostEditor(w, r, database.Post{})
 	case "POST":
-		newPost, e := buildPostFromFormRequest(r)
+		newPost, tags, e := buildPostFromFormRequest(r)
 		if e != nil {
 			http.Error(w, "Error creating post: "+e.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		seriesID, err := seriesFromForm(r)
+		if err != nil {
+			http.Error(w, "Error creating post: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		passwordHash, changePassword, err := postPasswordFromForm(r)
+		if err != nil {
+			http.Error(w, "Error creating post: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if changePassword {
+			newPost.PasswordHash = passwordHash
+		}
+
 		if newPost.Slug == "" {
 			newPost.Slug = slug.Make(newPost.Title)
 		}
@@ -304,11 +451,25 @@ func CreatePost(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		result := database.GetDB().Create(&newPost)
-		if result.Error != nil {
+		err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&newPost).Error; err != nil {
+				return err
+			}
+			if err := database.SetPostSeries(tx, &newPost, seriesID); err != nil {
+				return err
+			}
+			return database.SetPostTags(tx, &newPost, tags)
+		})
+		if errors.Is(err, database.ErrSeriesNotFound) {
+			http.Error(w, "Invalid series", http.StatusBadRequest)
+			return
+		} else if err != nil {
 			http.Error(w, "Error creating post", http.StatusInternalServerError)
 			return
 		}
+
+		sendPostWebmentions(nil, &newPost, getSignedInUserOrFail(r))
+
 		http.Redirect(w, r, "/dashboard/post/"+strconv.Itoa(int(newPost.ID)), http.StatusSeeOther)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -319,7 +480,7 @@ func UpdatePost(w http.ResponseWriter, r *http.Request) {
 	postID := chi.URLParam(r, "postID")
 
 	var post database.Post
-	result := database.GetDB().First(&post, postID)
+	result := database.GetDB().Preload("Tags").First(&post, postID)
 	if result.Error != nil {
 		http.Error(w, "Post not found", http.StatusNotFound)
 		return
@@ -333,15 +494,29 @@ func UpdatePost(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET":
-		RenderTemplate(w, r, "dashboard/create_edit_post", post)
+		renderPostEditor(w, r, post)
 
 	case "POST":
-		newPostData, e := buildPostFromFormRequest(r)
+		newPostData, tags, e := buildPostFromFormRequest(r)
 		if e != nil {
 			http.Error(w, "Error updating post: "+e.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		seriesID, err := seriesFromForm(r)
+		if err != nil {
+			http.Error(w, "Error updating post: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		passwordHash, changePassword, err := postPasswordFromForm(r)
+		if err != nil {
+			http.Error(w, "Error updating post: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		previousPost := post
+
 		post.Title = newPostData.Title
 		post.Body = newPostData.Body
 
@@ -365,15 +540,35 @@ func UpdatePost(w http.ResponseWriter, r *http.Request) {
 		post.MetaDescription = newPostData.MetaDescription
 		post.MetaImage = newPostData.MetaImage
 		post.Lang = newPostData.Lang
-		post.Tags = newPostData.Tags
 		post.Published = newPostData.Published
+		post.NoIndex = newPostData.NoIndex
+		post.Visibility = newPostData.Visibility
+		post.CommentsEnabled = newPostData.CommentsEnabled
+		if changePassword {
+			post.PasswordHash = passwordHash
+		}
+		post.RenderOptions = newPostData.RenderOptions
 
-		result = database.GetDB().Save(&post)
-		if result.Error != nil {
+		err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+			if err := tx.Omit("Tags", "Series", "Upvotes").Save(&post).Error; err != nil {
+				return err
+			}
+			if err := database.SetPostSeries(tx, &post, seriesID); err != nil {
+				return err
+			}
+			return database.SetPostTags(tx, &post, tags)
+		})
+		if errors.Is(err, database.ErrSeriesNotFound) {
+			http.Error(w, "Invalid series", http.StatusBadRequest)
+			return
+		} else if err != nil {
 			http.Error(w, "Error updating guestbook", http.StatusInternalServerError)
 			return
 		}
 
+		forgetRenderedPost(&previousPost, currentUser)
+		sendPostWebmentions(&previousPost, &post, currentUser)
+
 		http.Redirect(w, r, "/dashboard/post/"+postID, http.StatusSeeOther)
 
 	default:
@@ -399,12 +594,14 @@ func DeletePost(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "POST":
-		result = database.GetDB().Delete(&post)
-		if result.Error != nil {
+		err := database.DeletePost(&post)
+		if err != nil {
 			http.Error(w, "Error deleting post", http.StatusInternalServerError)
 			return
 		}
 
+		forgetRenderedPost(&post, currentUser)
+
 		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
 
 	default:
@@ -412,30 +609,259 @@ func DeletePost(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type publicPostView struct {
+	database.Post
+	BodyHTML template.HTML
+	// nil unless the post is part of a series
+	SeriesNav *postSeriesNav
+	// nil on pages only reachable through a share link
+	Meta *pageMeta
+	// also set for posts that aren't public, and those seen through share
+	// links
+	NoIndex bool
+	// drafts and private posts can't be upvoted
+	CanUpvote bool
+	// comments are only taken on posts anyone can read that allow them
+	CanComment bool
+	// approved comments, oldest first
+	Comments []commentView
+	// set right after a reader submitted a comment that awaits moderation
+	CommentPending bool
+	// verified mentions of the post on other sites, oldest first
+	Webmentions []database.Webmention
+	// absolute URL where Webmentions of the post are received, empty for
+	// posts that can't be mentioned
+	WebmentionEndpoint string
+}
+
 func PublicViewPost(w http.ResponseWriter, r *http.Request) {
 	postID := chi.URLParam(r, "postID")
 
 	var post database.Post
-	result := database.GetDB().First(&post, postID)
+	result := database.GetDB().Preload("Tags").Preload("Series").First(&post, postID)
 	if result.Error != nil {
 		http.Error(w, "Post not found", http.StatusNotFound)
 		return
 	}
 
-	RenderTemplate(w, r, "public_view_post", post)
+	var author database.AdminUser
+	result = database.GetDB().First(&author, post.AdminUserID)
+	if result.Error != nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	// moderated content is still visible to instance admins so they can review it
+	currentUser := getSignedInUserOrNil(r)
+	isAdmin := currentUser != nil && currentUser.IsAdmin
+	if (post.HiddenByAdmin || author.IsSuspended()) && !isAdmin {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	// drafts and private posts are only shown to their author, others need
+	// a share link
+	isAuthor := currentUser != nil && currentUser.ID == author.ID
+	if !post.IsReadableByURL() && !isAuthor {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	if !canReadProtectedPost(r, &post) {
+		if r.Method != "POST" {
+			renderPostPasswordForm(w, r, &post, http.StatusOK, "")
+			return
+		}
+		err := unlockPost(w, r, &post)
+		if errors.Is(err, errWrongPostPassword) {
+			renderPostPasswordForm(w, r, &post, http.StatusForbidden, "Wrong password.")
+			return
+		} else if err != nil {
+			http.Error(w, "Error checking the password", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	} else if r.Method == "POST" {
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	recordPageView(r, &author, post.ID)
+	mentionable := isMentionable(&post, &author)
+	if mentionable {
+		advertiseWebmentionEndpoint(w)
+	}
+
+	noIndex := post.NoIndex || post.Visibility != database.PostVisibilityPublic || post.IsPasswordProtected()
+	if noIndex {
+		w.Header().Set("X-Robots-Tag", "noindex")
+	}
+
+	validators := newCacheValidators(r)
+	validators.add("post", post.ID, post.UpdatedAt)
+	validators.add("author", author.ID, author.UpdatedAt)
+	validators.addValue("upvotes", strconv.FormatInt(post.Upvotes, 10))
+	commentPending := r.URL.Query().Get("comment") == "pending"
+	validators.addValue("comment", strconv.FormatBool(commentPending))
+	commentsLastModified, err := database.CommentsLastModified(post.ID)
+	if err != nil {
+		http.Error(w, "Error fetching comments", http.StatusInternalServerError)
+		return
+	}
+	validators.add("comments", post.ID, commentsLastModified)
+	webmentionsLastModified, err := database.WebmentionsLastModified(post.ID)
+	if err != nil {
+		http.Error(w, "Error fetching mentions", http.StatusInternalServerError)
+		return
+	}
+	validators.add("webmentions", post.ID, webmentionsLastModified)
+	if post.Series != nil {
+		// the links to the previous and next parts change with the other posts
+		postsLastModified, err := database.PostsLastModified(author.ID)
+		if err != nil {
+			http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+			return
+		}
+		validators.add("series", post.Series.ID, post.Series.UpdatedAt)
+		validators.add("posts", author.ID, postsLastModified)
+	}
+	if post.IsPasswordProtected() {
+		// the page depends on the reader's access cookie, which shared
+		// caches must never see
+		w.Header().Set("Cache-Control", "private, no-store")
+	} else if writeCacheHeaders(w, r, validators) {
+		return
+	}
+
+	seriesNav, err := getPostSeriesNav(&post)
+	if err != nil {
+		http.Error(w, "Error fetching series", http.StatusInternalServerError)
+		return
+	}
+
+	meta, err := postMeta(&post, &author)
+	if err != nil {
+		http.Error(w, "Error fetching blog", http.StatusInternalServerError)
+		return
+	}
+
+	comments, err := approvedCommentViews(&post)
+	if err != nil {
+		http.Error(w, "Error fetching comments", http.StatusInternalServerError)
+		return
+	}
+
+	webmentions, err := database.GetPostWebmentions(post.ID)
+	if err != nil {
+		http.Error(w, "Error fetching mentions", http.StatusInternalServerError)
+		return
+	}
+
+	view := publicPostView{
+		Post:           post,
+		BodyHTML:       renderPostBody(&post, &author),
+		SeriesNav:      seriesNav,
+		Meta:           meta,
+		NoIndex:        noIndex,
+		CanUpvote:      post.IsReadableByURL(),
+		CanComment:     post.IsReadableByURL() && post.CommentsEnabled,
+		Comments:       comments,
+		CommentPending: commentPending,
+		Webmentions:    webmentions,
+	}
+	if mentionable {
+		view.WebmentionEndpoint = webmentionEndpoint()
+	}
+	RenderTemplate(w, r, "public_view_post", view)
+}
+
+type publicUserView struct {
+	database.AdminUser
+	Tags   []database.TagCount
+	Series []database.SeriesCount
+	Meta   *pageMeta
+	// "upvotes" when the most upvoted posts come first, empty for the newest
+	Sort string
 }
 
 func PublicViewUser(w http.ResponseWriter, r *http.Request) {
 	userID := chi.URLParam(r, "userID")
 
+	sort := r.URL.Query().Get("sort")
+	order := "published_date DESC"
+	if sort == "upvotes" {
+		order = "upvotes DESC, published_date DESC"
+	} else {
+		sort = ""
+	}
+
 	var user database.AdminUser
 	result := database.GetDB().Preload("Posts", func(db *gorm.DB) *gorm.DB {
-		return db.Select("id, title, admin_user_id", "published_date").Where("published = ?", true).Order("published_date DESC")
+		return db.Select("id, title, admin_user_id", "published_date", "upvotes").
+			Scopes(database.ListedPosts).
+			Order(order)
 	}).First(&user, userID)
-	if result.Error != nil {
+	if result.Error != nil || user.IsSuspended() {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	RenderTemplate(w, r, "public_view_user", user)
+	b, err := getBlog(&user)
+	if err != nil {
+		http.Error(w, "Error fetching blog", http.StatusInternalServerError)
+		return
+	}
+	if b.Enabled {
+		canonicalBase, err := blogCanonicalBase(&user)
+		if err != nil {
+			http.Error(w, "Error fetching blog", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, canonicalBase+"/", http.StatusFound)
+		return
+	}
+
+	recordPageView(r, &user, 0)
+
+	postsLastModified, err := database.PostsLastModified(user.ID)
+	if err != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	upvotes, err := database.TotalUpvotes(user.ID)
+	if err != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	validators := newCacheValidators(r)
+	validators.add("user", user.ID, user.UpdatedAt)
+	validators.add("posts", user.ID, postsLastModified)
+	validators.addValue("upvotes", strconv.FormatInt(upvotes, 10))
+	validators.addValue("sort", sort)
+	if writeCacheHeaders(w, r, validators) {
+		return
+	}
+
+	tags, err := database.GetTagCounts(user.ID, true)
+	if err != nil {
+		http.Error(w, "Error fetching tags", http.StatusInternalServerError)
+		return
+	}
+
+	series, err := database.GetUserSeries(user.ID, true)
+	if err != nil {
+		http.Error(w, "Error fetching series", http.StatusInternalServerError)
+		return
+	}
+
+	RenderTemplate(w, r, "public_view_user", publicUserView{
+		AdminUser: user,
+		Tags:      tags,
+		Series:    series,
+		Meta:      userMeta(&user),
+		Sort:      sort,
+	})
 }
@@ -0,0 +1,118 @@
+package site
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"kitty/database"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Public responses can be reused by browsers and CDNs for a short while, and
+// revalidated with ETag/Last-Modified after that.
+const publicMaxAge = 60 * time.Second
+
+// serverStartedAt is part of every validator, since a new release can change
+// the templates without any post being modified.
+var serverStartedAt = time.Now()
+
+// cacheValidators identifies a version of a response without rendering it.
+type cacheValidators struct {
+	parts        []string
+	lastModified time.Time
+}
+
+// newCacheValidators starts the validators of a response shown to the user
+// making the request, including the instance settings since they affect how
+// every page is rendered.
+func newCacheValidators(r *http.Request) *cacheValidators {
+	v := &cacheValidators{}
+	v.add("started", serverStartedAt.UnixNano(), serverStartedAt)
+
+	// pages look different (navigation, moderation) for signed in users
+	if user := getSignedInUserOrNil(r); user != nil {
+		v.add("viewer", user.ID, user.UpdatedAt)
+	}
+
+	settings, err := database.GetInstanceSettings()
+	if err != nil {
+		log.Printf("Failed to load instance settings for cache validators: %v", err)
+	} else {
+		v.add("settings", settings.ID, settings.UpdatedAt)
+	}
+
+	return v
+}
+
+// add includes a record in the validators, the response is considered
+// modified whenever any of the records is.
+func (v *cacheValidators) add(kind string, id any, updatedAt time.Time) {
+	v.parts = append(v.parts, fmt.Sprintf("%s:%v:%d", kind, id, updatedAt.UnixNano()))
+	if updatedAt.After(v.lastModified) {
+		v.lastModified = updatedAt
+	}
+}
+
+// addValue includes something that isn't a record, like query parameters.
+func (v *cacheValidators) addValue(kind string, value string) {
+	v.parts = append(v.parts, kind+"="+value)
+}
+
+// etag is weak because the same version of a page can be served with
+// different encodings.
+func (v *cacheValidators) etag() string {
+	hash := sha256.Sum256([]byte(strings.Join(v.parts, "\n")))
+	return `W/"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// writeCacheHeaders sets the caching headers of the response. It returns true
+// if the client's copy is still fresh, in which case a 304 has been written
+// and the handler must not write a body.
+func writeCacheHeaders(w http.ResponseWriter, r *http.Request, v *cacheValidators) bool {
+	etag := v.etag()
+	lastModified := v.lastModified.UTC().Truncate(time.Second)
+
+	header := w.Header()
+	header.Set("ETag", etag)
+	header.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	header.Add("Vary", "Cookie")
+	if getSignedInUserOrNil(r) != nil {
+		header.Set("Cache-Control", "private, no-cache")
+	} else {
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(publicMaxAge.Seconds())))
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	if isNotModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// isNotModified evaluates If-None-Match, or If-Modified-Since when there's
+// no If-None-Match, as described in RFC 9110 section 13.2.2.
+func isNotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		return err == nil && !lastModified.After(since)
+	}
+
+	return false
+}
@@ -0,0 +1,456 @@
+package site
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"kitty/database"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long clients have to redeem an authorization code
+const indieAuthCodeTTL = 10 * time.Minute
+
+// indieAuthScopes are the scopes IndieAuth clients can ask for besides the
+// ones of API tokens.
+var indieAuthScopes = []apiScope{
+	{"profile", "See your username"},
+	{"email", "See your email address, if it's verified"},
+}
+
+// indieAuthScope returns the known scope with the given name.
+func indieAuthScope(name string) (apiScope, bool) {
+	for _, scope := range append(indieAuthScopes, apiScopes...) {
+		if scope.Name == name {
+			return scope, true
+		}
+	}
+	return apiScope{}, false
+}
+
+// indieAuthIssuer is the issuer identifier of the instance, a prefix of the
+// metadata URL.
+func indieAuthIssuer() string {
+	return PublicURL() + "/"
+}
+
+func indieAuthMetadataURL() string {
+	return PublicURL() + "/.well-known/oauth-authorization-server"
+}
+
+func indieAuthAuthorizationEndpoint() string {
+	return PublicURL() + "/indieauth/auth"
+}
+
+func indieAuthTokenEndpoint() string {
+	return PublicURL() + "/indieauth/token"
+}
+
+func indieAuthRevocationEndpoint() string {
+	return PublicURL() + "/indieauth/revoke"
+}
+
+// indieAuthProfileURL is the URL users sign in to other sites with. Users
+// with a blog are redirected to it, where the endpoints are advertised too.
+func indieAuthProfileURL(user *database.AdminUser) string {
+	return PublicURL() + "/u/" + strconv.Itoa(int(user.ID))
+}
+
+// advertiseIndieAuth lets IndieAuth clients find the endpoints from the home
+// page of a blog, whose template may not have <link>s to them.
+func advertiseIndieAuth(w http.ResponseWriter) {
+	w.Header().Add("Link", "<"+indieAuthMetadataURL()+`>; rel="indieauth-metadata"`)
+	w.Header().Add("Link", "<"+indieAuthAuthorizationEndpoint()+`>; rel="authorization_endpoint"`)
+	w.Header().Add("Link", "<"+indieAuthTokenEndpoint()+`>; rel="token_endpoint"`)
+}
+
+// IndieAuthMetadata describes the authorization server, see
+// https://indieauth.spec.indieweb.org/#indieauth-server-metadata.
+func IndieAuthMetadata(w http.ResponseWriter, r *http.Request) {
+	var scopes []string
+	for _, scope := range append(indieAuthScopes, apiScopes...) {
+		scopes = append(scopes, scope.Name)
+	}
+
+	writeAPIJSON(w, map[string]any{
+		"issuer":                 indieAuthIssuer(),
+		"authorization_endpoint": indieAuthAuthorizationEndpoint(),
+		"token_endpoint":         indieAuthTokenEndpoint(),
+		"revocation_endpoint":    indieAuthRevocationEndpoint(),
+		"revocation_endpoint_auth_methods_supported":     []string{"none"},
+		"scopes_supported":                               scopes,
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          []string{"authorization_code"},
+		"code_challenge_methods_supported":               []string{"S256"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+// indieAuthRequest is the authorization request of a client, see
+// https://indieauth.spec.indieweb.org/#authorization-request.
+type indieAuthRequest struct {
+	ClientID      string
+	RedirectURI   string
+	State         string
+	CodeChallenge string
+	// the scopes asked for that Kitty knows of, others are ignored
+	Scopes []string
+	// why the request can't be granted, told to the client
+	Error string
+}
+
+// parseIndieAuthRequest reads an authorization request. It only fails when
+// the client can't be sent back an error, because its client_id or its
+// redirect_uri isn't valid. Codes are only ever sent to the site of the
+// client, so that a client can't pass itself off as another.
+func parseIndieAuthRequest(values url.Values) (*indieAuthRequest, error) {
+	req := indieAuthRequest{
+		ClientID:      values.Get("client_id"),
+		RedirectURI:   values.Get("redirect_uri"),
+		State:         values.Get("state"),
+		CodeChallenge: values.Get("code_challenge"),
+	}
+
+	clientID, err := url.Parse(req.ClientID)
+	if err != nil || (clientID.Scheme != "https" && clientID.Scheme != "http") || clientID.Host == "" ||
+		clientID.User != nil || clientID.Fragment != "" {
+		return nil, errors.New("the app's client_id must be an http(s) URL")
+	}
+	redirectURI, err := url.Parse(req.RedirectURI)
+	if err != nil || redirectURI.Scheme != clientID.Scheme || !strings.EqualFold(redirectURI.Host, clientID.Host) ||
+		redirectURI.User != nil || redirectURI.Fragment != "" {
+		return nil, errors.New("the app's redirect_uri must be on the same site as its client_id")
+	}
+
+	for _, name := range strings.Fields(values.Get("scope")) {
+		if _, ok := indieAuthScope(name); ok && !scopeListed(req.Scopes, name) {
+			req.Scopes = append(req.Scopes, name)
+		}
+	}
+
+	// "id" is what the first version of the specification used
+	responseType := values.Get("response_type")
+	if responseType != "code" && responseType != "id" && responseType != "" {
+		req.Error = "response_type must be code"
+	} else if req.State == "" {
+		req.Error = "state is required"
+	} else if req.CodeChallenge == "" || values.Get("code_challenge_method") != "S256" {
+		req.Error = "PKCE is required, with the S256 code_challenge_method"
+	}
+	return &req, nil
+}
+
+func scopeListed(scopes []string, name string) bool {
+	for _, scope := range scopes {
+		if scope == name {
+			return true
+		}
+	}
+	return false
+}
+
+// signature binds the consent form to the signed in user and to the request,
+// so that other sites can't have someone allow their app without knowing.
+func (req *indieAuthRequest) signature(user *database.AdminUser) (string, error) {
+	settings, err := database.GetInstanceSettings()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, settings.SigningKey)
+	fmt.Fprintf(mac, "indieauth-consent:%d:%s", user.ID, user.SessionToken)
+	for _, value := range []string{req.ClientID, req.RedirectURI, req.State, req.CodeChallenge, strings.Join(req.Scopes, " ")} {
+		fmt.Fprintf(mac, ":%d:%s", len(value), value)
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// redirect sends the user back to the client with params, along with the
+// state and the issuer every response carries.
+func (req *indieAuthRequest) redirect(w http.ResponseWriter, r *http.Request, params url.Values) {
+	redirectURI, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	query := redirectURI.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	query.Set("state", req.State)
+	query.Set("iss", indieAuthIssuer())
+	redirectURI.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+type indieAuthConsentData struct {
+	Request indieAuthRequest
+	// the app, as far as the user can tell
+	ClientHost string
+	Me         string
+	Scopes     []apiScope
+	// the scopes asked for, sent back with the answer
+	Scope     string
+	Signature string
+}
+
+// DashboardIndieAuth asks the user whether to sign in to an app, and to give
+// it the scopes it asks for. The authorization endpoint sends users here.
+func DashboardIndieAuth(w http.ResponseWriter, r *http.Request) {
+	user := getSignedInUserOrFail(r)
+	if user.IsSuspended() {
+		http.Error(w, "This account has been suspended", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		req, err := parseIndieAuthRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, asSentence(err.Error()), http.StatusBadRequest)
+			return
+		} else if req.Error != "" {
+			req.redirect(w, r, url.Values{"error": {"invalid_request"}, "error_description": {req.Error}})
+			return
+		}
+
+		signature, err := req.signature(user)
+		if err != nil {
+			http.Error(w, "Error signing in", http.StatusInternalServerError)
+			return
+		}
+
+		data := indieAuthConsentData{
+			Request:   *req,
+			Me:        indieAuthProfileURL(user),
+			Scope:     strings.Join(req.Scopes, " "),
+			Signature: signature,
+		}
+		clientID, _ := url.Parse(req.ClientID)
+		data.ClientHost = clientID.Host
+		for _, name := range req.Scopes {
+			scope, _ := indieAuthScope(name)
+			data.Scopes = append(data.Scopes, scope)
+		}
+
+		// the buttons mustn't be clickable from another site
+		w.Header().Set("X-Frame-Options", "DENY")
+		RenderTemplate(w, r, "dashboard/indieauth", data)
+
+	case "POST":
+		r.ParseForm()
+		req, err := parseIndieAuthRequest(r.PostForm)
+		if err != nil || req.Error != "" {
+			http.Error(w, "Invalid sign in request", http.StatusBadRequest)
+			return
+		}
+
+		signature, err := req.signature(user)
+		if err != nil {
+			http.Error(w, "Error signing in", http.StatusInternalServerError)
+			return
+		}
+		if !hmac.Equal([]byte(signature), []byte(r.PostFormValue("signature"))) {
+			http.Error(w, "This sign in request is no longer valid, please start again from the app", http.StatusBadRequest)
+			return
+		}
+
+		if r.PostFormValue("decision") != "allow" {
+			req.redirect(w, r, url.Values{"error": {"access_denied"}})
+			return
+		}
+
+		var granted []string
+		for _, name := range r.PostForm["granted"] {
+			if scopeListed(req.Scopes, name) && !scopeListed(granted, name) {
+				granted = append(granted, name)
+			}
+		}
+
+		secret, err := generateAuthToken()
+		if err != nil {
+			http.Error(w, "Error signing in", http.StatusInternalServerError)
+			return
+		}
+		code := database.IndieAuthCode{
+			AdminUserID:   user.ID,
+			ClientID:      req.ClientID,
+			RedirectURI:   req.RedirectURI,
+			Scope:         strings.Join(granted, " "),
+			CodeChallenge: req.CodeChallenge,
+			ExpiresAt:     time.Now().Add(indieAuthCodeTTL),
+		}
+		if err := database.CreateIndieAuthCode(&code, secret); err != nil {
+			http.Error(w, "Error signing in", http.StatusInternalServerError)
+			return
+		}
+
+		req.redirect(w, r, url.Values{"code": {secret}})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkCodeVerifier reports whether verifier is the one challenge was made
+// from, see RFC 7636.
+func checkCodeVerifier(challenge string, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// redeemIndieAuthCode checks the code a client sent along with the details
+// of its request, returning the code and its user. It writes an error and
+// returns nils when the code can't be redeemed.
+func redeemIndieAuthCode(w http.ResponseWriter, r *http.Request) (*database.IndieAuthCode, *database.AdminUser) {
+	if grantType := r.PostFormValue("grant_type"); grantType != "authorization_code" && grantType != "" {
+		apiError(w, http.StatusBadRequest, "unsupported_grant_type", "Only the authorization_code grant type is supported")
+		return nil, nil
+	}
+
+	code, err := database.ConsumeIndieAuthCode(r.PostFormValue("code"))
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error checking the code")
+		return nil, nil
+	}
+	if code == nil || code.ClientID != r.PostFormValue("client_id") || code.RedirectURI != r.PostFormValue("redirect_uri") ||
+		!checkCodeVerifier(code.CodeChallenge, r.PostFormValue("code_verifier")) {
+		apiError(w, http.StatusBadRequest, "invalid_grant", "The code is invalid, expired, or was issued for another request")
+		return nil, nil
+	}
+
+	var user database.AdminUser
+	result := database.GetDB().First(&user, code.AdminUserID)
+	if result.Error != nil || user.IsSuspended() {
+		apiError(w, http.StatusBadRequest, "invalid_grant", "The account is no longer available")
+		return nil, nil
+	}
+	return code, &user
+}
+
+// indieAuthProfile is the response to a redeemed code, the profile URL of the
+// user, with their name and email when the client was allowed to see them.
+func indieAuthProfile(code *database.IndieAuthCode, user *database.AdminUser) map[string]any {
+	me := indieAuthProfileURL(user)
+	response := map[string]any{"me": me}
+	if code.HasScope("profile") {
+		profile := map[string]string{"name": user.Username, "url": me}
+		if code.HasScope("email") && user.EmailVerifiedAt != nil {
+			profile["email"] = user.Email
+		}
+		response["profile"] = profile
+	}
+	return response
+}
+
+// IndieAuthAuthorize is the authorization endpoint. Users are sent to the
+// consent screen of the dashboard, and clients that only want to know who the
+// user is redeem their code here.
+func IndieAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		http.Redirect(w, r, "/dashboard/indieauth?"+r.URL.RawQuery, http.StatusFound)
+
+	case "POST":
+		code, user := redeemIndieAuthCode(w, r)
+		if code == nil {
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeAPIJSON(w, indieAuthProfile(code, user))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// IndieAuthToken is the token endpoint, which exchanges codes for API tokens.
+// Tokens can also be checked with a GET, as clients of older versions of the
+// specification do, and revoked.
+func IndieAuthToken(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		token, user, err := authenticateAPIRequest(r)
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, "server_error", "Error checking the access token")
+			return
+		} else if token == nil {
+			apiError(w, http.StatusUnauthorized, "unauthorized", "A valid access token is required")
+			return
+		}
+		writeAPIJSON(w, map[string]string{
+			"me":        indieAuthProfileURL(user),
+			"client_id": token.ClientID,
+			"scope":     token.Scope,
+		})
+
+	case "POST":
+		if r.PostFormValue("action") == "revoke" {
+			IndieAuthRevoke(w, r)
+			return
+		}
+
+		code, user := redeemIndieAuthCode(w, r)
+		if code == nil {
+			return
+		}
+		if code.Scope == "" {
+			apiError(w, http.StatusBadRequest, "invalid_grant", "No scope was granted, the code can only be redeemed at the authorization endpoint")
+			return
+		}
+
+		secret, err := generateAuthToken()
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, "server_error", "Error creating the token")
+			return
+		}
+		clientID, _ := url.Parse(code.ClientID)
+		token := database.APIToken{
+			AdminUserID: user.ID,
+			Name:        clientID.Host,
+			Scope:       code.Scope,
+			ClientID:    code.ClientID,
+		}
+		if err := database.CreateAPIToken(&token, secret); err != nil {
+			apiError(w, http.StatusInternalServerError, "server_error", "Error creating the token")
+			return
+		}
+
+		response := indieAuthProfile(code, user)
+		response["access_token"] = secret
+		response["token_type"] = "Bearer"
+		response["scope"] = code.Scope
+		w.Header().Set("Cache-Control", "no-store")
+		writeAPIJSON(w, response)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// IndieAuthRevoke revokes the token a client gives up. Unknown tokens are
+// not an error, see RFC 7009.
+func IndieAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := database.RevokeAPITokenBySecret(r.PostFormValue("token")); err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error revoking the token")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,268 @@
+package site
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"kitty/database"
+)
+
+const (
+	testIndieAuthClientID    = "https://app.example.com/"
+	testIndieAuthRedirectURI = "https://app.example.com/callback"
+	testCodeVerifier         = "verifier-verifier-verifier-verifier-verifier"
+)
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// indieAuthRequestValues is the authorization request of the test client,
+// as the consent form sends it back.
+func indieAuthRequestValues() url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {testIndieAuthClientID},
+		"redirect_uri":          {testIndieAuthRedirectURI},
+		"state":                 {"state"},
+		"code_challenge":        {codeChallenge(testCodeVerifier)},
+		"code_challenge_method": {"S256"},
+		"scope":                 {"create"},
+	}
+}
+
+// postIndieAuthConsent answers the consent form as user, with the given
+// signature.
+func postIndieAuthConsent(user *database.AdminUser, values url.Values, signature string) *httptest.ResponseRecorder {
+	form := url.Values{}
+	for name, value := range values {
+		form[name] = value
+	}
+	form.Set("signature", signature)
+	form.Set("decision", "allow")
+	form.Set("granted", "create")
+
+	rec := httptest.NewRecorder()
+	DashboardIndieAuth(rec, signedInRequest("POST", "/dashboard/indieauth", strings.NewReader(form.Encode()), user))
+	return rec
+}
+
+func consentSignature(t *testing.T, user *database.AdminUser, values url.Values) string {
+	t.Helper()
+
+	req, err := parseIndieAuthRequest(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := req.signature(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+// issueIndieAuthCode has user allow the test client and returns the code it
+// was sent.
+func issueIndieAuthCode(t *testing.T, user *database.AdminUser) string {
+	t.Helper()
+
+	values := indieAuthRequestValues()
+	rec := postIndieAuthConsent(user, values, consentSignature(t, user, values))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("consent: status = %d, want %d: %s", rec.Code, http.StatusFound, rec.Body.String())
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("consent redirected to %q, want a code", location)
+	}
+	return code
+}
+
+// redeemAtTokenEndpoint exchanges code for a token, with the test client's
+// details overridden by changes.
+func redeemAtTokenEndpoint(code string, changes url.Values) *httptest.ResponseRecorder {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {testIndieAuthClientID},
+		"redirect_uri":  {testIndieAuthRedirectURI},
+		"code_verifier": {testCodeVerifier},
+	}
+	for name, value := range changes {
+		form[name] = value
+	}
+
+	req := httptest.NewRequest("POST", "/indieauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	IndieAuthToken(rec, req)
+	return rec
+}
+
+func TestCheckCodeVerifier(t *testing.T) {
+	short := "short-verifier"
+
+	tests := []struct {
+		name      string
+		challenge string
+		verifier  string
+		want      bool
+	}{
+		{"matching verifier", codeChallenge(testCodeVerifier), testCodeVerifier, true},
+		{"wrong verifier", codeChallenge(testCodeVerifier), testCodeVerifier + "-other", false},
+		{"short verifier", codeChallenge(short), short, false},
+		{"long verifier", codeChallenge(strings.Repeat("a", 129)), strings.Repeat("a", 129), false},
+		{"empty verifier", codeChallenge(""), "", false},
+		{"plain challenge", testCodeVerifier, testCodeVerifier, false},
+	}
+
+	for _, tc := range tests {
+		if got := checkCodeVerifier(tc.challenge, tc.verifier); got != tc.want {
+			t.Errorf("%s: checkCodeVerifier() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIndieAuthCodeIsRedeemedOnce(t *testing.T) {
+	user := createTestUser(t, "indieauth-once")
+	code := issueIndieAuthCode(t, user)
+
+	rec := redeemAtTokenEndpoint(code, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first redemption: status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"access_token"`) {
+		t.Errorf("first redemption: body = %q, want an access token", rec.Body.String())
+	}
+
+	rec = redeemAtTokenEndpoint(code, nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_grant") {
+		t.Errorf("second redemption: status = %d, body = %q, want invalid_grant", rec.Code, rec.Body.String())
+	}
+}
+
+func TestIndieAuthCodeExpires(t *testing.T) {
+	user := createTestUser(t, "indieauth-expired")
+	code := issueIndieAuthCode(t, user)
+
+	result := database.GetDB().Model(&database.IndieAuthCode{}).Where("admin_user_id = ?", user.ID).
+		Update("expires_at", time.Now().Add(-time.Second))
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+
+	rec := redeemAtTokenEndpoint(code, nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_grant") {
+		t.Errorf("status = %d, body = %q, want invalid_grant", rec.Code, rec.Body.String())
+	}
+}
+
+func TestIndieAuthTokenEndpointChecksTheRequest(t *testing.T) {
+	user := createTestUser(t, "indieauth-mismatch")
+
+	tests := []struct {
+		name    string
+		changes url.Values
+	}{
+		{"another client_id", url.Values{"client_id": {"https://evil.example.com/"}}},
+		{"another redirect_uri", url.Values{"redirect_uri": {"https://app.example.com/other"}}},
+		{"wrong code_verifier", url.Values{"code_verifier": {testCodeVerifier + "-wrong"}}},
+		{"short code_verifier", url.Values{"code_verifier": {"short"}}},
+		{"no code_verifier", url.Values{"code_verifier": {""}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code := issueIndieAuthCode(t, user)
+
+			rec := redeemAtTokenEndpoint(code, tc.changes)
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_grant") {
+				t.Errorf("status = %d, body = %q, want invalid_grant", rec.Code, rec.Body.String())
+			}
+			if strings.Contains(rec.Body.String(), "access_token") {
+				t.Errorf("a token was issued: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestIndieAuthRefusesRedirectsToAnotherHost(t *testing.T) {
+	user := createTestUser(t, "indieauth-redirect")
+
+	tests := []struct {
+		name        string
+		redirectURI string
+	}{
+		{"another host", "https://evil.example.com/callback"},
+		{"subdomain of the client", "https://evil.app.example.com/callback"},
+		{"another scheme", "http://app.example.com/callback"},
+		{"userinfo", "https://app.example.com@evil.example.com/callback"},
+		{"relative", "/callback"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			values := indieAuthRequestValues()
+			values.Set("redirect_uri", tc.redirectURI)
+			if _, err := parseIndieAuthRequest(values); err == nil {
+				t.Errorf("parseIndieAuthRequest() accepted redirect_uri %q", tc.redirectURI)
+			}
+
+			rec := httptest.NewRecorder()
+			DashboardIndieAuth(rec, signedInRequest("GET", "/dashboard/indieauth?"+values.Encode(), nil, user))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			if location := rec.Header().Get("Location"); location != "" {
+				t.Errorf("redirected to %q", location)
+			}
+		})
+	}
+}
+
+func TestIndieAuthConsentRejectsForgedSignature(t *testing.T) {
+	user := createTestUser(t, "indieauth-victim")
+	other := createTestUser(t, "indieauth-attacker")
+	values := indieAuthRequestValues()
+
+	changed := indieAuthRequestValues()
+	changed.Set("state", "another-state")
+
+	signatures := map[string]string{
+		"made up":                    "forged",
+		"empty":                      "",
+		"signed for another user":    consentSignature(t, other, values),
+		"signed for another request": consentSignature(t, user, changed),
+	}
+
+	for name, signature := range signatures {
+		t.Run(name, func(t *testing.T) {
+			rec := postIndieAuthConsent(user, values, signature)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+			if location := rec.Header().Get("Location"); location != "" {
+				t.Errorf("redirected to %q", location)
+			}
+		})
+	}
+
+	var count int64
+	if err := database.GetDB().Model(&database.IndieAuthCode{}).Where("admin_user_id = ?", user.ID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d codes were issued for forged consents", count)
+	}
+}
@@ -0,0 +1,59 @@
+package site
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kitty/database"
+)
+
+// TestMain points the database at a scratch file, so that tests never touch
+// a real instance, and runs from the repository root where the templates are.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "kitty-site-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("KITTY_DATABASE", filepath.Join(dir, "kitty.db"))
+	if err := os.Chdir(".."); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+
+	database.CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// createTestUser stores a user without a password.
+func createTestUser(t *testing.T, username string) *database.AdminUser {
+	t.Helper()
+
+	sessionToken, err := generateAuthToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &database.AdminUser{Username: username, SessionToken: sessionToken}
+	if err := database.CreateUser(database.GetDB(), user); err != nil {
+		t.Fatalf("creating user %s: %v", username, err)
+	}
+	return user
+}
+
+// signedInRequest is a request made by user, as the authentication middleware
+// would pass it on.
+func signedInRequest(method string, target string, body io.Reader, user *database.AdminUser) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req.WithContext(context.WithValue(req.Context(), AuthenticatedUserCookieName, user))
+}
@@ -0,0 +1,90 @@
+package site
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"kitty/database"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxMediaFileSize = 10 << 20
+
+// mediaExtensions are the types of files that can be uploaded, all of them
+// images, with the extension their names get.
+var mediaExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+var errUnsupportedMedia = errors.New("only JPEG, PNG, GIF and WebP images can be uploaded")
+
+func mediaURL(file *database.MediaFile) string {
+	return PublicURL() + "/media/" + file.Name
+}
+
+// newMediaFile reads an uploaded image of the user, without storing it. The
+// type is sniffed from the content, whatever the client claims.
+func newMediaFile(user *database.AdminUser, upload multipart.File) (*database.MediaFile, error) {
+	data, err := io.ReadAll(io.LimitReader(upload, maxMediaFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxMediaFileSize {
+		return nil, errors.New("files can't be larger than 10 MB")
+	}
+
+	contentType := http.DetectContentType(data)
+	extension, ok := mediaExtensions[contentType]
+	if !ok {
+		return nil, errUnsupportedMedia
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+
+	return &database.MediaFile{
+		AdminUserID: user.ID,
+		Name:        hex.EncodeToString(random) + extension,
+		ContentType: contentType,
+		Data:        data,
+	}, nil
+}
+
+// saveMediaFile stores an uploaded image of the user, see newMediaFile.
+func saveMediaFile(user *database.AdminUser, upload multipart.File) (*database.MediaFile, error) {
+	file, err := newMediaFile(user, upload)
+	if err != nil {
+		return nil, err
+	}
+	if err := database.CreateMediaFile(file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// ServeMediaFile serves an uploaded file. Names are random and files never
+// change, so they can be cached for good.
+func ServeMediaFile(w http.ResponseWriter, r *http.Request) {
+	file, err := database.GetMediaFile(chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, "Error fetching file", http.StatusInternalServerError)
+		return
+	} else if file == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", file.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(file.Data)
+}
@@ -0,0 +1,159 @@
+package site
+
+import (
+	"kitty/database"
+	"kitty/render"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pageMeta describes a public page to search engines and to the sites
+// showing previews of links, it's rendered by the "page_meta" template.
+type pageMeta struct {
+	Title       string
+	Description string
+	// absolute URL of the page where search engines should index it
+	CanonicalURL string
+	// absolute URL, empty when there's no image
+	Image string
+	Lang  string
+	// the Open Graph type, "article" or "profile"
+	Type          string
+	Author        string
+	PublishedTime time.Time
+	ModifiedTime  time.Time
+	Tags          []string
+	// schema.org description of the page, encoded as JSON-LD
+	JSONLD map[string]any
+}
+
+// defaultLang is the language of pages that don't say otherwise.
+const defaultLang = "en"
+
+// userURLs returns the URL of the user's homepage and a function giving the
+// URL of their posts. They point at the user's blog when it's enabled, and at
+// their profile and /post pages otherwise.
+func userURLs(user *database.AdminUser) (string, func(post *database.Post) string, error) {
+	b, err := getBlog(user)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if b.Enabled {
+		canonicalBase, err := blogCanonicalBase(user)
+		if err != nil {
+			return "", nil, err
+		}
+		return canonicalBase + "/", func(post *database.Post) string {
+			return canonicalBase + "/" + url.PathEscape(post.Slug)
+		}, nil
+	}
+
+	return PublicURL() + "/u/" + strconv.Itoa(int(user.ID)), func(post *database.Post) string {
+		return PublicURL() + "/post/" + strconv.Itoa(int(post.ID))
+	}, nil
+}
+
+// absoluteImageURL resolves an image URL entered by a user against the public
+// URL. Anything that isn't http(s) is dropped, previews need to fetch it.
+func absoluteImageURL(image string) string {
+	image = strings.TrimSpace(image)
+	if image == "" {
+		return ""
+	}
+	base, err := url.Parse(PublicURL() + "/")
+	if err != nil {
+		return ""
+	}
+	ref, err := url.Parse(image)
+	if err != nil {
+		return ""
+	}
+	resolved := base.ResolveReference(ref)
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return ""
+	}
+	return resolved.String()
+}
+
+func postMeta(post *database.Post, author *database.AdminUser) (*pageMeta, error) {
+	homeURL, postURL, err := userURLs(author)
+	if err != nil {
+		return nil, err
+	}
+
+	// the content of protected posts is only described by their author
+	description := post.MetaDescription
+	if description == "" && !post.IsPasswordProtected() {
+		description = render.Summarize(post.Body, effectiveRenderOptions(post, author)).Excerpt
+	}
+	lang := strings.TrimSpace(post.Lang)
+	if lang == "" {
+		lang = defaultLang
+	}
+
+	meta := &pageMeta{
+		Title:         post.Title,
+		Description:   description,
+		CanonicalURL:  postURL(post),
+		Image:         absoluteImageURL(post.MetaImage),
+		Lang:          lang,
+		Type:          "article",
+		Author:        author.Username,
+		PublishedTime: post.PublishedDate,
+		ModifiedTime:  post.UpdatedAt,
+		Tags:          tagNames(post.Tags),
+	}
+
+	jsonLD := map[string]any{
+		"@context":         "https://schema.org",
+		"@type":            "BlogPosting",
+		"headline":         meta.Title,
+		"url":              meta.CanonicalURL,
+		"mainEntityOfPage": meta.CanonicalURL,
+		"inLanguage":       meta.Lang,
+		"datePublished":    meta.PublishedTime.UTC().Format(time.RFC3339),
+		"dateModified":     meta.ModifiedTime.UTC().Format(time.RFC3339),
+		"author": map[string]any{
+			"@type": "Person",
+			"name":  meta.Author,
+			"url":   homeURL,
+		},
+	}
+	if meta.Description != "" {
+		jsonLD["description"] = meta.Description
+	}
+	if meta.Image != "" {
+		jsonLD["image"] = meta.Image
+	}
+	if len(meta.Tags) > 0 {
+		jsonLD["keywords"] = meta.Tags
+	}
+	meta.JSONLD = jsonLD
+
+	return meta, nil
+}
+
+func userMeta(user *database.AdminUser) *pageMeta {
+	canonicalURL := PublicURL() + "/u/" + strconv.Itoa(int(user.ID))
+	return &pageMeta{
+		Title:        user.Username + "'s posts",
+		Description:  "Posts written by " + user.Username + ".",
+		CanonicalURL: canonicalURL,
+		Lang:         defaultLang,
+		Type:         "profile",
+		Author:       user.Username,
+		JSONLD: map[string]any{
+			"@context": "https://schema.org",
+			"@type":    "ProfilePage",
+			"url":      canonicalURL,
+			"mainEntity": map[string]any{
+				"@type": "Person",
+				"name":  user.Username,
+				"url":   canonicalURL,
+			},
+		},
+	}
+}
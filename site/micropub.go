@@ -0,0 +1,724 @@
+package site
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kitty/constants"
+	"kitty/database"
+	"kitty/webmention"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gosimple/slug"
+	"gorm.io/gorm"
+)
+
+const (
+	maxMicropubRequestSize = 1 << 20
+	// titles taken from the content of notes are cut at this length
+	micropubTitleLength = 60
+)
+
+func micropubEndpoint() string {
+	return PublicURL() + "/micropub"
+}
+
+func micropubMediaEndpoint() string {
+	return PublicURL() + "/micropub/media"
+}
+
+// advertiseMicropubEndpoint lets Micropub clients find the endpoint from the
+// home page of a blog, whose template may not have a <link> to it.
+func advertiseMicropubEndpoint(w http.ResponseWriter) {
+	w.Header().Add("Link", "<"+micropubEndpoint()+`>; rel="micropub"`)
+}
+
+// limitMicropubRequest caps the size of the body before anything reads it,
+// the access token included. Multipart requests can carry a photo.
+func limitMicropubRequest(w http.ResponseWriter, r *http.Request) {
+	limit := int64(maxMicropubRequestSize)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		limit += maxMediaFileSize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+}
+
+// micropubRequest is a Micropub request, either sent as JSON or converted from
+// a form. Property values are strings, or objects like {"html": "..."}.
+type micropubRequest struct {
+	Type       []string         `json:"type"`
+	Properties map[string][]any `json:"properties"`
+	Action     string           `json:"action"`
+	URL        string           `json:"url"`
+	Replace    map[string][]any `json:"replace"`
+	Add        map[string][]any `json:"add"`
+	// either a list of property names or property values to remove
+	Delete json.RawMessage `json:"delete"`
+	// photos uploaded with a multipart request, only saved once a post using
+	// them is created
+	Uploads []*multipart.FileHeader `json:"-"`
+}
+
+// errMicropubContentTooLong is checked against the final body of a post,
+// photos included.
+var errMicropubContentTooLong = fmt.Errorf("the content can't be longer than %d characters", constants.MAX_POST_LENGTH)
+
+// micropubReservedFields are form fields that aren't properties.
+var micropubReservedFields = map[string]bool{"access_token": true, "h": true, "action": true, "url": true}
+
+// parseMicropubRequest reads a JSON, form or multipart request, whose size
+// was limited by limitMicropubRequest. Photos uploaded with a multipart
+// request are kept in Uploads.
+func parseMicropubRequest(r *http.Request) (*micropubRequest, error) {
+	var req micropubRequest
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, errors.New("the request isn't valid JSON")
+		}
+		return &req, nil
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(maxMicropubRequestSize); err != nil {
+			return nil, errors.New("the request isn't a valid form")
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return nil, errors.New("the request isn't a valid form")
+		}
+	}
+
+	req.Action = r.PostForm.Get("action")
+	req.URL = r.PostForm.Get("url")
+	if h := r.PostForm.Get("h"); h != "" {
+		req.Type = []string{"h-" + h}
+	}
+	req.Properties = map[string][]any{}
+	for name, values := range r.PostForm {
+		if micropubReservedFields[name] {
+			continue
+		}
+		name = strings.TrimSuffix(name, "[]")
+		for _, value := range values {
+			req.Properties[name] = append(req.Properties[name], value)
+		}
+	}
+
+	if r.MultipartForm != nil {
+		for _, name := range []string{"photo", "photo[]"} {
+			req.Uploads = append(req.Uploads, r.MultipartForm.File[name]...)
+		}
+	}
+
+	return &req, nil
+}
+
+// micropubString returns the text of a property value, which is either a
+// string or an object like {"html": "..."} or {"value": "...", "alt": "..."}.
+func micropubString(value any) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case map[string]any:
+		for _, key := range []string{"html", "value", "text"} {
+			if s, ok := v[key].(string); ok {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
+
+func micropubStrings(name string, values []any) ([]string, error) {
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		s, ok := micropubString(value)
+		if !ok {
+			return nil, fmt.Errorf("%s must be text", name)
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+func micropubFirstString(name string, values []any) (string, error) {
+	strs, err := micropubStrings(name, values)
+	if err != nil {
+		return "", err
+	}
+	if len(strs) == 0 {
+		return "", fmt.Errorf("%s is empty", name)
+	}
+	return strs[0], nil
+}
+
+// micropubPhotoMarkdown returns the Markdown showing photo, a URL or an
+// object with the URL and an alternative text.
+func micropubPhotoMarkdown(photo any) (string, string, error) {
+	photoURL, ok := micropubString(photo)
+	if !ok || !webmention.IsHTTPURL(photoURL) {
+		return "", "", errors.New("photo must be an http(s) URL")
+	}
+	alt := ""
+	if object, ok := photo.(map[string]any); ok {
+		alt, _ = object["alt"].(string)
+	}
+	alt = strings.NewReplacer("[", "", "]", "", "\n", " ").Replace(alt)
+	photoURL = strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29").Replace(photoURL)
+	return "![" + alt + "](" + photoURL + ")", photoURL, nil
+}
+
+// applyMicropubProperty sets the field of post matching an h-entry
+// property. Properties Kitty has no use for are ignored.
+func applyMicropubProperty(post *database.Post, tags *[]string, name string, values []any) error {
+	switch name {
+	case "name":
+		title, err := micropubFirstString(name, values)
+		if err != nil {
+			return err
+		}
+		post.Title = strings.TrimSpace(title)
+
+	case "content":
+		content, err := micropubFirstString(name, values)
+		if err != nil {
+			return err
+		}
+		post.Body = content
+
+	case "summary":
+		summary, err := micropubFirstString(name, values)
+		if err != nil {
+			return err
+		}
+		post.MetaDescription = summary
+
+	case "published":
+		value, err := micropubFirstString(name, values)
+		if err != nil {
+			return err
+		}
+		published, err := tryParseDate(value)
+		if err != nil {
+			return errors.New("published must be an ISO 8601 date")
+		}
+		post.PublishedDate = published
+
+	case "post-status":
+		status, err := micropubFirstString(name, values)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case "published":
+			post.Published = true
+		case "draft":
+			post.Published = false
+		default:
+			return errors.New("post-status must be published or draft")
+		}
+
+	case "visibility":
+		visibility, err := micropubFirstString(name, values)
+		if err != nil {
+			return err
+		}
+		if !database.IsValidPostVisibility(database.PostVisibility(visibility)) {
+			return errors.New("visibility must be public, unlisted or private")
+		}
+		post.Visibility = database.PostVisibility(visibility)
+
+	case "mp-slug":
+		value, err := micropubFirstString(name, values)
+		if err != nil {
+			return err
+		}
+		post.Slug = slug.Make(value)
+
+	case "category":
+		names, err := micropubStrings(name, values)
+		if err != nil {
+			return err
+		}
+		*tags, err = validateTagNames(names)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// micropubTitle makes up a title for notes, which only have content.
+func micropubTitle(content string) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(content), "\n")
+	title = strings.TrimSpace(strings.TrimLeft(title, "#>*- "))
+	if utf8.RuneCountInString(title) > micropubTitleLength {
+		title = strings.TrimSpace(string([]rune(title)[:micropubTitleLength])) + "…"
+	}
+	return title
+}
+
+// uniquePostSlug returns base, or base with a number appended when another
+// post has it already.
+func uniquePostSlug(base string, postID uint) (string, error) {
+	candidate := base
+	for i := 2; ; i++ {
+		existing, err := database.GetPostWithSlug(candidate)
+		if err != nil {
+			return "", err
+		}
+		if existing == nil || existing.ID == postID {
+			return candidate, nil
+		}
+		candidate = base + "-" + strconv.Itoa(i)
+	}
+}
+
+// micropubPostURL is the URL of a post given to Micropub clients, the one of
+// its blog when it has one.
+func micropubPostURL(post *database.Post, user *database.AdminUser) (string, error) {
+	if !post.IsReadableByURL() {
+		return PublicURL() + "/post/" + strconv.Itoa(int(post.ID)), nil
+	}
+	_, postURL, err := userURLs(user)
+	if err != nil {
+		return "", err
+	}
+	return postURL(post), nil
+}
+
+// Micropub lets clients publish and edit posts on behalf of a user, see
+// https://www.w3.org/TR/micropub/.
+func Micropub(w http.ResponseWriter, r *http.Request) {
+	limitMicropubRequest(w, r)
+	token, user, err := authenticateAPIRequest(r)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error checking the access token")
+		return
+	} else if token == nil {
+		apiError(w, http.StatusUnauthorized, "unauthorized", "A valid access token is required")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		micropubQuery(w, r, user)
+
+	case "POST":
+		req, err := parseMicropubRequest(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		switch req.Action {
+		case "", "create":
+			if !token.HasScope("create") && !token.HasScope("draft") {
+				apiError(w, http.StatusForbidden, "insufficient_scope", "The token doesn't allow creating posts")
+				return
+			}
+			micropubCreate(w, req, user, !token.HasScope("create"))
+		case "update":
+			if !token.HasScope("update") {
+				apiError(w, http.StatusForbidden, "insufficient_scope", "The token doesn't allow updating posts")
+				return
+			}
+			micropubUpdate(w, req, user)
+		case "delete":
+			if !token.HasScope("delete") {
+				apiError(w, http.StatusForbidden, "insufficient_scope", "The token doesn't allow deleting posts")
+				return
+			}
+			micropubDelete(w, req, user)
+		default:
+			apiError(w, http.StatusBadRequest, "invalid_request", "Unsupported action: "+req.Action)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func micropubQuery(w http.ResponseWriter, r *http.Request, user *database.AdminUser) {
+	switch r.URL.Query().Get("q") {
+	case "config":
+		writeAPIJSON(w, map[string]any{
+			"media-endpoint": micropubMediaEndpoint(),
+			"syndicate-to":   []any{},
+			"q":              []string{"config", "source", "syndicate-to"},
+			"post-types": []map[string]string{
+				{"type": "note", "name": "Note"},
+				{"type": "article", "name": "Article"},
+				{"type": "photo", "name": "Photo"},
+			},
+		})
+
+	case "syndicate-to":
+		writeAPIJSON(w, map[string]any{"syndicate-to": []any{}})
+
+	case "source":
+		post, err := micropubOwnPost(w, r.URL.Query().Get("url"), user)
+		if post == nil || err != nil {
+			return
+		}
+
+		properties := map[string][]any{
+			"name":        {post.Title},
+			"content":     {post.Body},
+			"published":   {post.PublishedDate.Format(time.RFC3339)},
+			"post-status": {"draft"},
+			"visibility":  {string(post.Visibility)},
+			"mp-slug":     {post.Slug},
+		}
+		if post.Published {
+			properties["post-status"] = []any{"published"}
+		}
+		if post.MetaDescription != "" {
+			properties["summary"] = []any{post.MetaDescription}
+		}
+		for _, tag := range post.Tags {
+			properties["category"] = append(properties["category"], tag.Name)
+		}
+
+		// clients can ask for some properties only
+		if wanted := r.URL.Query()["properties[]"]; len(wanted) > 0 {
+			filtered := map[string][]any{}
+			for _, name := range wanted {
+				if values, ok := properties[name]; ok {
+					filtered[name] = values
+				}
+			}
+			writeAPIJSON(w, map[string]any{"properties": filtered})
+			return
+		}
+		writeAPIJSON(w, map[string]any{"type": []string{"h-entry"}, "properties": properties})
+
+	default:
+		apiError(w, http.StatusBadRequest, "invalid_request", "Unsupported query, q must be config, source or syndicate-to")
+	}
+}
+
+// micropubOwnPost loads the user's post at postURL, with its tags. It writes
+// an error and returns nil if there's no such post.
+func micropubOwnPost(w http.ResponseWriter, postURL string, user *database.AdminUser) (*database.Post, error) {
+	post, err := findPostByURL(postURL)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error fetching the post")
+		return nil, err
+	} else if post == nil {
+		apiError(w, http.StatusBadRequest, "invalid_request", "url isn't the URL of a post")
+		return nil, nil
+	} else if post.AdminUserID != user.ID {
+		apiError(w, http.StatusForbidden, "forbidden", "The post belongs to someone else")
+		return nil, nil
+	}
+
+	result := database.GetDB().Preload("Tags").First(post, post.ID)
+	if result.Error != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error fetching the post")
+		return nil, result.Error
+	}
+	return post, nil
+}
+
+func micropubCreate(w http.ResponseWriter, req *micropubRequest, user *database.AdminUser, draftOnly bool) {
+	if len(req.Type) > 0 && req.Type[0] != "h-entry" {
+		apiError(w, http.StatusBadRequest, "invalid_request", "Only h-entry posts are supported")
+		return
+	}
+
+	post := database.Post{
+		AdminUserID:   user.ID,
+		PublishedDate: time.Now(),
+		Published:     true,
+		Visibility:    database.PostVisibilityPublic,
+	}
+	var tags []string
+	for name, values := range req.Properties {
+		if err := applyMicropubProperty(&post, &tags, name, values); err != nil {
+			apiError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+	}
+	if draftOnly {
+		post.Published = false
+	}
+
+	// uploaded photos are only stored along with the post
+	photos := req.Properties["photo"]
+	var media []*database.MediaFile
+	for _, header := range req.Uploads {
+		upload, err := header.Open()
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, "server_error", "Error reading the photo")
+			return
+		}
+		file, err := newMediaFile(user, upload)
+		upload.Close()
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		media = append(media, file)
+		photos = append(photos, mediaURL(file))
+	}
+
+	for _, photo := range photos {
+		markdown, photoURL, err := micropubPhotoMarkdown(photo)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		post.Body = strings.TrimSpace(post.Body + "\n\n" + markdown)
+		if post.MetaImage == "" {
+			post.MetaImage = photoURL
+		}
+	}
+	if len(post.Body) > constants.MAX_POST_LENGTH {
+		apiError(w, http.StatusBadRequest, "invalid_request", errMicropubContentTooLong.Error())
+		return
+	}
+
+	if post.Title == "" {
+		post.Title = micropubTitle(post.Body)
+	}
+	if post.Title == "" {
+		apiError(w, http.StatusBadRequest, "invalid_request", "The post needs a name, content or a photo")
+		return
+	}
+
+	base := post.Slug
+	if base == "" {
+		base = slug.Make(post.Title)
+	}
+	postSlug, err := uniquePostSlug(base, 0)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error creating the post")
+		return
+	}
+	post.Slug = postSlug
+
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		for _, file := range media {
+			if err := tx.Create(file).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(&post).Error; err != nil {
+			return err
+		}
+		return database.SetPostTags(tx, &post, tags)
+	})
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error creating the post")
+		return
+	}
+
+	sendPostWebmentions(nil, &post, user)
+
+	location, err := micropubPostURL(&post, user)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error creating the post")
+		return
+	}
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func micropubUpdate(w http.ResponseWriter, req *micropubRequest, user *database.AdminUser) {
+	post, err := micropubOwnPost(w, req.URL, user)
+	if post == nil || err != nil {
+		return
+	}
+	previousPost := *post
+	previousURL, err := micropubPostURL(post, user)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error updating the post")
+		return
+	}
+
+	tags := tagNames(post.Tags)
+	for name, values := range req.Replace {
+		if err := applyMicropubProperty(post, &tags, name, values); err != nil {
+			apiError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+	}
+
+	for name, values := range req.Add {
+		if name != "category" {
+			apiError(w, http.StatusBadRequest, "invalid_request", "Only category values can be added, replace "+name+" instead")
+			return
+		}
+		added, err := micropubStrings(name, values)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		if tags, err = validateTagNames(append(tags, added...)); err != nil {
+			apiError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+	}
+
+	if err := micropubDeleteProperties(post, &tags, req.Delete); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	if post.Title == "" {
+		apiError(w, http.StatusBadRequest, "invalid_request", "The post can't be left without a name")
+		return
+	}
+	if len(post.Body) > constants.MAX_POST_LENGTH {
+		apiError(w, http.StatusBadRequest, "invalid_request", errMicropubContentTooLong.Error())
+		return
+	}
+	if post.Slug == "" {
+		post.Slug = slug.Make(post.Title)
+	}
+	if post.Slug, err = uniquePostSlug(post.Slug, post.ID); err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error updating the post")
+		return
+	}
+
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Tags", "Series", "Upvotes").Save(post).Error; err != nil {
+			return err
+		}
+		return database.SetPostTags(tx, post, tags)
+	})
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error updating the post")
+		return
+	}
+
+	forgetRenderedPost(&previousPost, user)
+	sendPostWebmentions(&previousPost, post, user)
+
+	location, err := micropubPostURL(post, user)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error updating the post")
+		return
+	}
+	if location != previousURL {
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// micropubDeleteProperties applies the "delete" of an update, which is
+// either a list of properties to remove or values to remove from them.
+func micropubDeleteProperties(post *database.Post, tags *[]string, raw json.RawMessage) error {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	var names []string
+	if json.Unmarshal(raw, &names) == nil {
+		for _, name := range names {
+			switch name {
+			case "category":
+				*tags = nil
+			case "summary":
+				post.MetaDescription = ""
+			case "content":
+				post.Body = ""
+			default:
+				return errors.New("only category, summary and content can be deleted")
+			}
+		}
+		return nil
+	}
+
+	var values map[string][]any
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return errors.New("delete must be a list of properties or an object of values")
+	}
+	for name, removed := range values {
+		if name != "category" {
+			return errors.New("only category values can be deleted")
+		}
+		removedNames, err := micropubStrings(name, removed)
+		if err != nil {
+			return err
+		}
+		kept := []string{}
+		for _, tag := range *tags {
+			keep := true
+			for _, r := range removedNames {
+				if database.TagSlug(r) == database.TagSlug(tag) {
+					keep = false
+				}
+			}
+			if keep {
+				kept = append(kept, tag)
+			}
+		}
+		*tags = kept
+	}
+	return nil
+}
+
+func micropubDelete(w http.ResponseWriter, req *micropubRequest, user *database.AdminUser) {
+	post, err := micropubOwnPost(w, req.URL, user)
+	if post == nil || err != nil {
+		return
+	}
+
+	if err := database.DeletePost(post); err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error deleting the post")
+		return
+	}
+	forgetRenderedPost(post, user)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MicropubMedia is the Micropub media endpoint, it takes an image uploaded as
+// "file" and answers with its URL.
+func MicropubMedia(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxMediaFileSize+maxMicropubRequestSize)
+	token, user, err := authenticateAPIRequest(r)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "server_error", "Error checking the access token")
+		return
+	} else if token == nil {
+		apiError(w, http.StatusUnauthorized, "unauthorized", "A valid access token is required")
+		return
+	} else if !token.HasScope("media") && !token.HasScope("create") {
+		apiError(w, http.StatusForbidden, "insufficient_scope", "The token doesn't allow uploading files")
+		return
+	}
+
+	if err := r.ParseMultipartForm(maxMicropubRequestSize); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_request", "The file must be uploaded as \"file\", up to 10 MB")
+		return
+	}
+	upload, _, err := r.FormFile("file")
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_request", "The file must be uploaded as \"file\", up to 10 MB")
+		return
+	}
+	defer upload.Close()
+
+	file, err := saveMediaFile(user, upload)
+	if errors.Is(err, errUnsupportedMedia) {
+		apiError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	} else if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid_request", "Error saving the file: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Location", mediaURL(file))
+	w.WriteHeader(http.StatusCreated)
+}
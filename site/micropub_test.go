@@ -0,0 +1,169 @@
+package site
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"kitty/constants"
+	"kitty/database"
+)
+
+// countingReader counts how much of a request body a handler read.
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error { return nil }
+
+// createTestAPIToken gives user a token with the given scopes and returns
+// its value.
+func createTestAPIToken(t *testing.T, user *database.AdminUser, scope string) string {
+	t.Helper()
+
+	secret, err := generateAuthToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.CreateAPIToken(&database.APIToken{AdminUserID: user.ID, Name: "test", Scope: scope}, secret); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// postMicropubPhoto sends fields and a small PNG as "photo" to the Micropub
+// endpoint.
+func postMicropubPhoto(t *testing.T, secret string, fields map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	file, err := form.CreateFormFile("photo", "photo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(file, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/micropub", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+secret)
+	rec := httptest.NewRecorder()
+	Micropub(rec, req)
+	return rec
+}
+
+func countMediaFiles(t *testing.T, user *database.AdminUser) int64 {
+	t.Helper()
+
+	var count int64
+	if err := database.GetDB().Model(&database.MediaFile{}).Where("admin_user_id = ?", user.ID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestMicropubStoresPhotosOnlyWithTheirPost(t *testing.T) {
+	user := createTestUser(t, "micropub-photos")
+
+	deleteOnly := createTestAPIToken(t, user, "delete")
+	rec := postMicropubPhoto(t, deleteOnly, map[string]string{"h": "entry", "content": "sneaky"})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("create with a delete-only token: status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	rec = postMicropubPhoto(t, deleteOnly, map[string]string{"action": "delete", "url": "https://example.com/nothing"})
+	if rec.Code == http.StatusNoContent {
+		t.Errorf("delete of an unknown post succeeded")
+	}
+	if count := countMediaFiles(t, user); count != 0 {
+		t.Fatalf("a delete-only token stored %d files", count)
+	}
+
+	creator := createTestAPIToken(t, user, "create")
+	rec = postMicropubPhoto(t, creator, map[string]string{"h": "entry", "content": "invalid", "visibility": "everyone"})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("create of an invalid post: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if count := countMediaFiles(t, user); count != 0 {
+		t.Fatalf("a post failing validation left %d files behind", count)
+	}
+
+	rec = postMicropubPhoto(t, creator, map[string]string{"h": "entry", "name": "Photo", "content": "A photo"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create with a photo: status = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body.String())
+	}
+	if count := countMediaFiles(t, user); count != 1 {
+		t.Errorf("the created post stored %d files, want 1", count)
+	}
+}
+
+func TestMicropubLimitsBodyBeforeAuthenticating(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("access_token", "not-a-token")
+	file, err := form.CreateFormFile("photo", "big.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(bytes.Repeat([]byte{0}, 3*maxMediaFileSize))
+	form.Close()
+
+	limit := int64(maxMediaFileSize + maxMicropubRequestSize)
+	for _, handler := range []http.HandlerFunc{Micropub, MicropubMedia} {
+		counted := &countingReader{reader: bytes.NewReader(body.Bytes())}
+		req := httptest.NewRequest("POST", "/micropub", nil)
+		req.Body = counted
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+		}
+		if counted.read > limit+1 {
+			t.Errorf("read %d bytes of an anonymous upload, want at most %d", counted.read, limit)
+		}
+	}
+}
+
+func TestMicropubCountsPhotosInContentLength(t *testing.T) {
+	user := createTestUser(t, "micropub-length")
+	secret := createTestAPIToken(t, user, "create")
+
+	form := url.Values{
+		"h":       {"entry"},
+		"content": {strings.Repeat("a", constants.MAX_POST_LENGTH-10)},
+		"photo":   {"https://example.com/photo.png"},
+	}
+	req := httptest.NewRequest("POST", "/micropub", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+secret)
+	rec := httptest.NewRecorder()
+	Micropub(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), errMicropubContentTooLong.Error()) {
+		t.Errorf("body = %q, want the content length error", rec.Body.String())
+	}
+}
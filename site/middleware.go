@@ -3,24 +3,96 @@ package site
 import (
 	"context"
 	"kitty/database"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
+	"sync"
 )
 
-// RealIPMiddleware extracts the client's real IP address from the
-// X-Forwarded-For header and sets it on the request's RemoteAddr field. Useful
-// for when the app is running behind a reverse proxy
-func RealIPMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-			// This assumes the first IP in the X-Forwarded-For list is the client's real IP
-			// This may need to be adjusted depending on your reverse proxy setup
-			i := strings.Index(xff, ", ")
-			if i == -1 {
-				i = len(xff)
+// trustedProxies are the reverse proxies allowed to tell the client's address
+// in X-Forwarded-For, set with KITTY_TRUSTED_PROXIES as a comma separated list
+// of IP addresses and CIDR ranges. Without any, the header is ignored.
+var (
+	trustedProxies     []*net.IPNet
+	trustedProxiesOnce sync.Once
+)
+
+func getTrustedProxies() []*net.IPNet {
+	trustedProxiesOnce.Do(func() {
+		trustedProxies = parseTrustedProxies(os.Getenv("KITTY_TRUSTED_PROXIES"))
+	})
+	return trustedProxies
+}
+
+func parseTrustedProxies(value string) []*net.IPNet {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
 			}
-			r.RemoteAddr = xff[:i]
 		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid trusted proxy %q", entry)
+			continue
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+func isTrustedProxy(ip net.IP, proxies []*net.IPNet) bool {
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client behind a request coming from
+// remoteAddr. X-Forwarded-For is only believed when the request comes from
+// a trusted proxy, and read from the right since proxies append to it:
+// the first address that isn't a trusted proxy is the client, anything
+// before it may have been made up by the client.
+func clientIP(remoteAddr string, forwardedFor string, proxies []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+	if forwardedFor == "" || !isTrustedProxy(net.ParseIP(ip), proxies) {
+		return ip
+	}
+
+	hops := strings.Split(forwardedFor, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop.String()
+		if !isTrustedProxy(hop, proxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// RealIPMiddleware sets the request's RemoteAddr to the client's address, as
+// told by the trusted reverse proxies in front of the app, see clientIP.
+func RealIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = clientIP(r.RemoteAddr, strings.Join(r.Header.Values("X-Forwarded-For"), ","), getTrustedProxies())
 		next.ServeHTTP(w, r)
 	})
 }
@@ -37,14 +109,9 @@ func TryPutUserInContextMiddleware(next http.Handler) http.Handler {
 		// Validate the token and retrieve the corresponding user
 		var user database.AdminUser
 		result := database.GetDB().Where(&database.AdminUser{SessionToken: cookie.Value}).First(&user)
-		if result.Error != nil {
+		if result.Error != nil || user.IsSuspended() {
 			// Clear the invalid cookie
-			http.SetCookie(w, &http.Cookie{
-				Name:   string(AuthenticatedUserTokenCookieName),
-				Value:  "",
-				Path:   "/",
-				MaxAge: -1,
-			})
+			clearSessionCookie(w)
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -55,6 +122,16 @@ func TryPutUserInContextMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// redirectToSignIn sends the user to the sign in page, from where they come
+// back to the page they asked for if it can be loaded again.
+func redirectToSignIn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/signin?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+}
+
 func AuthProtectedMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// if logout then just continue
@@ -66,14 +143,14 @@ func AuthProtectedMiddleware(next http.Handler) http.Handler {
 		// check context for user
 		adminUser := getSignedInUserOrNil(r)
 		if adminUser == nil {
-			http.Redirect(w, r, "/signin", http.StatusSeeOther)
+			redirectToSignIn(w, r)
 			return
 		}
 
 		// try to set admin user into context
 		cookie, err := r.Cookie(string(AuthenticatedUserTokenCookieName))
 		if err != nil || cookie.Value == "" {
-			http.Redirect(w, r, "/signin", http.StatusSeeOther)
+			redirectToSignIn(w, r)
 			return
 		}
 
@@ -81,3 +158,17 @@ func AuthProtectedMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// AdminProtectedMiddleware only lets instance administrators through. Must be
+// used after AuthProtectedMiddleware.
+func AdminProtectedMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminUser := getSignedInUserOrNil(r)
+		if adminUser == nil || !adminUser.IsAdmin {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
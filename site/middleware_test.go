@@ -0,0 +1,92 @@
+package site
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies := parseTrustedProxies("10.0.0.1, 192.168.0.0/16,::1")
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		proxies      []*net.IPNet
+		want         string
+	}{
+		{
+			name:         "no trusted proxies",
+			remoteAddr:   "203.0.113.7:4321",
+			forwardedFor: "198.51.100.1",
+			want:         "203.0.113.7",
+		},
+		{
+			name:         "untrusted peer",
+			remoteAddr:   "203.0.113.7:4321",
+			forwardedFor: "198.51.100.1",
+			proxies:      proxies,
+			want:         "203.0.113.7",
+		},
+		{
+			name:         "trusted proxy",
+			remoteAddr:   "10.0.0.1:4321",
+			forwardedFor: "198.51.100.1",
+			proxies:      proxies,
+			want:         "198.51.100.1",
+		},
+		{
+			name:         "address made up by the client",
+			remoteAddr:   "10.0.0.1:4321",
+			forwardedFor: "1.2.3.4, 198.51.100.1",
+			proxies:      proxies,
+			want:         "198.51.100.1",
+		},
+		{
+			name:         "chain of trusted proxies",
+			remoteAddr:   "[::1]:4321",
+			forwardedFor: "1.2.3.4, 198.51.100.1, 192.168.1.2",
+			proxies:      proxies,
+			want:         "198.51.100.1",
+		},
+		{
+			name:         "garbage from the client",
+			remoteAddr:   "10.0.0.1:4321",
+			forwardedFor: "not an address, 198.51.100.1",
+			proxies:      proxies,
+			want:         "198.51.100.1",
+		},
+		{
+			name:       "trusted proxy without the header",
+			remoteAddr: "10.0.0.1:4321",
+			proxies:    proxies,
+			want:       "10.0.0.1",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := clientIP(tc.remoteAddr, tc.forwardedFor, tc.proxies); got != tc.want {
+				t.Errorf("clientIP(%q, %q) = %q, want %q", tc.remoteAddr, tc.forwardedFor, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRealIPMiddlewareIgnoresForwardedForByDefault(t *testing.T) {
+	var remoteAddr string
+	handler := RealIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+	}))
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "203.0.113.7:4321"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if remoteAddr != "203.0.113.7" {
+		t.Errorf("RemoteAddr = %q, want the socket peer 203.0.113.7", remoteAddr)
+	}
+}
@@ -0,0 +1,515 @@
+package site
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"kitty/constants"
+	"kitty/database"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+const (
+	oidcStateCookieName = "kitty_oidc_state"
+	oidcCallbackPath    = "/signin/oidc/callback"
+	oidcLoginTimeout    = 10 * time.Minute
+)
+
+const (
+	oidcIntentSignIn = "signin"
+	oidcIntentLink   = "link"
+)
+
+// oidcProvider is a single sign-on provider configured through environment
+// variables:
+//
+//   - KITTY_OIDC_ISSUER: issuer URL, used for discovery. SSO is disabled when empty
+//   - KITTY_OIDC_CLIENT_ID / KITTY_OIDC_CLIENT_SECRET: client credentials
+//   - KITTY_OIDC_NAME: name shown on the sign in button (defaults to "SSO")
+//   - KITTY_OIDC_REDIRECT_URL: defaults to the public URL + /signin/oidc/callback
+//   - KITTY_OIDC_ALLOW_SIGNUP: when "true", unknown identities get a new
+//     account (as long as registrations are open)
+//
+// Unknown identities whose email address was verified by the provider are
+// linked to the account with the same verified address, if there's one.
+type oidcProvider struct {
+	name         string
+	issuer       string
+	allowSignUp  bool
+	verifier     *oidc.IDTokenVerifier
+	oauth2Config oauth2.Config
+}
+
+var (
+	oidcInstance *oidcProvider
+	oidcLock     sync.Mutex
+)
+
+func oidcDisplayName() string {
+	if os.Getenv("KITTY_OIDC_ISSUER") == "" {
+		return ""
+	}
+	if name := os.Getenv("KITTY_OIDC_NAME"); name != "" {
+		return name
+	}
+	return "SSO"
+}
+
+// getOIDCProvider returns the configured provider, running discovery the first
+// time it's called. Returns nil if single sign-on isn't configured. Failed
+// discoveries aren't cached so that a temporarily unreachable provider doesn't
+// break sign in until the next restart.
+func getOIDCProvider(ctx context.Context) (*oidcProvider, error) {
+	issuer := os.Getenv("KITTY_OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+
+	if oidcInstance != nil {
+		return oidcInstance, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discovering OIDC provider: %w", err)
+	}
+
+	redirectURL := os.Getenv("KITTY_OIDC_REDIRECT_URL")
+	if redirectURL == "" {
+		redirectURL = PublicURL() + oidcCallbackPath
+	}
+
+	clientID := os.Getenv("KITTY_OIDC_CLIENT_ID")
+	oidcInstance = &oidcProvider{
+		name:        oidcDisplayName(),
+		issuer:      issuer,
+		allowSignUp: os.Getenv("KITTY_OIDC_ALLOW_SIGNUP") == "true",
+		verifier:    provider.Verifier(&oidc.Config{ClientID: clientID}),
+		oauth2Config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: os.Getenv("KITTY_OIDC_CLIENT_SECRET"),
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+	}
+	return oidcInstance, nil
+}
+
+// oidcLoginState is kept in a short lived cookie between sending the user to
+// the provider and them coming back.
+type oidcLoginState struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Intent       string
+	// where to go once signed in, see localRedirectPath
+	Next string
+}
+
+func (s oidcLoginState) encode() string {
+	next := base64.RawURLEncoding.EncodeToString([]byte(s.Next))
+	return strings.Join([]string{s.State, s.Nonce, s.CodeVerifier, s.Intent, next}, ".")
+}
+
+func decodeOIDCLoginState(value string) (oidcLoginState, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 5 {
+		return oidcLoginState{}, false
+	}
+	next, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil {
+		return oidcLoginState{}, false
+	}
+	return oidcLoginState{State: parts[0], Nonce: parts[1], CodeVerifier: parts[2], Intent: parts[3], Next: string(next)}, true
+}
+
+func startOIDCLogin(w http.ResponseWriter, r *http.Request, intent string) {
+	provider, err := getOIDCProvider(r.Context())
+	if err != nil {
+		log.Printf("OIDC error: %v", err)
+		http.Error(w, "Single sign-on is currently unavailable", http.StatusBadGateway)
+		return
+	}
+	if provider == nil {
+		http.Error(w, "Single sign-on is not enabled on this instance", http.StatusNotFound)
+		return
+	}
+
+	state, err := generateAuthToken()
+	if err != nil {
+		http.Error(w, "Error starting sign in", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := generateAuthToken()
+	if err != nil {
+		http.Error(w, "Error starting sign in", http.StatusInternalServerError)
+		return
+	}
+
+	loginState := oidcLoginState{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		Intent:       intent,
+		Next:         r.URL.Query().Get("next"),
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    loginState.encode(),
+		Path:     "/signin/oidc",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   !constants.DEBUG_MODE,
+		// Lax so that the cookie is sent when the provider redirects back
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	authURL := provider.oauth2Config.AuthCodeURL(state,
+		oidc.Nonce(nonce),
+		oauth2.S256ChallengeOption(loginState.CodeVerifier))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func OIDCSignIn(w http.ResponseWriter, r *http.Request) {
+	startOIDCLogin(w, r, oidcIntentSignIn)
+}
+
+func AccountLinkOIDC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	startOIDCLogin(w, r, oidcIntentLink)
+}
+
+func AccountUnlinkOIDC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getSignedInUserOrFail(r)
+	if len(user.PasswordHash) == 0 {
+		http.Error(w, "Set a password before unlinking single sign-on, or you won't be able to sign in anymore",
+			http.StatusBadRequest)
+		return
+	}
+
+	result := database.GetDB().Where("admin_user_id = ?", user.ID).Delete(&database.OIDCIdentity{})
+	if result.Error != nil {
+		http.Error(w, "Error unlinking account", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account?updated=sso_unlinked", http.StatusSeeOther)
+}
+
+type oidcClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Nonce             string `json:"nonce"`
+}
+
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, err := getOIDCProvider(r.Context())
+	if err != nil {
+		log.Printf("OIDC error: %v", err)
+		http.Error(w, "Single sign-on is currently unavailable", http.StatusBadGateway)
+		return
+	}
+	if provider == nil {
+		http.Error(w, "Single sign-on is not enabled on this instance", http.StatusNotFound)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil {
+		http.Error(w, "Sign in session expired, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Value: "", Path: "/signin/oidc", MaxAge: -1})
+
+	loginState, ok := decodeOIDCLoginState(cookie.Value)
+	if !ok || r.URL.Query().Get("state") != loginState.State {
+		http.Error(w, "Invalid sign in state, please try again", http.StatusBadRequest)
+		return
+	}
+
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		http.Error(w, "Sign in was not completed: "+errCode, http.StatusUnauthorized)
+		return
+	}
+
+	token, err := provider.oauth2Config.Exchange(r.Context(), r.URL.Query().Get("code"),
+		oauth2.VerifierOption(loginState.CodeVerifier))
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		http.Error(w, "Sign in failed", http.StatusUnauthorized)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "Sign in failed: the provider didn't return an ID token", http.StatusUnauthorized)
+		return
+	}
+
+	idToken, err := provider.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		log.Printf("OIDC ID token verification failed: %v", err)
+		http.Error(w, "Sign in failed", http.StatusUnauthorized)
+		return
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "Sign in failed", http.StatusUnauthorized)
+		return
+	}
+	if claims.Nonce != loginState.Nonce {
+		http.Error(w, "Sign in failed: invalid nonce", http.StatusUnauthorized)
+		return
+	}
+
+	identity, err := database.GetOIDCIdentity(provider.issuer, idToken.Subject)
+	if err != nil {
+		http.Error(w, "Error signing in", http.StatusInternalServerError)
+		return
+	}
+
+	if loginState.Intent == oidcIntentLink {
+		linkOIDCIdentity(w, r, provider, identity, claims)
+		return
+	}
+
+	var user database.AdminUser
+	if identity != nil {
+		result := database.GetDB().First(&user, identity.AdminUserID)
+		if result.Error != nil {
+			http.Error(w, "Error signing in", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		existing, err := linkOIDCIdentityByEmail(provider, claims)
+		if err != nil {
+			log.Printf("Error linking OIDC identity by email: %v", err)
+			http.Error(w, "Error signing in", http.StatusInternalServerError)
+			return
+		}
+
+		if existing != nil {
+			user = *existing
+		} else {
+			newUser, status, err := signUpWithOIDC(provider, claims)
+			if err != nil {
+				http.Error(w, asSentence(err.Error()), status)
+				return
+			}
+			user = *newUser
+		}
+	}
+
+	if user.IsSuspended() {
+		http.Error(w, "This account has been suspended", http.StatusForbidden)
+		return
+	}
+
+	sessionToken, err := generateAuthToken()
+	if err != nil {
+		http.Error(w, "Error signing in", http.StatusInternalServerError)
+		return
+	}
+
+	result := database.GetDB().Model(&user).Updates(map[string]any{"session_token": sessionToken, "signed_in_at": time.Now()})
+	if result.Error != nil {
+		http.Error(w, "Error signing in", http.StatusInternalServerError)
+		return
+	}
+
+	setSessionCookie(w, sessionToken)
+	http.Redirect(w, r, localRedirectPath(loginState.Next), http.StatusSeeOther)
+}
+
+func linkOIDCIdentity(w http.ResponseWriter, r *http.Request, provider *oidcProvider, identity *database.OIDCIdentity, claims oidcClaims) {
+	user := getSignedInUserOrNil(r)
+	if user == nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+
+	if identity != nil {
+		if identity.AdminUserID == user.ID {
+			http.Redirect(w, r, "/dashboard/account", http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "That identity is already linked to a different account", http.StatusConflict)
+		return
+	}
+
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		// only one identity per user, so linking again replaces the old one
+		result := tx.Where("admin_user_id = ?", user.ID).Delete(&database.OIDCIdentity{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		return tx.Create(&database.OIDCIdentity{
+			AdminUserID: user.ID,
+			Issuer:      provider.issuer,
+			Subject:     claims.Subject,
+			Email:       claims.Email,
+		}).Error
+	})
+	if err != nil {
+		http.Error(w, "Error linking account", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account?updated=sso_linked", http.StatusSeeOther)
+}
+
+// linkOIDCIdentityByEmail links an identity that isn't linked to any user yet
+// to the account with the same email address, as long as both the provider
+// and this instance verified the address. Returns nil if there's no such
+// account or if it's already linked to another identity.
+func linkOIDCIdentityByEmail(provider *oidcProvider, claims oidcClaims) (*database.AdminUser, error) {
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, nil
+	}
+
+	user, err := database.GetUserWithVerifiedEmail(claims.Email)
+	if err != nil || user == nil {
+		return nil, err
+	}
+
+	var linkedCount int64
+	result := database.GetDB().Model(&database.OIDCIdentity{}).Where("admin_user_id = ?", user.ID).Count(&linkedCount)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if linkedCount > 0 {
+		return nil, nil
+	}
+
+	result = database.GetDB().Create(&database.OIDCIdentity{
+		AdminUserID: user.ID,
+		Issuer:      provider.issuer,
+		Subject:     claims.Subject,
+		Email:       claims.Email,
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return user, nil
+}
+
+// signUpWithOIDC creates a new account for an identity that isn't linked to
+// any user yet. Returns the HTTP status to use alongside any error.
+func signUpWithOIDC(provider *oidcProvider, claims oidcClaims) (*database.AdminUser, int, error) {
+	if !provider.allowSignUp {
+		return nil, http.StatusForbidden, errors.New("no account is linked to this identity. " +
+			"Sign in with your password and link it from your account settings")
+	}
+
+	settings, err := database.GetInstanceSettings()
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("error loading instance settings")
+	}
+	if settings.RegistrationMode != database.RegistrationModeOpen {
+		return nil, http.StatusForbidden, errors.New("no account is linked to this identity and registrations are not open")
+	}
+
+	username, err := pickUsernameForOIDC(claims)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	sessionToken, err := generateAuthToken()
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("error creating account")
+	}
+
+	user := database.AdminUser{Username: username, SessionToken: sessionToken}
+	if claims.Email != "" && claims.EmailVerified && validateEmail(claims.Email) == nil {
+		existing, err := database.GetUserWithVerifiedEmail(claims.Email)
+		if err == nil && existing == nil {
+			now := time.Now()
+			user.Email = claims.Email
+			user.EmailVerifiedAt = &now
+		}
+	}
+
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := database.CreateUser(tx, &user); err != nil {
+			return err
+		}
+
+		return tx.Create(&database.OIDCIdentity{
+			AdminUserID: user.ID,
+			Issuer:      provider.issuer,
+			Subject:     claims.Subject,
+			Email:       claims.Email,
+		}).Error
+	})
+	if err != nil {
+		log.Printf("Error creating account through OIDC: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("error creating account")
+	}
+
+	return &user, http.StatusOK, nil
+}
+
+var invalidUsernameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// pickUsernameForOIDC derives a valid, available username from the claims
+// returned by the provider.
+func pickUsernameForOIDC(claims oidcClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" && claims.Email != "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = invalidUsernameChars.ReplaceAllString(base, "-")
+	base = strings.Trim(base, "-")
+	if len(base) > maxUsernameLength-5 {
+		base = base[:maxUsernameLength-5]
+	}
+	if len(base) < minUsernameLength {
+		base = "user"
+	}
+
+	candidate := base
+	for range 20 {
+		if validateUsername(candidate) == nil {
+			taken, err := database.IsUsernameTaken(candidate)
+			if err != nil {
+				return "", errors.New("error creating account")
+			}
+			if !taken {
+				return candidate, nil
+			}
+		}
+		candidate = fmt.Sprintf("%s-%04d", base, rand.IntN(10000))
+	}
+
+	return "", errors.New("could not find an available username")
+}
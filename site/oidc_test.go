@@ -0,0 +1,265 @@
+package site
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kitty/database"
+)
+
+// mockIdP is a minimal OpenID Connect provider: discovery, keys and a token
+// endpoint answering every code with an ID token carrying claims.
+type mockIdP struct {
+	server       *httptest.Server
+	key          *rsa.PrivateKey
+	codeVerifier string
+	claims       map[string]any
+}
+
+func startMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.server.URL,
+			"authorization_endpoint":                idp.server.URL + "/authorize",
+			"token_endpoint":                        idp.server.URL + "/token",
+			"jwks_uri":                              idp.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code_verifier") != idp.codeVerifier {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     idp.signIDToken(t),
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	t.Setenv("KITTY_OIDC_ISSUER", idp.server.URL)
+	t.Setenv("KITTY_OIDC_CLIENT_ID", "kitty")
+	t.Setenv("KITTY_OIDC_CLIENT_SECRET", "secret")
+	resetOIDCProvider()
+	t.Cleanup(resetOIDCProvider)
+
+	return idp
+}
+
+func resetOIDCProvider() {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	oidcInstance = nil
+}
+
+func (idp *mockIdP) signIDToken(t *testing.T) string {
+	claims := map[string]any{
+		"iss": idp.server.URL,
+		"aud": "kitty",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range idp.claims {
+		claims[name] = value
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Error(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Error(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// completeOIDCLogin calls the callback the way the provider's redirect would
+// for a sign in started with loginState, answering with the given state.
+func completeOIDCLogin(idp *mockIdP, loginState oidcLoginState, state string) *httptest.ResponseRecorder {
+	idp.codeVerifier = loginState.CodeVerifier
+
+	req := httptest.NewRequest("GET", oidcCallbackPath+"?code=code&state="+state, nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookieName, Value: loginState.encode()})
+	rec := httptest.NewRecorder()
+	OIDCCallback(rec, req)
+	return rec
+}
+
+func newOIDCLoginState() oidcLoginState {
+	return oidcLoginState{
+		State:        "state",
+		Nonce:        "nonce",
+		CodeVerifier: "verifier-verifier-verifier-verifier-verifier",
+		Intent:       oidcIntentSignIn,
+	}
+}
+
+func sessionCookie(rec *httptest.ResponseRecorder) string {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == string(AuthenticatedUserTokenCookieName) {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// createUserWithVerifiedEmail stores a user that verified email.
+func createUserWithVerifiedEmail(t *testing.T, username string, email string) *database.AdminUser {
+	t.Helper()
+
+	user := createTestUser(t, username)
+	now := time.Now()
+	user.Email = email
+	user.EmailVerifiedAt = &now
+	if err := database.GetDB().Save(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func linkedOIDCIdentities(t *testing.T, user *database.AdminUser) []database.OIDCIdentity {
+	t.Helper()
+
+	var identities []database.OIDCIdentity
+	if err := database.GetDB().Where("admin_user_id = ?", user.ID).Find(&identities).Error; err != nil {
+		t.Fatal(err)
+	}
+	return identities
+}
+
+func TestOIDCCallbackRejectsStateMismatch(t *testing.T) {
+	idp := startMockIdP(t)
+	idp.claims = map[string]any{"sub": "state-mismatch", "nonce": "nonce"}
+
+	rec := completeOIDCLogin(idp, newOIDCLoginState(), "another-state")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if sessionCookie(rec) != "" {
+		t.Error("a session was started despite the state mismatch")
+	}
+}
+
+func TestOIDCCallbackRejectsNonceMismatch(t *testing.T) {
+	idp := startMockIdP(t)
+	user := createTestUser(t, "nonce-victim")
+	if err := database.GetDB().Create(&database.OIDCIdentity{AdminUserID: user.ID, Issuer: idp.server.URL, Subject: "nonce-subject"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	idp.claims = map[string]any{"sub": "nonce-subject", "nonce": "replayed-nonce"}
+
+	loginState := newOIDCLoginState()
+	rec := completeOIDCLogin(idp, loginState, loginState.State)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if !strings.Contains(rec.Body.String(), "nonce") {
+		t.Errorf("body = %q, want it to mention the nonce", rec.Body.String())
+	}
+	if sessionCookie(rec) != "" {
+		t.Error("a session was started despite the nonce mismatch")
+	}
+}
+
+func TestOIDCCallbackIgnoresUnverifiedEmail(t *testing.T) {
+	idp := startMockIdP(t)
+	user := createUserWithVerifiedEmail(t, "unverified-victim", "unverified-victim@example.com")
+	idp.claims = map[string]any{
+		"sub":            "unverified-subject",
+		"nonce":          "nonce",
+		"email":          "unverified-victim@example.com",
+		"email_verified": false,
+	}
+
+	loginState := newOIDCLoginState()
+	rec := completeOIDCLogin(idp, loginState, loginState.State)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if sessionCookie(rec) != "" {
+		t.Error("a session was started for an unverified email")
+	}
+	if identities := linkedOIDCIdentities(t, user); len(identities) != 0 {
+		t.Errorf("an identity with an unverified email was linked: %+v", identities)
+	}
+}
+
+func TestOIDCCallbackLinksAccountByVerifiedEmail(t *testing.T) {
+	idp := startMockIdP(t)
+	user := createUserWithVerifiedEmail(t, "verified-owner", "verified-owner@example.com")
+	idp.claims = map[string]any{
+		"sub":            "verified-subject",
+		"nonce":          "nonce",
+		"email":          "Verified-Owner@example.com",
+		"email_verified": true,
+	}
+
+	loginState := newOIDCLoginState()
+	loginState.Next = "/dashboard/account"
+	rec := completeOIDCLogin(idp, loginState, loginState.State)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusSeeOther, rec.Body.String())
+	}
+	if location := rec.Header().Get("Location"); location != "/dashboard/account" {
+		t.Errorf("redirected to %q, want /dashboard/account", location)
+	}
+
+	identities := linkedOIDCIdentities(t, user)
+	if len(identities) != 1 || identities[0].Issuer != idp.server.URL || identities[0].Subject != "verified-subject" {
+		t.Fatalf("linked identities = %+v, want the provider's identity", identities)
+	}
+
+	var signedIn database.AdminUser
+	if err := database.GetDB().First(&signedIn, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if token := sessionCookie(rec); token == "" || token != signedIn.SessionToken {
+		t.Errorf("session cookie %q doesn't belong to user %d", token, user.ID)
+	}
+	if signedIn.SignedInAt == nil || time.Since(*signedIn.SignedInAt) > time.Minute {
+		t.Errorf("SignedInAt = %v, want the time of the sign in", signedIn.SignedInAt)
+	}
+}
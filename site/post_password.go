@@ -0,0 +1,157 @@
+package site
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"kitty/database"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	postAccessCookiePrefix = "kitty_post_"
+	// how long readers stay able to read a post after entering its password
+	postAccessDuration = 30 * 24 * time.Hour
+)
+
+// postPasswordFromForm reads the password fields of the post editor. change
+// is false when the post's password must be left as is.
+func postPasswordFromForm(r *http.Request) (hash string, change bool, err error) {
+	if r.FormValue("removePassword") == "on" {
+		return "", true, nil
+	}
+
+	password := r.FormValue("postPassword")
+	if password == "" {
+		return "", false, nil
+	}
+	if len(password) > maxPasswordLength {
+		return "", false, fmt.Errorf("the post password can't be longer than %d characters", maxPasswordLength)
+	}
+
+	hashBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", false, err
+	}
+	return string(hashBytes), true, nil
+}
+
+// postAccessSignature signs the access to a post until expires. The password
+// hash is part of it so that changing the password locks out every reader.
+func postAccessSignature(post *database.Post, expires int64) (string, error) {
+	settings, err := database.GetInstanceSettings()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, settings.SigningKey)
+	fmt.Fprintf(mac, "post-access:%d:%d:", post.ID, expires)
+	mac.Write([]byte(post.PasswordHash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func postAccessCookieName(post *database.Post) string {
+	return postAccessCookiePrefix + strconv.Itoa(int(post.ID))
+}
+
+func setPostAccessCookie(w http.ResponseWriter, r *http.Request, post *database.Post) error {
+	expires := time.Now().Add(postAccessDuration)
+	signature, err := postAccessSignature(post, expires.Unix())
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     postAccessCookieName(post),
+		Value:    strconv.FormatInt(expires.Unix(), 10) + "." + signature,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// canReadProtectedPost reports whether the request may see the content of a
+// post, which is the case for posts without a password, for their author and
+// for readers who entered the password.
+func canReadProtectedPost(r *http.Request, post *database.Post) bool {
+	if !post.IsPasswordProtected() {
+		return true
+	}
+
+	if user := getSignedInUserOrNil(r); user != nil && user.ID == post.AdminUserID {
+		return true
+	}
+
+	cookie, err := r.Cookie(postAccessCookieName(post))
+	if err != nil {
+		return false
+	}
+	expiresValue, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiresValue, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	expected, err := postAccessSignature(post, expires)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+var errWrongPostPassword = errors.New("wrong password")
+
+// unlockPost checks the password posted by a reader, remembering their access
+// when it's right.
+func unlockPost(w http.ResponseWriter, r *http.Request, post *database.Post) error {
+	err := bcrypt.CompareHashAndPassword([]byte(post.PasswordHash), []byte(r.FormValue("password")))
+	if err != nil {
+		return errWrongPostPassword
+	}
+	return setPostAccessCookie(w, r, post)
+}
+
+type postPasswordView struct {
+	Post  *database.Post
+	Error string
+}
+
+// renderPostPasswordForm asks for the password of a post on the main site.
+func renderPostPasswordForm(w http.ResponseWriter, r *http.Request, post *database.Post, status int, formError string) {
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	RenderTemplateStatus(w, r, "post_password", status, postPasswordView{Post: post, Error: formError})
+}
+
+// blogPostPasswordForm is shown in place of the body of protected posts on
+// blogs, so it's styled by the blog's theme.
+var blogPostPasswordForm = template.Must(template.New("password").Parse(`<form method="post" class="post-password">
+<p>This post is password protected.</p>
+{{if .}}<p class="error">{{.}}</p>{{end}}
+<label for="password">Password:</label>
+<input type="password" id="password" name="password" required autofocus>
+<input type="submit" value="Read">
+</form>`))
+
+func renderBlogPostPasswordForm(formError string) template.HTML {
+	var b bytes.Buffer
+	if err := blogPostPasswordForm.Execute(&b, formError); err != nil {
+		return ""
+	}
+	return template.HTML(b.String())
+}
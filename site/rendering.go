@@ -0,0 +1,128 @@
+package site
+
+import (
+	"html/template"
+	"kitty/database"
+	"kitty/render"
+	"kitty/sanitizer"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRenderCacheSize = 1000
+	// persisted entries that go unused for this long are most likely old
+	// versions of edited posts
+	renderCacheRetention = 30 * 24 * time.Hour
+)
+
+var (
+	renderCache     *render.Cache
+	renderCacheOnce sync.Once
+)
+
+// getRenderCache returns the rendered Markdown cache, configured with
+// KITTY_RENDER_CACHE_SIZE (number of documents kept in memory) and
+// KITTY_RENDER_CACHE_PERSIST=true to also keep them in the database.
+func getRenderCache() *render.Cache {
+	renderCacheOnce.Do(func() {
+		size := defaultRenderCacheSize
+		if value := os.Getenv("KITTY_RENDER_CACHE_SIZE"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				log.Printf("Invalid KITTY_RENDER_CACHE_SIZE %q, using %d", value, defaultRenderCacheSize)
+			} else {
+				size = parsed
+			}
+		}
+
+		var store render.CacheStore
+		if os.Getenv("KITTY_RENDER_CACHE_PERSIST") == "true" {
+			store = database.RenderCacheStore{}
+			go func() {
+				pruned, err := database.PruneRenderCache(time.Now().Add(-renderCacheRetention))
+				if err != nil {
+					log.Printf("Failed to prune the render cache: %v", err)
+				} else if pruned > 0 {
+					log.Printf("Pruned %d unused entries from the render cache", pruned)
+				}
+			}()
+		}
+
+		renderCache = render.NewCache(size, store)
+	})
+	return renderCache
+}
+
+func instanceHTMLPolicy() sanitizer.PolicyName {
+	settings, err := database.GetInstanceSettings()
+	if err != nil {
+		log.Printf("Failed to load instance settings, using default HTML policy: %v", err)
+		return sanitizer.DefaultPolicy
+	}
+	return sanitizer.PolicyName(settings.HTMLPolicy)
+}
+
+// effectiveRenderOptions returns the options the post should be rendered with,
+// taking into account the defaults of its author.
+func effectiveRenderOptions(post *database.Post, author *database.AdminUser) render.Options {
+	if post.RenderOptions != nil {
+		return render.Options(*post.RenderOptions)
+	}
+	if author != nil && author.RenderOptions != nil {
+		return render.Options(*author.RenderOptions)
+	}
+	return render.DefaultOptions()
+}
+
+func renderMarkdown(source string, opts render.Options) template.HTML {
+	return template.HTML(getRenderCache().ToHTML(source, opts, instanceHTMLPolicy()))
+}
+
+func renderPostBody(post *database.Post, author *database.AdminUser) template.HTML {
+	return renderMarkdown(post.Body, effectiveRenderOptions(post, author))
+}
+
+// forgetRenderedPost drops the cached HTML of a post, called with the post as
+// it was before being edited or deleted.
+func forgetRenderedPost(post *database.Post, author *database.AdminUser) {
+	getRenderCache().Invalidate(post.Body, effectiveRenderOptions(post, author), instanceHTMLPolicy())
+}
+
+// renderOptionsFromForm reads the render option checkboxes shared by the
+// account settings and post editor forms.
+func renderOptionsFromForm(r *http.Request) database.RenderOptions {
+	return database.RenderOptions{
+		Footnotes:          r.FormValue("render_footnotes") == "on",
+		DefinitionLists:    r.FormValue("render_definition_lists") == "on",
+		TaskLists:          r.FormValue("render_task_lists") == "on",
+		Math:               r.FormValue("render_math") == "on",
+		SyntaxHighlighting: r.FormValue("render_syntax_highlighting") == "on",
+		HeadingAnchors:     r.FormValue("render_heading_anchors") == "on",
+		TableOfContents:    r.FormValue("render_table_of_contents") == "on",
+		LinksInNewTab:      r.FormValue("render_links_in_new_tab") == "on",
+	}
+}
+
+func AccountRenderOptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getSignedInUserOrFail(r)
+	opts := renderOptionsFromForm(r)
+
+	user.RenderOptions = &opts
+	result := database.GetDB().Save(user)
+	if result.Error != nil {
+		http.Error(w, "Error saving render options", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account?updated=rendering", http.StatusSeeOther)
+}
@@ -0,0 +1,325 @@
+package site
+
+import (
+	"errors"
+	"kitty/database"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+const maxSeriesTitleLength = 100
+
+// seriesFromForm reads the series picked in the post editor, nil meaning no
+// series. SetPostSeries checks that it belongs to the post's author.
+func seriesFromForm(r *http.Request) (*uint, error) {
+	value := r.FormValue("series")
+	if value == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid series")
+	}
+	seriesID := uint(id)
+	return &seriesID, nil
+}
+
+// postSeriesNav is the part of a post page linking to the rest of its
+// series. Only public posts are counted, so drafts don't leave gaps.
+type postSeriesNav struct {
+	Series   *database.Series
+	Position int
+	Total    int
+	Previous *database.Post
+	Next     *database.Post
+}
+
+// getPostSeriesNav needs post.Series to be preloaded.
+func getPostSeriesNav(post *database.Post) (*postSeriesNav, error) {
+	if post.Series == nil {
+		return nil, nil
+	}
+
+	posts, err := database.SeriesPosts(post.Series.ID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	nav := &postSeriesNav{Series: post.Series, Total: len(posts)}
+	for i := range posts {
+		if posts[i].ID != post.ID {
+			continue
+		}
+		nav.Position = i + 1
+		if i > 0 {
+			nav.Previous = &posts[i-1]
+		}
+		if i < len(posts)-1 {
+			nav.Next = &posts[i+1]
+		}
+	}
+	if nav.Position == 0 {
+		// the post itself isn't public, it's being previewed by an admin
+		return nil, nil
+	}
+	return nav, nil
+}
+
+type publicSeriesView struct {
+	User   *database.AdminUser
+	Series *database.Series
+	Posts  []database.Post
+}
+
+func PublicViewSeries(w http.ResponseWriter, r *http.Request) {
+	var user database.AdminUser
+	result := database.GetDB().First(&user, chi.URLParam(r, "userID"))
+	if result.Error != nil || user.IsSuspended() {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	series, err := database.GetSeriesBySlug(user.ID, chi.URLParam(r, "slug"))
+	if err != nil {
+		http.Error(w, "Error fetching series", http.StatusInternalServerError)
+		return
+	} else if series == nil {
+		http.Error(w, "Series not found", http.StatusNotFound)
+		return
+	}
+
+	postsLastModified, err := database.PostsLastModified(user.ID)
+	if err != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	validators := newCacheValidators(r)
+	validators.add("user", user.ID, user.UpdatedAt)
+	validators.add("series", series.ID, series.UpdatedAt)
+	validators.add("posts", user.ID, postsLastModified)
+	if writeCacheHeaders(w, r, validators) {
+		return
+	}
+
+	posts, err := database.SeriesPosts(series.ID, true)
+	if err != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+	// series with only drafts stay private
+	if len(posts) == 0 {
+		http.Error(w, "Series not found", http.StatusNotFound)
+		return
+	}
+
+	RenderTemplate(w, r, "public_view_series", publicSeriesView{User: &user, Series: series, Posts: posts})
+}
+
+type seriesListFormData struct {
+	Series []database.SeriesCount
+	Title  string
+	Errors []string
+}
+
+func renderDashboardSeriesList(w http.ResponseWriter, r *http.Request, status int, title string, formErrors ...string) {
+	user := getSignedInUserOrFail(r)
+
+	series, err := database.GetUserSeries(user.ID, false)
+	if err != nil {
+		http.Error(w, "Error fetching series", http.StatusInternalServerError)
+		return
+	}
+
+	RenderTemplateStatus(w, r, "dashboard/series_list", status, seriesListFormData{Series: series, Title: title, Errors: formErrors})
+}
+
+// validateSeries checks a series about to be saved, returning messages for
+// the user.
+func validateSeries(series *database.Series) []string {
+	var formErrors []string
+	if series.Title == "" {
+		formErrors = append(formErrors, "The title can't be empty.")
+	} else if len(series.Title) > maxSeriesTitleLength {
+		formErrors = append(formErrors, "The title can't be longer than "+strconv.Itoa(maxSeriesTitleLength)+" characters.")
+	}
+	return formErrors
+}
+
+func saveSeriesError(err error) string {
+	if errors.Is(err, database.ErrSeriesExists) {
+		return "You already have a series with that title."
+	}
+	return asSentence(err.Error())
+}
+
+func DashboardSeriesList(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		renderDashboardSeriesList(w, r, http.StatusOK, "")
+
+	case "POST":
+		user := getSignedInUserOrFail(r)
+
+		series := database.Series{
+			AdminUserID: user.ID,
+			Title:       strings.TrimSpace(r.FormValue("title")),
+			Description: strings.TrimSpace(r.FormValue("description")),
+		}
+		if formErrors := validateSeries(&series); formErrors != nil {
+			renderDashboardSeriesList(w, r, http.StatusBadRequest, series.Title, formErrors...)
+			return
+		}
+
+		err := database.SaveSeries(&series)
+		if err != nil {
+			renderDashboardSeriesList(w, r, http.StatusBadRequest, series.Title, saveSeriesError(err))
+			return
+		}
+
+		http.Redirect(w, r, "/dashboard/series/"+strconv.Itoa(int(series.ID)), http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type seriesFormData struct {
+	Series *database.Series
+	Posts  []database.Post
+	Saved  bool
+	Errors []string
+}
+
+func renderDashboardSeries(w http.ResponseWriter, r *http.Request, status int, series *database.Series, formErrors ...string) {
+	posts, err := database.SeriesPosts(series.ID, false)
+	if err != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	RenderTemplateStatus(w, r, "dashboard/series", status, seriesFormData{
+		Series: series,
+		Posts:  posts,
+		Saved:  r.URL.Query().Get("saved") == "1",
+		Errors: formErrors,
+	})
+}
+
+// getOwnSeries loads the series in the URL if it belongs to the signed in
+// user, otherwise it writes an error and returns nil.
+func getOwnSeries(w http.ResponseWriter, r *http.Request) *database.Series {
+	user := getSignedInUserOrFail(r)
+
+	var series database.Series
+	result := database.GetDB().Where("admin_user_id = ?", user.ID).First(&series, chi.URLParam(r, "seriesID"))
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		http.Error(w, "Series not found", http.StatusNotFound)
+		return nil
+	} else if result.Error != nil {
+		http.Error(w, "Error fetching series", http.StatusInternalServerError)
+		return nil
+	}
+	return &series
+}
+
+func DashboardSeries(w http.ResponseWriter, r *http.Request) {
+	series := getOwnSeries(w, r)
+	if series == nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		renderDashboardSeries(w, r, http.StatusOK, series)
+
+	case "POST":
+		series.Title = strings.TrimSpace(r.FormValue("title"))
+		series.Description = strings.TrimSpace(r.FormValue("description"))
+		if formErrors := validateSeries(series); formErrors != nil {
+			renderDashboardSeries(w, r, http.StatusBadRequest, series, formErrors...)
+			return
+		}
+
+		err := database.SaveSeries(series)
+		if err != nil {
+			renderDashboardSeries(w, r, http.StatusBadRequest, series, saveSeriesError(err))
+			return
+		}
+
+		http.Redirect(w, r, "/dashboard/series/"+strconv.Itoa(int(series.ID))+"?saved=1", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DashboardReorderSeries takes a "position_<post ID>" field per post. Posts
+// are sorted by the numbers entered, ties keeping their current order.
+func DashboardReorderSeries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	series := getOwnSeries(w, r)
+	if series == nil {
+		return
+	}
+
+	posts, err := database.SeriesPosts(series.ID, false)
+	if err != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	positions := make(map[uint]int, len(posts))
+	for _, post := range posts {
+		position, err := strconv.Atoi(r.FormValue("position_" + strconv.Itoa(int(post.ID))))
+		if err != nil {
+			position = post.SeriesPosition
+		}
+		positions[post.ID] = position
+	}
+	sort.SliceStable(posts, func(i, j int) bool {
+		return positions[posts[i].ID] < positions[posts[j].ID]
+	})
+
+	postIDs := make([]uint, 0, len(posts))
+	for _, post := range posts {
+		postIDs = append(postIDs, post.ID)
+	}
+
+	err = database.ReorderSeries(series, postIDs)
+	if err != nil {
+		http.Error(w, "Error saving the order", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/series/"+strconv.Itoa(int(series.ID))+"?saved=1", http.StatusSeeOther)
+}
+
+func DashboardDeleteSeries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	series := getOwnSeries(w, r)
+	if series == nil {
+		return
+	}
+
+	err := database.DeleteSeries(series)
+	if err != nil {
+		http.Error(w, "Error deleting series", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/series", http.StatusSeeOther)
+}
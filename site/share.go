@@ -0,0 +1,143 @@
+package site
+
+import (
+	"errors"
+	"kitty/database"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+const maxShareLinkLabelLength = 100
+
+// PublicViewSharedPost shows a post to whoever has one of its share links,
+// whatever its visibility. Moderation still applies.
+func PublicViewSharedPost(w http.ResponseWriter, r *http.Request) {
+	link, err := database.GetUsableShareLink(chi.URLParam(r, "token"))
+	if err != nil {
+		http.Error(w, "Error fetching post", http.StatusInternalServerError)
+		return
+	} else if link == nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post := link.Post
+
+	var author database.AdminUser
+	result := database.GetDB().First(&author, post.AdminUserID)
+	if result.Error != nil || post.HiddenByAdmin || author.IsSuspended() {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	// the page must go away as soon as the link is revoked
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+
+	RenderTemplate(w, r, "public_view_post", publicPostView{
+		Post:     post,
+		BodyHTML: renderPostBody(&post, &author),
+		NoIndex:  true,
+	})
+}
+
+// getOwnPost loads the post in the URL if it belongs to the signed in user,
+// otherwise it writes an error and returns nil.
+func getOwnPost(w http.ResponseWriter, r *http.Request) *database.Post {
+	user := getSignedInUserOrFail(r)
+
+	var post database.Post
+	result := database.GetDB().Where("admin_user_id = ?", user.ID).First(&post, chi.URLParam(r, "postID"))
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return nil
+	} else if result.Error != nil {
+		http.Error(w, "Error fetching post", http.StatusInternalServerError)
+		return nil
+	}
+	return &post
+}
+
+type shareLinksData struct {
+	Post  *database.Post
+	Links []database.PostShareLink
+}
+
+func DashboardPostShareLinks(w http.ResponseWriter, r *http.Request) {
+	post := getOwnPost(w, r)
+	if post == nil {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		links, err := database.GetPostShareLinks(post.ID)
+		if err != nil {
+			http.Error(w, "Error fetching share links", http.StatusInternalServerError)
+			return
+		}
+
+		RenderTemplate(w, r, "dashboard/share_links", shareLinksData{Post: post, Links: links})
+
+	case "POST":
+		token, err := generateAuthToken()
+		if err != nil {
+			http.Error(w, "Error generating share link: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		label := strings.TrimSpace(r.FormValue("label"))
+		if len(label) > maxShareLinkLabelLength {
+			http.Error(w, "The label can't be longer than "+strconv.Itoa(maxShareLinkLabelLength)+" characters", http.StatusBadRequest)
+			return
+		}
+
+		link := database.PostShareLink{PostID: post.ID, Token: token, Label: label}
+		if days, err := strconv.Atoi(r.FormValue("expires_in_days")); err == nil && days > 0 {
+			expiresAt := time.Now().AddDate(0, 0, days)
+			link.ExpiresAt = &expiresAt
+		}
+
+		result := database.GetDB().Create(&link)
+		if result.Error != nil {
+			http.Error(w, "Error creating share link", http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/dashboard/post/"+strconv.Itoa(int(post.ID))+"/share", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func DashboardRevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	post := getOwnPost(w, r)
+	if post == nil {
+		return
+	}
+
+	var link database.PostShareLink
+	result := database.GetDB().Where("post_id = ?", post.ID).First(&link, chi.URLParam(r, "linkID"))
+	if result.Error != nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+
+	err := database.RevokeShareLink(&link)
+	if err != nil {
+		http.Error(w, "Error revoking share link", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/post/"+strconv.Itoa(int(post.ID))+"/share", http.StatusSeeOther)
+}
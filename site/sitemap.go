@@ -0,0 +1,255 @@
+package site
+
+import (
+	"encoding/xml"
+	"fmt"
+	"kitty/database"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// sitemapMaxURLs is the most URLs the sitemap protocol allows in a single
+// file, users with more posts get several files.
+const sitemapMaxURLs = 50_000
+
+const sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+const defaultRobotsTxt = `User-agent: *
+Disallow: /dashboard/
+Disallow: /admin/
+Disallow: /api/
+Disallow: /share/
+`
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndexEntry struct {
+	Loc string `xml:"loc"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name            `xml:"sitemapindex"`
+	Xmlns    string              `xml:"xmlns,attr"`
+	Sitemaps []sitemapIndexEntry `xml:"sitemap"`
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("Failed to write XML: %v", err)
+	}
+}
+
+func sitemapLastMod(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// sitemapFileCount is how many files the sitemap of a user with postCount
+// indexable posts takes, the first URL being their homepage.
+func sitemapFileCount(postCount int64) int {
+	return int((postCount + 1 + sitemapMaxURLs - 1) / sitemapMaxURLs)
+}
+
+// userSitemapURLs returns the given page of the user's sitemap: their
+// homepage, then their indexable posts.
+func userSitemapURLs(user *database.AdminUser, page int) ([]sitemapURL, error) {
+	homeURL, postURL, err := userURLs(user)
+	if err != nil {
+		return nil, err
+	}
+
+	// the homepage takes the first spot of the first page
+	offset := (page-1)*sitemapMaxURLs - 1
+	limit := sitemapMaxURLs
+	var urls []sitemapURL
+	if page == 1 {
+		offset = 0
+		limit--
+		urls = append(urls, sitemapURL{Loc: homeURL})
+	}
+
+	var posts []database.Post
+	result := publicPostsQuery(user.ID).
+		Select("id, slug, updated_at").
+		Where("no_index = ?", false).
+		Where("password_hash = ''").
+		Order("id ASC").
+		Offset(offset).
+		Limit(limit).
+		Find(&posts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	for i := range posts {
+		urls = append(urls, sitemapURL{Loc: postURL(&posts[i]), LastMod: sitemapLastMod(posts[i].UpdatedAt)})
+	}
+	if page == 1 && len(posts) > 0 {
+		lastModified, err := database.PostsLastModified(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		urls[0].LastMod = sitemapLastMod(lastModified)
+	}
+	return urls, nil
+}
+
+// SitemapIndex lists the sitemaps of every user with indexable posts, except
+// for users whose blog is on a custom domain, which has its own sitemap.
+func SitemapIndex(w http.ResponseWriter, r *http.Request) {
+	users, err := database.ListSitemapUsers()
+	if err != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	customDomainOwners, err := database.ListCustomDomainBlogOwners()
+	if err != nil {
+		http.Error(w, "Error fetching blogs", http.StatusInternalServerError)
+		return
+	}
+
+	index := sitemapIndex{Xmlns: sitemapNamespace, Sitemaps: []sitemapIndexEntry{}}
+	for _, user := range users {
+		if customDomainOwners[user.UserID] {
+			continue
+		}
+		for page := 1; page <= sitemapFileCount(user.PostCount); page++ {
+			index.Sitemaps = append(index.Sitemaps, sitemapIndexEntry{
+				Loc: fmt.Sprintf("%s/sitemap-%d-%d.xml", PublicURL(), user.UserID, page),
+			})
+		}
+	}
+
+	writeXML(w, index)
+}
+
+func UserSitemap(w http.ResponseWriter, r *http.Request) {
+	page, err := strconv.Atoi(chi.URLParam(r, "page"))
+	if err != nil || page < 1 {
+		http.Error(w, "Sitemap not found", http.StatusNotFound)
+		return
+	}
+
+	var user database.AdminUser
+	result := database.GetDB().First(&user, chi.URLParam(r, "userID"))
+	if result.Error != nil || user.IsSuspended() {
+		http.Error(w, "Sitemap not found", http.StatusNotFound)
+		return
+	}
+
+	customDomainOwners, err := database.ListCustomDomainBlogOwners()
+	if err != nil {
+		http.Error(w, "Error fetching blogs", http.StatusInternalServerError)
+		return
+	}
+	if customDomainOwners[user.ID] {
+		http.Error(w, "Sitemap not found", http.StatusNotFound)
+		return
+	}
+
+	serveUserSitemap(w, &user, page)
+}
+
+func serveUserSitemap(w http.ResponseWriter, user *database.AdminUser, page int) {
+	urls, err := userSitemapURLs(user, page)
+	if err != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+	// only the first page has the homepage, later pages must have posts
+	if len(urls) == 0 {
+		http.Error(w, "Sitemap not found", http.StatusNotFound)
+		return
+	}
+
+	writeXML(w, sitemapURLSet{Xmlns: sitemapNamespace, URLs: urls})
+}
+
+func RobotsTxt(w http.ResponseWriter, r *http.Request) {
+	settings, err := database.GetInstanceSettings()
+	if err != nil {
+		http.Error(w, "Error loading instance settings", http.StatusInternalServerError)
+		return
+	}
+
+	rules := settings.RobotsTxt
+	if strings.TrimSpace(rules) == "" {
+		rules = defaultRobotsTxt
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%s\n\nSitemap: %s/sitemap.xml\n", strings.TrimRight(rules, "\r\n"), PublicURL())
+}
+
+// CustomDomainSitemapIndex lists the sitemaps of the blog served on the
+// requested custom domain.
+func CustomDomainSitemapIndex(w http.ResponseWriter, r *http.Request) {
+	br, err := customDomainBlog(r)
+	if err != nil {
+		http.Error(w, "Error fetching blog", http.StatusInternalServerError)
+		return
+	} else if br == nil {
+		http.Error(w, "Blog not found", http.StatusNotFound)
+		return
+	}
+
+	var postCount int64
+	result := publicPostsQuery(br.user.ID).Where("no_index = ?", false).Where("password_hash = ''").Count(&postCount)
+	if result.Error != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	index := sitemapIndex{Xmlns: sitemapNamespace}
+	for page := 1; page <= sitemapFileCount(postCount); page++ {
+		index.Sitemaps = append(index.Sitemaps, sitemapIndexEntry{
+			Loc: fmt.Sprintf("%s/sitemap-%d.xml", br.canonicalBase, page),
+		})
+	}
+
+	writeXML(w, index)
+}
+
+func CustomDomainSitemap(w http.ResponseWriter, r *http.Request) {
+	page, err := strconv.Atoi(chi.URLParam(r, "page"))
+	if err != nil || page < 1 {
+		http.Error(w, "Sitemap not found", http.StatusNotFound)
+		return
+	}
+
+	br, err := customDomainBlog(r)
+	if err != nil {
+		http.Error(w, "Error fetching blog", http.StatusInternalServerError)
+		return
+	} else if br == nil {
+		http.Error(w, "Blog not found", http.StatusNotFound)
+		return
+	}
+
+	serveUserSitemap(w, br.user, page)
+}
+
+// CustomDomainRobotsTxt lets search engines crawl the whole blog, the
+// instance's rules are about pages that only exist on the main host.
+func CustomDomainRobotsTxt(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "User-agent: *\nAllow: /\n\nSitemap: %s/sitemap.xml\n", customDomainURL(requestHost(r)))
+}
@@ -0,0 +1,97 @@
+package site
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+
+	"kitty/database"
+)
+
+func createTestPost(t *testing.T, user *database.AdminUser, slug string, passwordHash string) *database.Post {
+	t.Helper()
+
+	post := &database.Post{
+		AdminUserID:  user.ID,
+		Title:        slug,
+		Body:         "Hello",
+		Slug:         slug,
+		Published:    true,
+		Visibility:   database.PostVisibilityPublic,
+		PasswordHash: passwordHash,
+	}
+	if err := database.GetDB().Create(post).Error; err != nil {
+		t.Fatal(err)
+	}
+	return post
+}
+
+func TestSitemapLeavesOutProtectedPosts(t *testing.T) {
+	user := createTestUser(t, "sitemap-protected")
+	open := createTestPost(t, user, "open", "")
+	protected := createTestPost(t, user, "protected", "$2a$10$hash")
+
+	_, postURL, err := userURLs(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, err := userSitemapURLs(user, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var locs []string
+	for _, u := range urls {
+		locs = append(locs, u.Loc)
+	}
+	if !containsString(locs, postURL(open)) {
+		t.Errorf("sitemap %v doesn't list the open post", locs)
+	}
+	if containsString(locs, postURL(protected)) {
+		t.Errorf("sitemap %v lists the password protected post", locs)
+	}
+
+	users, err := database.ListSitemapUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range users {
+		if u.UserID == user.ID && u.PostCount != 1 {
+			t.Errorf("PostCount = %d, want 1", u.PostCount)
+		}
+	}
+}
+
+func TestPublicViewPostMarksProtectedPostsNoIndex(t *testing.T) {
+	user := createTestUser(t, "noindex-protected")
+	post := createTestPost(t, user, "protected", "$2a$10$hash")
+
+	req := signedInRequest("GET", "/posts/"+strconv.Itoa(int(post.ID)), nil, user)
+	routeContext := chi.NewRouteContext()
+	routeContext.URLParams.Add("postID", strconv.Itoa(int(post.ID)))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeContext))
+	rec := httptest.NewRecorder()
+	PublicViewPost(rec, req)
+
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	if robots := rec.Header().Get("X-Robots-Tag"); robots != "noindex" {
+		t.Errorf("X-Robots-Tag = %q, want noindex", robots)
+	}
+	if !strings.Contains(rec.Body.String(), "noindex") {
+		t.Error("the page has no robots meta tag")
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package site
+
+import (
+	"errors"
+	"fmt"
+	"kitty/constants"
+	"kitty/database"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+type publicTagView struct {
+	User  *database.AdminUser
+	Tag   *database.Tag
+	Posts []database.Post
+}
+
+func PublicViewUserTag(w http.ResponseWriter, r *http.Request) {
+	var user database.AdminUser
+	result := database.GetDB().First(&user, chi.URLParam(r, "userID"))
+	if result.Error != nil || user.IsSuspended() {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	tag, err := database.GetTagBySlug(user.ID, chi.URLParam(r, "tag"))
+	if err != nil {
+		http.Error(w, "Error fetching tag", http.StatusInternalServerError)
+		return
+	} else if tag == nil {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	postsLastModified, err := database.PostsLastModified(user.ID)
+	if err != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+
+	validators := newCacheValidators(r)
+	validators.add("user", user.ID, user.UpdatedAt)
+	validators.add("tag", tag.ID, tag.UpdatedAt)
+	validators.add("posts", user.ID, postsLastModified)
+	if writeCacheHeaders(w, r, validators) {
+		return
+	}
+
+	var posts []database.Post
+	result = publicPostsQuery(user.ID).
+		Select("id, title, published_date").
+		Scopes(database.PostsWithTag(tag.ID)).
+		Order("published_date DESC").
+		Find(&posts)
+	if result.Error != nil {
+		http.Error(w, "Error fetching posts", http.StatusInternalServerError)
+		return
+	}
+	// tags only used by drafts stay private
+	if len(posts) == 0 {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	RenderTemplate(w, r, "public_view_tag", publicTagView{User: &user, Tag: tag, Posts: posts})
+}
+
+type tagsFormData struct {
+	Tags   []database.TagCount
+	Status string
+	Errors []string
+}
+
+func renderDashboardTags(w http.ResponseWriter, r *http.Request, status int, formErrors ...string) {
+	user := getSignedInUserOrFail(r)
+
+	tags, err := database.GetTagCounts(user.ID, false)
+	if err != nil {
+		http.Error(w, "Error fetching tags", http.StatusInternalServerError)
+		return
+	}
+
+	RenderTemplateStatus(w, r, "dashboard/tags", status, tagsFormData{
+		Tags:   tags,
+		Status: r.URL.Query().Get("updated"),
+		Errors: formErrors,
+	})
+}
+
+func DashboardTags(w http.ResponseWriter, r *http.Request) {
+	renderDashboardTags(w, r, http.StatusOK)
+}
+
+// getOwnTag loads a tag of the signed in user, returning nil if the user has
+// no such tag.
+func getOwnTag(r *http.Request, tagID string) (*database.Tag, error) {
+	user := getSignedInUserOrFail(r)
+
+	id, err := strconv.ParseUint(tagID, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+
+	var tag database.Tag
+	result := database.GetDB().Where("admin_user_id = ?", user.ID).First(&tag, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	return &tag, nil
+}
+
+func DashboardRenameTag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tag, err := getOwnTag(r, chi.URLParam(r, "tagID"))
+	if err != nil {
+		http.Error(w, "Error fetching tag", http.StatusInternalServerError)
+		return
+	} else if tag == nil {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	name := r.FormValue("name")
+	if utf8.RuneCountInString(name) > constants.MAX_TAG_LENGTH {
+		renderDashboardTags(w, r, http.StatusBadRequest, fmt.Sprintf("Tags can't be longer than %d characters.", constants.MAX_TAG_LENGTH))
+		return
+	}
+
+	err = database.RenameTag(tag, name)
+	if errors.Is(err, database.ErrTagExists) {
+		renderDashboardTags(w, r, http.StatusBadRequest, "You already have a tag with that name, merge the two tags instead.")
+		return
+	} else if err != nil {
+		renderDashboardTags(w, r, http.StatusBadRequest, asSentence(err.Error()))
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/tags?updated=renamed", http.StatusSeeOther)
+}
+
+func DashboardMergeTag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from, err := getOwnTag(r, chi.URLParam(r, "tagID"))
+	if err != nil {
+		http.Error(w, "Error fetching tag", http.StatusInternalServerError)
+		return
+	}
+	into, err := getOwnTag(r, r.FormValue("into"))
+	if err != nil {
+		http.Error(w, "Error fetching tag", http.StatusInternalServerError)
+		return
+	}
+	if from == nil || into == nil {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+	if from.ID == into.ID {
+		renderDashboardTags(w, r, http.StatusBadRequest, "A tag can't be merged into itself.")
+		return
+	}
+
+	err = database.MergeTags(from, into)
+	if err != nil {
+		http.Error(w, "Error merging tags", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/tags?updated=merged", http.StatusSeeOther)
+}
@@ -1,31 +1,36 @@
 package site
 
 import (
-	"encoding/json"
+	"bytes"
+	"fmt"
 	"html/template"
 	"kitty/constants"
 	"kitty/database"
+	"kitty/render"
 	"log"
 	"net/http"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/gomarkdown/markdown"
-	"github.com/gomarkdown/markdown/html"
-	"github.com/gomarkdown/markdown/parser"
-	"gorm.io/datatypes"
 )
 
 var templatesCache sync.Map
 
 func RenderTemplate(w http.ResponseWriter, r *http.Request, templateName string, data any) {
+	RenderTemplateStatus(w, r, templateName, http.StatusOK, data)
+}
+
+// RenderTemplateStatus renders a template and answers with status. The page
+// is rendered first, so that a failing template can still be answered with
+// an error.
+func RenderTemplateStatus(w http.ResponseWriter, r *http.Request, templateName string, status int, data any) {
 	type GlobalTemplateData struct {
 		CurrentUser *database.AdminUser
 		IsDebug     bool
 		SiteName    string
 		PublicURL   string
+		SSOName     string // empty when single sign-on is disabled
 	}
 
 	templateData := struct {
@@ -36,7 +41,8 @@ func RenderTemplate(w http.ResponseWriter, r *http.Request, templateName string,
 			CurrentUser: getSignedInUserOrNil(r),
 			IsDebug:     constants.DEBUG_MODE,
 			SiteName:    constants.APP_NAME,
-			PublicURL:   constants.PUBLIC_URL,
+			PublicURL:   PublicURL(),
+			SSOName:     oidcDisplayName(),
 		},
 		Data: data,
 	}
@@ -47,31 +53,23 @@ func RenderTemplate(w http.ResponseWriter, r *http.Request, templateName string,
 		templatesDir := "templates/"
 
 		baseTemplate := template.New("layout.html").Funcs(template.FuncMap{
-			"jsonListToCommaSeparated": func(jsonList datatypes.JSON) string {
-				var tags []string
-				err := json.Unmarshal(jsonList, &tags)
-				if err != nil {
-					log.Printf("Failed to parse JSON list: %v", err)
-					return ""
-				}
-				for i, tag := range tags {
-					tags[i] = strings.TrimSpace(tag)
-				}
-				return strings.Join(tags, ", ")
+			"tagsToCommaSeparated": func(tags []database.Tag) string {
+				return strings.Join(tagNames(tags), ", ")
 			},
 			"parseMarkdown": func(markdownStr string) template.HTML {
-				extensions := parser.CommonExtensions | parser.AutoHeadingIDs
-				p := parser.NewWithExtensions(extensions)
-				doc := p.Parse([]byte(markdownStr))
-
-				// create HTML renderer with extensions
-				htmlFlags := html.CommonFlags | html.HrefTargetBlank
-				opts := html.RendererOptions{Flags: htmlFlags}
-				renderer := html.NewRenderer(opts)
-
-				rendered := markdown.Render(doc, renderer)
-
-				return template.HTML(rendered)
+				return renderMarkdown(markdownStr, render.DefaultOptions())
+			},
+			// post can be a database.Post, a *database.Post or nil (for new posts)
+			"postRenderOptions": func(author *database.AdminUser, post any) render.Options {
+				switch post := post.(type) {
+				case database.Post:
+					return effectiveRenderOptions(&post, author)
+				case *database.Post:
+					if post != nil {
+						return effectiveRenderOptions(post, author)
+					}
+				}
+				return effectiveRenderOptions(&database.Post{}, author)
 			},
 			"dateFmt": func(layout string, t time.Time) string {
 				return t.Format(layout)
@@ -79,18 +77,42 @@ func RenderTemplate(w http.ResponseWriter, r *http.Request, templateName string,
 			"now": func() time.Time {
 				return time.Now()
 			},
+			"formatBytes": func(bytes int64) string {
+				const unit = 1024
+				if bytes < unit {
+					return fmt.Sprintf("%d B", bytes)
+				}
+				div, exp := int64(unit), 0
+				for n := bytes / unit; n >= unit; n /= unit {
+					div *= unit
+					exp++
+				}
+				return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+			},
+			"add": func(a, b int) int {
+				return a + b
+			},
+			// ratio is between 0 and 1
+			"percent": func(ratio float64) string {
+				return fmt.Sprintf("%.1f%%", ratio*100)
+			},
 		})
 
 		baseTemplate = template.Must(baseTemplate.ParseFiles(filepath.Join(templatesDir, "layout.html")))
+		baseTemplate = template.Must(baseTemplate.ParseGlob(filepath.Join(templatesDir, "partials", "*.html")))
 		actualTemplate = template.Must(baseTemplate.ParseFiles(filepath.Join(templatesDir, templateName+".html")))
 
 		templatesCache.Store(templateName, actualTemplate)
 	}
 
-	err := actualTemplate.(*template.Template).Execute(w, templateData)
-
+	var buf bytes.Buffer
+	err := actualTemplate.(*template.Template).Execute(&buf, templateData)
 	if err != nil {
 		log.Printf("Template execution error: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	w.WriteHeader(status)
+	buf.WriteTo(w)
 }
@@ -0,0 +1,162 @@
+package site
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"kitty/database"
+	"net"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSServer is built-in HTTPS with certificates from an ACME CA, configured
+// through environment variables:
+//
+//   - KITTY_TLS: "acme" to enable it. Without it the instance serves plain
+//     HTTP and expects a reverse proxy to handle TLS
+//   - KITTY_ACME_EMAIL: contact address given to the CA, optional
+//   - KITTY_ACME_DIRECTORY_URL: defaults to Let's Encrypt. Point it at a local
+//     test server like Pebble (https://localhost:14000/dir) for testing
+//   - KITTY_ACME_CA_CERT: PEM file with extra roots to trust when talking to
+//     the CA, for test servers with their own certificate
+//   - KITTY_TLS_CACHE: where certificates are stored, "db" (the default) or
+//     "dir"
+//   - KITTY_TLS_CACHE_DIR: directory used with KITTY_TLS_CACHE=dir, defaults
+//     to "certs"
+//   - KITTY_HTTP_ADDR / KITTY_HTTPS_ADDR: addresses to listen on, default to
+//     :80 and :443
+//
+// Certificates are only requested for the primary host and verified custom
+// domains, anyone can point a domain at the instance but that mustn't make us
+// ask the CA for certificates on their behalf.
+type TLSServer struct {
+	HTTPAddr  string
+	HTTPSAddr string
+	Manager   *autocert.Manager
+}
+
+// GetTLSServer returns the TLS configuration, or nil when built-in TLS is
+// disabled.
+func GetTLSServer() (*TLSServer, error) {
+	switch mode := os.Getenv("KITTY_TLS"); mode {
+	case "":
+		return nil, nil
+	case "acme":
+	default:
+		return nil, fmt.Errorf("unknown KITTY_TLS %q, the only supported value is acme", mode)
+	}
+
+	cache, err := getACMECache()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{DirectoryURL: os.Getenv("KITTY_ACME_DIRECTORY_URL")}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if caFile := os.Getenv("KITTY_ACME_CA_CERT"); caFile != "" {
+		client.HTTPClient, err = httpClientTrusting(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      cache,
+		HostPolicy: acmeHostPolicy,
+		Client:     client,
+		Email:      os.Getenv("KITTY_ACME_EMAIL"),
+	}
+
+	return &TLSServer{
+		HTTPAddr:  envOrDefault("KITTY_HTTP_ADDR", ":80"),
+		HTTPSAddr: envOrDefault("KITTY_HTTPS_ADDR", ":443"),
+		Manager:   manager,
+	}, nil
+}
+
+func envOrDefault(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getACMECache() (autocert.Cache, error) {
+	switch kind := os.Getenv("KITTY_TLS_CACHE"); kind {
+	case "", "db":
+		return database.ACMECache{}, nil
+	case "dir":
+		return autocert.DirCache(envOrDefault("KITTY_TLS_CACHE_DIR", "certs")), nil
+	default:
+		return nil, fmt.Errorf("unknown KITTY_TLS_CACHE %q, use db or dir", kind)
+	}
+}
+
+func httpClientTrusting(caFile string) (*http.Client, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading KITTY_ACME_CA_CERT: %w", err)
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, errors.New("KITTY_ACME_CA_CERT doesn't contain any PEM certificate")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	return &http.Client{Transport: transport}, nil
+}
+
+func acmeHostPolicy(ctx context.Context, host string) error {
+	if host == PrimaryHost() {
+		return nil
+	}
+
+	_, ok, err := database.LookupVerifiedDomain(host)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%q isn't a verified custom domain", host)
+	}
+	return nil
+}
+
+// TLSConfig is used by the HTTPS server, it gets certificates from the
+// manager and answers tls-alpn-01 challenges.
+func (s *TLSServer) TLSConfig() *tls.Config {
+	return s.Manager.TLSConfig()
+}
+
+// HTTPHandler answers http-01 challenges and sends everything else to
+// HTTPS. GET and HEAD get a 301, other methods a 308 so that clients repeat
+// the same request.
+func (s *TLSServer) HTTPHandler() http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(s.HTTPSAddr)
+
+	return s.Manager.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := requestHost(r)
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		status := http.StatusPermanentRedirect
+		if r.Method == "GET" || r.Method == "HEAD" {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	}))
+}
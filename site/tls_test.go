@@ -0,0 +1,68 @@
+package site
+
+import (
+	"context"
+	"testing"
+
+	"kitty/database"
+)
+
+// claimTestDomain claims domain for a new user, verifying it if asked to.
+func claimTestDomain(t *testing.T, username string, domain string, verified bool) *database.AdminUser {
+	t.Helper()
+
+	user := createTestUser(t, username)
+	if err := database.ClaimCustomDomain(user.ID, domain, "token"); err != nil {
+		t.Fatal(err)
+	}
+	if verified {
+		customDomain, err := database.GetCustomDomain(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := database.MarkCustomDomainVerified(customDomain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return user
+}
+
+func TestACMEHostPolicy(t *testing.T) {
+	claimTestDomain(t, "verified-domain", "verified.example.com", true)
+	claimTestDomain(t, "unverified-domain", "unverified.example.com", false)
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{PrimaryHost(), true},
+		{"verified.example.com", true},
+		{"unverified.example.com", false},
+		{"unknown.example.com", false},
+		{"", false},
+	}
+
+	for _, tc := range tests {
+		err := acmeHostPolicy(context.Background(), tc.host)
+		if tc.allowed && err != nil {
+			t.Errorf("acmeHostPolicy(%q) = %v, want the host to be allowed", tc.host, err)
+		}
+		if !tc.allowed && err == nil {
+			t.Errorf("acmeHostPolicy(%q) allowed the host", tc.host)
+		}
+	}
+}
+
+func TestACMEHostPolicyForgetsRemovedDomains(t *testing.T) {
+	user := claimTestDomain(t, "removed-domain", "removed.example.com", true)
+	if err := acmeHostPolicy(context.Background(), "removed.example.com"); err != nil {
+		t.Fatalf("acmeHostPolicy() = %v before the domain was removed", err)
+	}
+
+	if err := database.DeleteCustomDomain(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := acmeHostPolicy(context.Background(), "removed.example.com"); err == nil {
+		t.Error("acmeHostPolicy() still allows a removed domain")
+	}
+}
@@ -0,0 +1,71 @@
+package site
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"kitty/database"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// upvoterHash identifies a reader upvoting a post. It's keyed with the
+// instance's signing key so that it can't be matched with IP addresses.
+func upvoterHash(r *http.Request, post *database.Post) (string, error) {
+	settings, err := database.GetInstanceSettings()
+	if err != nil {
+		return "", err
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	mac := hmac.New(sha256.New, settings.SigningKey)
+	mac.Write([]byte("upvote:" + ip + ":" + strconv.Itoa(int(post.ID))))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// UpvotePost adds the reader's upvote to a post anyone can read. Forms are
+// sent back to the post, clients asking for JSON get the new count.
+func UpvotePost(w http.ResponseWriter, r *http.Request) {
+	var post database.Post
+	result := database.GetDB().First(&post, chi.URLParam(r, "postID"))
+	if result.Error != nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	var author database.AdminUser
+	result = database.GetDB().First(&author, post.AdminUserID)
+	if result.Error != nil || author.IsSuspended() || post.HiddenByAdmin ||
+		!post.IsReadableByURL() || !canReadProtectedPost(r, &post) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	voterHash, err := upvoterHash(r, &post)
+	if err != nil {
+		http.Error(w, "Error saving the upvote", http.StatusInternalServerError)
+		return
+	}
+
+	upvotes, err := database.AddUpvote(&post, voterHash)
+	if err != nil {
+		http.Error(w, "Error saving the upvote", http.StatusInternalServerError)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"upvotes": upvotes})
+		return
+	}
+	http.Redirect(w, r, "/post/"+strconv.Itoa(int(post.ID))+"#upvotes", http.StatusSeeOther)
+}
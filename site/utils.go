@@ -3,7 +3,6 @@ package site
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"kitty/constants"
@@ -13,8 +12,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
-	"gorm.io/datatypes"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type AdminCookieName string
@@ -50,17 +50,40 @@ func tryParseDate(dateStr string) (time.Time, error) {
 	return time.Time{}, fmt.Errorf("unable to parse date: %s", dateStr)
 }
 
-func buildPostFromFormRequest(r *http.Request) (database.Post, error) {
+// parseTagList reads a comma separated list of tags, see
+// database.NormalizeTagNames.
+func parseTagList(list string) ([]string, error) {
+	return validateTagNames(strings.Split(list, ","))
+}
+
+// validateTagNames normalizes the tag names given for a post, checking that
+// there aren't too many of them and that they aren't too long.
+func validateTagNames(names []string) ([]string, error) {
+	tags := database.NormalizeTagNames(names)
+	if len(tags) > constants.MAX_TAGS_PER_POST {
+		return nil, fmt.Errorf("posts can't have more than %d tags", constants.MAX_TAGS_PER_POST)
+	}
+	for _, tag := range tags {
+		if utf8.RuneCountInString(tag) > constants.MAX_TAG_LENGTH {
+			return nil, fmt.Errorf("tags can't be longer than %d characters", constants.MAX_TAG_LENGTH)
+		}
+	}
+	return tags, nil
+}
+
+// buildPostFromFormRequest returns the post described by the form along with
+// its tags, which are saved separately with database.SetPostTags.
+func buildPostFromFormRequest(r *http.Request) (database.Post, []string, error) {
 	adminUser := getSignedInUserOrNil(r)
 	if adminUser == nil {
-		return database.Post{}, errors.New("user not signed in")
+		return database.Post{}, nil, errors.New("user not signed in")
 	}
 
 	title := r.FormValue("title")
 	body := r.FormValue("body")
 
 	if len(body) > constants.MAX_POST_LENGTH {
-		return database.Post{}, errors.New("post body too long. It must be less than " + strconv.Itoa(constants.MAX_POST_LENGTH) + " characters")
+		return database.Post{}, nil, errors.New("post body too long. It must be less than " + strconv.Itoa(constants.MAX_POST_LENGTH) + " characters")
 	}
 
 	slug := r.FormValue("slug")
@@ -69,12 +92,20 @@ func buildPostFromFormRequest(r *http.Request) (database.Post, error) {
 	metaDescription := r.FormValue("metaDescription")
 	metaImage := r.FormValue("metaImage")
 	lang := r.FormValue("lang")
-	tags := r.FormValue("tags")
 	published := r.FormValue("published") == "on"
+	noIndex := r.FormValue("noIndex") == "on"
+	commentsEnabled := r.FormValue("commentsEnabled") == "on"
+
+	visibility := database.PostVisibility(r.FormValue("visibility"))
+	if visibility == "" {
+		visibility = database.PostVisibilityPublic
+	} else if !database.IsValidPostVisibility(visibility) {
+		return database.Post{}, nil, errors.New("unknown visibility: " + string(visibility))
+	}
 
-	tagsJSON, err := json.Marshal(strings.Split(tags, ","))
+	tags, err := parseTagList(r.FormValue("tags"))
 	if err != nil {
-		return database.Post{}, errors.New("failed to parse post tags")
+		return database.Post{}, nil, err
 	}
 
 	newPost := database.Post{
@@ -87,11 +118,18 @@ func buildPostFromFormRequest(r *http.Request) (database.Post, error) {
 		MetaDescription: metaDescription,
 		MetaImage:       metaImage,
 		Lang:            lang,
-		Tags:            datatypes.JSON(tagsJSON),
 		Published:       published,
+		NoIndex:         noIndex,
+		Visibility:      visibility,
+		CommentsEnabled: commentsEnabled,
 	}
 
-	return newPost, nil
+	if r.FormValue("render_custom") == "on" {
+		renderOptions := renderOptionsFromForm(r)
+		newPost.RenderOptions = &renderOptions
+	}
+
+	return newPost, tags, nil
 }
 
 func getSignedInUserOrNil(r *http.Request) *database.AdminUser {
@@ -118,3 +156,69 @@ func generateAuthToken() (string, error) {
 	token := base64.URLEncoding.EncodeToString(tokenBytes)
 	return token, nil
 }
+
+// localRedirectPath returns next if it's a path on this site, where it's safe
+// to send the user back to after signing in, and the dashboard otherwise.
+func localRedirectPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/dashboard"
+	}
+	return next
+}
+
+func setSessionCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:  string(AuthenticatedUserTokenCookieName),
+		Value: token,
+		Path:  "/",
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   string(AuthenticatedUserTokenCookieName),
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// reauthenticationWindow is how long after signing in users without a
+// password can make sensitive changes.
+const reauthenticationWindow = 10 * time.Minute
+
+var (
+	errIncorrectPassword = errors.New("password is incorrect")
+	errSignInAgain       = errors.New("for your security, sign in again before making this change")
+)
+
+// checkCurrentPassword is used to re-authenticate a signed in user before a
+// sensitive change. Users that only ever signed in through single sign-on
+// don't have a password, so they must have signed in recently instead.
+func checkCurrentPassword(user *database.AdminUser, password string) error {
+	if len(user.PasswordHash) == 0 {
+		if user.SignedInAt == nil || time.Since(*user.SignedInAt) > reauthenticationWindow {
+			return errSignInAgain
+		}
+		return nil
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return errIncorrectPassword
+	}
+	return nil
+}
+
+// needsReauthentication tells whether checkCurrentPassword would ask user to
+// sign in again whatever they type.
+func needsReauthentication(user *database.AdminUser) bool {
+	return len(user.PasswordHash) == 0 && checkCurrentPassword(user, "") != nil
+}
+
+func tagNames(tags []database.Tag) []string {
+	names := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		names = append(names, tag.Name)
+	}
+	return names
+}
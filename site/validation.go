@@ -0,0 +1,105 @@
+package site
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores anything past 72 bytes
+)
+
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// reservedUsernames can't be registered, either because they clash with a
+// route or because they could be used to impersonate the instance.
+var reservedUsernames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"assets":        true,
+	"dashboard":     true,
+	"kitty":         true,
+	"logout":        true,
+	"moderator":     true,
+	"post":          true,
+	"root":          true,
+	"signin":        true,
+	"signup":        true,
+	"staff":         true,
+	"support":       true,
+	"system":        true,
+	"u":             true,
+	"www":           true,
+}
+
+func validateUsername(username string) error {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return fmt.Errorf("username must be between %d and %d characters long", minUsernameLength, maxUsernameLength)
+	}
+
+	if !usernameRegex.MatchString(username) {
+		return errors.New("username can only contain letters, numbers, '_' and '-'")
+	}
+
+	if reservedUsernames[strings.ToLower(username)] {
+		return fmt.Errorf("the username '%s' is reserved", username)
+	}
+
+	return nil
+}
+
+func validatePassword(password string, username string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+	}
+
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password can't be longer than %d characters", maxPasswordLength)
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errors.New("password can't contain your username")
+	}
+
+	// require at least two kinds of characters, so that things like
+	// "aaaaaaaa" or "12345678" are rejected
+	var hasLetter, hasDigit, hasOther bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLetter(c):
+			hasLetter = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		default:
+			hasOther = true
+		}
+	}
+
+	kinds := 0
+	for _, has := range []bool{hasLetter, hasDigit, hasOther} {
+		if has {
+			kinds++
+		}
+	}
+	if kinds < 2 {
+		return errors.New("password must mix at least two of: letters, numbers, symbols")
+	}
+
+	return nil
+}
+
+// asSentence upper-cases the first letter of an error message and adds a
+// trailing period so it can be shown to the user.
+func asSentence(msg string) string {
+	if msg == "" {
+		return msg
+	}
+	return strings.ToUpper(msg[:1]) + msg[1:] + "."
+}
@@ -0,0 +1,233 @@
+package site
+
+import (
+	"context"
+	"errors"
+	"kitty/database"
+	"kitty/webmention"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+const (
+	maxWebmentionURLLength   = 2000
+	maxWebmentionTitleLength = 200
+	// links of a post beyond this many aren't sent Webmentions
+	maxWebmentionTargets = 50
+	// how long sending or verifying a single Webmention can take
+	webmentionTimeout = 30 * time.Second
+)
+
+func webmentionEndpoint() string {
+	return PublicURL() + "/webmention"
+}
+
+// advertiseWebmentionEndpoint tells the sites linking to a post where to
+// send their Webmentions. Post pages also have a <link> to it.
+func advertiseWebmentionEndpoint(w http.ResponseWriter) {
+	w.Header().Add("Link", "<"+webmentionEndpoint()+`>; rel="webmention"`)
+}
+
+// isMentionable reports whether a post can be the source or the target of
+// Webmentions, which requires anyone to be able to read it.
+func isMentionable(post *database.Post, author *database.AdminUser) bool {
+	return post.IsReadableByURL() && !post.HiddenByAdmin && !post.IsPasswordProtected() && !author.IsSuspended()
+}
+
+// findPostByURL finds the post at a URL of the instance, which can be its
+// /post page or its place on its author's blog. It returns nil when the URL
+// isn't one of a post. Only readable posts have a blog URL, but /post URLs
+// can be those of drafts, private and hidden posts.
+func findPostByURL(rawURL string) (*database.Post, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil
+	}
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	path := strings.TrimSuffix(parsed.Path, "/")
+
+	var query *gorm.DB
+	if host == PrimaryHost() {
+		if id, ok := strings.CutPrefix(path, "/post/"); ok {
+			postID, err := strconv.Atoi(id)
+			if err != nil {
+				return nil, nil
+			}
+			query = database.GetDB().Where("id = ?", postID)
+		} else if rest, ok := strings.CutPrefix(path, "/b/"); ok {
+			username, slug, ok := strings.Cut(rest, "/")
+			if !ok {
+				return nil, nil
+			}
+			user, _, err := loadPublicBlog(username)
+			if err != nil || user == nil {
+				return nil, err
+			}
+			query = readablePostsQuery(user.ID).Where("slug = ?", slug)
+		} else {
+			return nil, nil
+		}
+	} else {
+		userID, ok, err := database.LookupVerifiedDomain(host)
+		if err != nil || !ok {
+			return nil, err
+		}
+		var user database.AdminUser
+		if err := database.GetDB().First(&user, userID).Error; err != nil {
+			return nil, err
+		}
+		b, err := getBlog(&user)
+		if err != nil || !b.Enabled {
+			return nil, err
+		}
+		query = readablePostsQuery(userID).Where("slug = ?", strings.TrimPrefix(path, "/"))
+	}
+
+	var post database.Post
+	result := query.First(&post)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	return &post, nil
+}
+
+// postFromTargetURL finds the post a Webmention target points at, returning
+// nil when the URL isn't one of a post that can be mentioned.
+func postFromTargetURL(target string) (*database.Post, error) {
+	post, err := findPostByURL(target)
+	if err != nil || post == nil {
+		return nil, err
+	}
+
+	var author database.AdminUser
+	result := database.GetDB().First(&author, post.AdminUserID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if !isMentionable(post, &author) {
+		return nil, nil
+	}
+	return post, nil
+}
+
+// ReceiveWebmention takes a Webmention from another site. The source is
+// fetched in the background, the mention is only shown once it's confirmed
+// to link to the post.
+func ReceiveWebmention(w http.ResponseWriter, r *http.Request) {
+	source := strings.TrimSpace(r.FormValue("source"))
+	target := strings.TrimSpace(r.FormValue("target"))
+
+	if !webmention.IsHTTPURL(source) || !webmention.IsHTTPURL(target) ||
+		len(source) > maxWebmentionURLLength || len(target) > maxWebmentionURLLength {
+		http.Error(w, "source and target must be http(s) URLs", http.StatusBadRequest)
+		return
+	}
+	if source == target {
+		http.Error(w, "source and target must be different", http.StatusBadRequest)
+		return
+	}
+
+	post, err := postFromTargetURL(target)
+	if err != nil {
+		http.Error(w, "Error fetching post", http.StatusInternalServerError)
+		return
+	} else if post == nil {
+		http.Error(w, "target isn't a post accepting Webmentions", http.StatusBadRequest)
+		return
+	}
+
+	mention, err := database.SaveWebmention(post.ID, source, target)
+	if err != nil {
+		http.Error(w, "Error saving the Webmention", http.StatusInternalServerError)
+		return
+	}
+	go verifyWebmention(mention)
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("The Webmention will be verified shortly.\n"))
+}
+
+func verifyWebmention(mention *database.Webmention) {
+	ctx, cancel := context.WithTimeout(context.Background(), webmentionTimeout)
+	defer cancel()
+
+	src, err := webmention.Verify(ctx, mention.Source, mention.Target)
+	if errors.Is(err, webmention.ErrNoLink) || errors.Is(err, webmention.ErrSourceGone) {
+		err = database.SetWebmentionInvalid(mention)
+	} else if err == nil {
+		title := src.Title
+		if utf8.RuneCountInString(title) > maxWebmentionTitleLength {
+			title = string([]rune(title)[:maxWebmentionTitleLength]) + "…"
+		}
+		err = database.SetWebmentionVerified(mention, title)
+	}
+	if err != nil {
+		log.Printf("Failed to verify the Webmention from %s: %v", mention.Source, err)
+	}
+}
+
+// postLinks returns the URLs the post links to.
+func postLinks(post *database.Post, author *database.AdminUser) []string {
+	return webmention.ExtractLinks(string(renderMarkdown(post.Body, effectiveRenderOptions(post, author))))
+}
+
+// sendPostWebmentions notifies the sites linked from a post that was just
+// saved, previous being its version before the save or nil for new posts.
+// Links removed by the edit are notified too, so that their sites notice.
+func sendPostWebmentions(previous *database.Post, post *database.Post, author *database.AdminUser) {
+	var targets []string
+	seen := map[string]bool{}
+	for _, p := range []*database.Post{post, previous} {
+		if p == nil || !isMentionable(p, author) {
+			continue
+		}
+		for _, link := range postLinks(p, author) {
+			if !seen[link] {
+				seen[link] = true
+				targets = append(targets, link)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	if len(targets) > maxWebmentionTargets {
+		targets = targets[:maxWebmentionTargets]
+	}
+
+	_, postURL, err := userURLs(author)
+	if err != nil {
+		log.Printf("Failed to send the Webmentions of post %d: %v", post.ID, err)
+		return
+	}
+	source := postURL(post)
+
+	// the author shouldn't wait for other sites
+	go func() {
+		for _, target := range targets {
+			if err := sendWebmention(source, target); err != nil {
+				log.Printf("Failed to send a Webmention to %s: %v", target, err)
+			}
+		}
+	}()
+}
+
+func sendWebmention(source string, target string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webmentionTimeout)
+	defer cancel()
+
+	endpoint, err := webmention.DiscoverEndpoint(ctx, target)
+	if err != nil || endpoint == "" {
+		return err
+	}
+	return webmention.Send(ctx, endpoint, source, target)
+}
@@ -0,0 +1,340 @@
+// Package webmention sends Webmentions and verifies received ones, as
+// described in https://www.w3.org/TR/webmention/.
+package webmention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// pages bigger than this are only read up to it
+	maxBodySize = 1 << 20
+	timeout     = 10 * time.Second
+	userAgent   = "Kitty Webmention (+https://www.w3.org/TR/webmention/)"
+)
+
+var (
+	// ErrSourceGone is returned by Verify when the source was deleted (or
+	// never existed), in which case the mention should be deleted too.
+	ErrSourceGone = errors.New("the source page is gone")
+	// ErrNoLink is returned by Verify when the source doesn't link to the
+	// target.
+	ErrNoLink = errors.New("the source page doesn't link to the target")
+
+	errPrivateAddress = errors.New("refusing to connect to a private address")
+)
+
+var (
+	client     *http.Client
+	clientLock sync.Mutex
+)
+
+// getClient returns the HTTP client used to reach other sites. Unless
+// KITTY_WEBMENTION_ALLOW_PRIVATE is "true", it refuses to connect to
+// loopback and private addresses, so that mentions can't be used to probe the
+// instance's network. Allowing them is meant for testing against local
+// servers.
+func getClient() *http.Client {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+
+	if client == nil {
+		client = newClient(os.Getenv("KITTY_WEBMENTION_ALLOW_PRIVATE") == "true")
+	}
+	return client
+}
+
+// SetClient replaces the HTTP client, for example with one reaching a local
+// stand-in server.
+func SetClient(c *http.Client) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+
+	client = c
+}
+
+func newClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// IsHTTPURL reports whether rawURL is an absolute http(s) URL, the only kind
+// of URL that can be mentioned.
+func IsHTTPURL(rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+func get(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "text/html, */*;q=0.5")
+	return getClient().Do(req)
+}
+
+func isHTML(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+func hasRel(rel string, value string) bool {
+	for _, r := range strings.Fields(strings.ToLower(rel)) {
+		if r == value {
+			return true
+		}
+	}
+	return false
+}
+
+// linkHeaderEndpoint returns the URL of the first Link header with the
+// "webmention" relation, if any.
+func linkHeaderEndpoint(header http.Header) (string, bool) {
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			target, params, ok := strings.Cut(link, ";")
+			if !ok {
+				continue
+			}
+			target = strings.TrimSpace(target)
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range strings.Split(params, ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(name, "rel") && hasRel(strings.Trim(value, `"`), "webmention") {
+					return strings.Trim(target, "<>"), true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+func attr(node *html.Node, name string) (string, bool) {
+	for _, a := range node.Attr {
+		if a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// walk calls visit for every element of the document, in document order,
+// until it returns false.
+func walk(node *html.Node, visit func(*html.Node) bool) bool {
+	if node.Type == html.ElementNode && !visit(node) {
+		return false
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if !walk(child, visit) {
+			return false
+		}
+	}
+	return true
+}
+
+// DiscoverEndpoint returns the Webmention endpoint of target, or "" when it
+// doesn't have one.
+func DiscoverEndpoint(ctx context.Context, target string) (string, error) {
+	resp, err := get(ctx, target)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("fetching %s: %s", target, resp.Status)
+	}
+	// relative endpoints are resolved against the URL after redirects
+	base := resp.Request.URL
+
+	endpoint, found := linkHeaderEndpoint(resp.Header)
+	if !found && isHTML(resp) {
+		doc, err := html.Parse(io.LimitReader(resp.Body, maxBodySize))
+		if err != nil {
+			return "", err
+		}
+		walk(doc, func(node *html.Node) bool {
+			if node.Data != "link" && node.Data != "a" {
+				return true
+			}
+			rel, _ := attr(node, "rel")
+			href, hasHref := attr(node, "href")
+			if hasHref && hasRel(rel, "webmention") {
+				endpoint, found = href, true
+				return false
+			}
+			return true
+		})
+	}
+	if !found {
+		return "", nil
+	}
+
+	ref, err := url.Parse(strings.TrimSpace(endpoint))
+	if err != nil {
+		return "", err
+	}
+	resolved := base.ResolveReference(ref).String()
+	if !IsHTTPURL(resolved) {
+		return "", nil
+	}
+	return resolved, nil
+}
+
+// Send notifies the endpoint that source mentions target.
+func Send(ctx context.Context, endpoint string, source string, target string) error {
+	form := url.Values{"source": {source}, "target": {target}}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := getClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodySize))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sending to %s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Source is what's kept of a page mentioning a post.
+type Source struct {
+	// the page's title, empty when it has none
+	Title string
+}
+
+// Verify checks that source links to target, returning ErrNoLink when it
+// doesn't and ErrSourceGone when the source was deleted.
+func Verify(ctx context.Context, source string, target string) (*Source, error) {
+	resp, err := get(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusNotFound {
+		return nil, ErrSourceGone
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("fetching %s: %s", source, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	base := resp.Request.URL
+
+	if !isHTML(resp) {
+		// plain text and the like mention the target by including it
+		if strings.Contains(string(body), target) {
+			return &Source{}, nil
+		}
+		return nil, ErrNoLink
+	}
+
+	doc, err := html.Parse(strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+
+	var src Source
+	linked := false
+	walk(doc, func(node *html.Node) bool {
+		if node.Data == "title" && src.Title == "" && node.FirstChild != nil {
+			src.Title = strings.TrimSpace(node.FirstChild.Data)
+		}
+		for _, name := range []string{"href", "src"} {
+			value, ok := attr(node, name)
+			if !ok {
+				continue
+			}
+			// relative links count too, once resolved
+			ref, err := url.Parse(strings.TrimSpace(value))
+			if err == nil && base.ResolveReference(ref).String() == target {
+				linked = true
+			}
+		}
+		return true
+	})
+	if !linked {
+		return nil, ErrNoLink
+	}
+	return &src, nil
+}
+
+// ExtractLinks returns the absolute http(s) URLs linked from an HTML
+// fragment, each once, in order.
+func ExtractLinks(fragment string) []string {
+	doc, err := html.Parse(strings.NewReader(fragment))
+	if err != nil {
+		return nil
+	}
+
+	var links []string
+	seen := map[string]bool{}
+	walk(doc, func(node *html.Node) bool {
+		if node.Data != "a" {
+			return true
+		}
+		href, ok := attr(node, "href")
+		href = strings.TrimSpace(href)
+		if ok && IsHTTPURL(href) && !seen[href] {
+			seen[href] = true
+			links = append(links, href)
+		}
+		return true
+	})
+	return links
+}
@@ -0,0 +1,139 @@
+package webmention
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useLocalClient lets the package reach httptest servers for the duration of
+// the test.
+func useLocalClient(t *testing.T) {
+	SetClient(newClient(true))
+	t.Cleanup(func() { SetClient(nil) })
+}
+
+func TestDiscoverEndpoint(t *testing.T) {
+	useLocalClient(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/header", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", `<https://example.com/other>; rel="alternate", <https://example.com/endpoint>; rel="webmention"`)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<link rel="webmention" href="https://example.com/ignored">`))
+	})
+	mux.HandleFunc("/link", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<html><head><link rel="stylesheet" href="/style.css"><link rel="webmention" href="https://example.com/link-endpoint"></head></html>`))
+	})
+	mux.HandleFunc("/anchor", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<p>Mention me at <a rel="nofollow webmention" href="https://example.com/anchor-endpoint">my endpoint</a></p>`))
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/posts/moved/", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/posts/moved/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<link rel="webmention" href="../../webmention?page=moved">`))
+	})
+	mux.HandleFunc("/none", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="https://example.com/">no endpoint here</a>`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/header", "https://example.com/endpoint"},
+		{"/link", "https://example.com/link-endpoint"},
+		{"/anchor", "https://example.com/anchor-endpoint"},
+		{"/moved", server.URL + "/webmention?page=moved"},
+		{"/none", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			got, err := DiscoverEndpoint(context.Background(), server.URL+tc.path)
+			if err != nil {
+				t.Fatalf("DiscoverEndpoint() error = %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("DiscoverEndpoint() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	useLocalClient(t)
+
+	const target = "https://blog.example.com/post/1"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/linked", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title> Reply </title></head><body><a href="https://blog.example.com/post/1">nice post</a></body></html>`))
+	})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+	mux.HandleFunc("/unlinked", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<p>Mentions https://blog.example.com/post/1 without linking it</p>`))
+	})
+	mux.HandleFunc("/relative", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/about">About</a> <a href="../post/1">my own post</a>`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	source, err := Verify(context.Background(), server.URL+"/linked", target)
+	if err != nil {
+		t.Fatalf("Verify() of a linking page: %v", err)
+	}
+	if source.Title != "Reply" {
+		t.Errorf("Title = %q, want %q", source.Title, "Reply")
+	}
+
+	if _, err := Verify(context.Background(), server.URL+"/gone", target); !errors.Is(err, ErrSourceGone) {
+		t.Errorf("Verify() of a 410 page: error = %v, want ErrSourceGone", err)
+	}
+
+	if _, err := Verify(context.Background(), server.URL+"/unlinked", target); !errors.Is(err, ErrNoLink) {
+		t.Errorf("Verify() of a page without a link: error = %v, want ErrNoLink", err)
+	}
+
+	// the target lives on the same server as the source this time
+	if _, err := Verify(context.Background(), server.URL+"/relative", server.URL+"/post/1"); err != nil {
+		t.Errorf("Verify() of a page with a relative link: %v", err)
+	}
+}
+
+func TestClientRefusesPrivateAddresses(t *testing.T) {
+	reached := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer server.Close()
+
+	_, err := newClient(false).Get(server.URL)
+	if !errors.Is(err, errPrivateAddress) {
+		t.Errorf("Get() of a loopback address: error = %v, want errPrivateAddress", err)
+	}
+	if reached {
+		t.Error("the loopback server was reached")
+	}
+
+	resp, err := newClient(true).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() with private addresses allowed: %v", err)
+	}
+	resp.Body.Close()
+}